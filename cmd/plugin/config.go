@@ -0,0 +1,130 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// pluginConfigSelector selects the ConfigMap in the Velero namespace that configures the plugin
+	pluginConfigSelector = "velero.io/plugin-config,astrolabe.io/astrolabe-velero"
+	// unmappedItemPolicyKey in the ConfigMap sets the policy of the backup item action for items with no PE type
+	unmappedItemPolicyKey = "unmappedItemPolicy"
+	// confDirKey in the ConfigMap names an astrolabe config dir mounted into the Velero pod
+	confDirKey = "confDir"
+	// s3ConfigKey and keys ending in peConfigSuffix are written into a generated astrolabe config dir
+	s3ConfigKey    = "s3config.json"
+	peConfigSuffix = ".pe.json"
+
+	defaultConfDir         = "/etc/astrolabe"
+	defaultVeleroNamespace = "velero"
+)
+
+// pluginConfig is read from the plugin ConfigMap
+type pluginConfig struct {
+	confDir            string
+	unmappedItemPolicy string
+}
+
+// loadPluginConfig reads the plugin ConfigMap from the Velero namespace.  The astrolabe config files can either be
+// mounted into the pod, with confDir naming the dir, or be stored in the ConfigMap itself, in which case they are
+// written to a new dir under tmpDir
+func loadPluginConfig(ctx context.Context, config *rest.Config, tmpDir string) (pluginConfig, error) {
+	returnConfig := pluginConfig{
+		confDir: defaultConfDir,
+	}
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return pluginConfig{}, errors.Wrap(err, "could not create Kubernetes client")
+	}
+	namespace := os.Getenv("VELERO_NAMESPACE")
+	if namespace == "" {
+		namespace = defaultVeleroNamespace
+	}
+	configMaps, err := kubeClient.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: pluginConfigSelector,
+	})
+	if err != nil {
+		return pluginConfig{}, errors.Wrapf(err, "could not list plugin ConfigMaps in namespace %s", namespace)
+	}
+	switch len(configMaps.Items) {
+	case 0:
+		return returnConfig, nil
+	case 1:
+	default:
+		return pluginConfig{}, errors.New(fmt.Sprintf("found %d ConfigMaps matching %q in namespace %s, expected one",
+			len(configMaps.Items), pluginConfigSelector, namespace))
+	}
+	configMap := configMaps.Items[0]
+	returnConfig.unmappedItemPolicy = configMap.Data[unmappedItemPolicyKey]
+	if confDir, ok := configMap.Data[confDirKey]; ok {
+		returnConfig.confDir = confDir
+		return returnConfig, nil
+	}
+	if hasConfigFiles(configMap) {
+		returnConfig.confDir, err = writeConfDir(configMap, tmpDir)
+		if err != nil {
+			return pluginConfig{}, err
+		}
+	}
+	return returnConfig, nil
+}
+
+func hasConfigFiles(configMap v1.ConfigMap) bool {
+	for key := range configMap.Data {
+		if key == s3ConfigKey || strings.HasSuffix(key, peConfigSuffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeConfDir lays out the config files in the ConfigMap as an astrolabe config dir, s3config.json at the top and
+// the PE type configs under pes
+func writeConfDir(configMap v1.ConfigMap, tmpDir string) (string, error) {
+	confDir := filepath.Join(tmpDir, "astrolabe-conf")
+	pesDir := filepath.Join(confDir, "pes")
+	if err := os.MkdirAll(pesDir, 0700); err != nil {
+		return "", errors.Wrapf(err, "could not create config dir %s", pesDir)
+	}
+	for key, value := range configMap.Data {
+		var path string
+		switch {
+		case key == s3ConfigKey:
+			path = filepath.Join(confDir, key)
+		case strings.HasSuffix(key, peConfigSuffix):
+			path = filepath.Join(pesDir, key)
+		default:
+			continue
+		}
+		if err := ioutil.WriteFile(path, []byte(value), 0600); err != nil {
+			return "", errors.Wrapf(err, "could not write config file %s", path)
+		}
+	}
+	return confDir, nil
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// The plugin binary runs the astrolabe item actions inside Velero.  Install it with
+// "velero plugin add <image>"; the astrolabe config is read from the ConfigMap described in config.go.
+//
+// The snapshotsDir of the k8sns config must be on persistent storage mounted into the Velero pod, for example a PVC.
+// The snapshot index, the queue of failed component snapshot deletes and the namespace snapshot files are kept there,
+// and they are lost with the pod if it is an emptyDir or the container filesystem
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe-velero/pkg/k8sns"
+	"github.com/vmware-tanzu/astrolabe-velero/pkg/pvc"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"github.com/vmware-tanzu/astrolabe/pkg/psql"
+	"github.com/vmware-tanzu/astrolabe/pkg/server"
+	"github.com/vmware-tanzu/velero/pkg/plugin/framework"
+	"io/ioutil"
+	"k8s.io/client-go/tools/clientcmd"
+	"os"
+	"sync"
+	"time"
+)
+
+// Names the item actions are registered with in Velero
+const (
+	backupItemActionName  = "astrolabe.io/component-backup"
+	restoreItemActionName = "astrolabe.io/component-restore"
+	deleteItemActionName  = "astrolabe.io/component-delete"
+)
+
+func main() {
+	framework.NewServer().
+		RegisterBackupItemAction(backupItemActionName, newBackupItemAction).
+		RegisterRestoreItemAction(restoreItemActionName, newRestoreItemAction).
+		RegisterDeleteItemAction(deleteItemActionName, newDeleteItemAction).
+		Serve()
+}
+
+// pluginState is shared by the item actions of the plugin process, so that the PEM is only set up once however many
+// actions Velero asks for
+type pluginState struct {
+	pem                astrolabe.ProtectedEntityManager
+	k8snsPetm          *k8sns.KubernetesNamespaceProtectedEntityTypeManager
+	clusterID          string
+	unmappedItemPolicy k8sns.UnmappedItemPolicy
+}
+
+var (
+	stateMutex sync.Mutex
+	state      *pluginState
+)
+
+// getPluginState initializes the plugin state on first use.  A failed initialization is not kept, so that the next
+// action Velero asks for tries again, e.g. once the ConfigMap has been fixed or the API server is reachable
+func getPluginState(logger logrus.FieldLogger) (pluginState, error) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	if state != nil {
+		return *state, nil
+	}
+	newState, err := initPluginState(logger)
+	if err != nil {
+		return pluginState{}, err
+	}
+	state = &newState
+	return newState, nil
+}
+
+func initPluginState(logger logrus.FieldLogger) (pluginState, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+	if err != nil {
+		return pluginState{}, errors.Wrap(err, "could not load Kubernetes config")
+	}
+	tmpDir, err := ioutil.TempDir("", "astrolabe-velero-plugin")
+	if err != nil {
+		return pluginState{}, errors.Wrap(err, "could not create temp dir")
+	}
+	initialized := false
+	defer func() {
+		if !initialized {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+	pluginConf, err := loadPluginConfig(context.Background(), config, tmpDir)
+	if err != nil {
+		return pluginState{}, err
+	}
+	unmappedItemPolicy := k8sns.SkipUnmappedItems
+	switch k8sns.UnmappedItemPolicy(pluginConf.unmappedItemPolicy) {
+	case "", k8sns.SkipUnmappedItems:
+	case k8sns.FailUnmappedItems:
+		unmappedItemPolicy = k8sns.FailUnmappedItems
+	default:
+		return pluginState{}, errors.New(fmt.Sprintf("unknown %s %q, expected %s or %s", unmappedItemPolicyKey,
+			pluginConf.unmappedItemPolicy, k8sns.SkipUnmappedItems, k8sns.FailUnmappedItems))
+	}
+	logger.Infof("Loading astrolabe config from %s", pluginConf.confDir)
+
+	addonInitFuncs := make(map[string]server.InitFunc)
+	addonInitFuncs[k8sns.Typename] = k8sns.NewKubernetesNamespaceProtectedEntityTypeManagerFromConfig
+	addonInitFuncs[psql.Typename] = psql.NewPSQLProtectedEntityTypeManager
+	addonInitFuncs[pvc.Typename] = pvc.NewPVCProtectedEntityTypeManagerFromConfig
+	pem, err := server.NewDirectProtectedEntityManagerFromConfigDir(pluginConf.confDir, addonInitFuncs, logger)
+	if err != nil {
+		return pluginState{}, errors.Wrapf(err, "could not initialize astrolabe from %s", pluginConf.confDir)
+	}
+	petm := pem.GetProtectedEntityTypeManager(k8sns.Typename)
+	if petm == nil {
+		return pluginState{}, errors.New("no " + k8sns.Typename + " type manager configured in " + pluginConf.confDir)
+	}
+	k8snsPetm, ok := petm.(*k8sns.KubernetesNamespaceProtectedEntityTypeManager)
+	if !ok {
+		return pluginState{}, errors.New("k8sns PETM returned is not a k8sns.KubernetesNamespaceProtectedEntityTypeManager")
+	}
+	k8snsPetm.SetProtectedEntityManager(pem)
+	clusterID, err := k8snsPetm.GetClusterID(context.Background())
+	if err != nil {
+		return pluginState{}, err
+	}
+	initialized = true
+	return pluginState{
+		pem:                pem,
+		k8snsPetm:          k8snsPetm,
+		clusterID:          clusterID,
+		unmappedItemPolicy: unmappedItemPolicy,
+	}, nil
+}
+
+// newBackupItemAction always takes component snapshots synchronously, Velero does not wait for snapshots taken in the
+// background before it completes the backup
+func newBackupItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	state, err := getPluginState(logger)
+	if err != nil {
+		return nil, err
+	}
+	componentMappings, err := state.k8snsPetm.GetComponentMappings(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return k8sns.NewAstrolabeBackupItemAction(k8sns.BackupItemActionOptions{
+		PEM:                   state.pem,
+		ComponentMappings:     componentMappings,
+		SnapshotParamDefaults: state.k8snsPetm.GetComponentSnapshotParams(),
+		DiscoveryHelper:       state.k8snsPetm.GetDiscoveryHelper(),
+		RelatedResourceFinder: state.k8snsPetm.GetRelatedResourceFinder(),
+		SnapshotIndex:         state.k8snsPetm.GetSnapshotIndex(),
+		ClusterID:             state.clusterID,
+		UnmappedItemPolicy:    state.unmappedItemPolicy,
+		Logger:                logger,
+	})
+}
+
+func newRestoreItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	state, err := getPluginState(logger)
+	if err != nil {
+		return nil, err
+	}
+	componentMappings, err := state.k8snsPetm.GetComponentMappings(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return k8sns.NewAstrolabeRestoreItemAction(state.pem, componentMappings, nil, logger)
+}
+
+// deleteRetryInterval is how often component snapshots that could not be deleted are retried while the plugin
+// process is alive
+const deleteRetryInterval = 5 * time.Minute
+
+var deleteRetryOnce sync.Once
+
+// newDeleteItemAction starts retrying the queued deletes in the background, once per plugin process.  Velero only
+// keeps the plugin process alive for the duration of an operation, so the queue is retried straight away as well
+func newDeleteItemAction(logger logrus.FieldLogger) (interface{}, error) {
+	state, err := getPluginState(logger)
+	if err != nil {
+		return nil, err
+	}
+	deleteRetryOnce.Do(func() {
+		go state.k8snsPetm.GetDeleteRetryQueue().RunPeriodically(context.Background(), state.pem, deleteRetryInterval)
+	})
+	componentMappings, err := state.k8snsPetm.GetComponentMappings(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return k8sns.NewAstrolabeDeleteItemAction(state.pem, componentMappings,
+		state.k8snsPetm.GetDeleteRetryQueue(), state.k8snsPetm.GetSnapshotIndex(), state.k8snsPetm.GetOperationTracker(), logger)
+}
@@ -17,20 +17,28 @@
 package main
 
 import (
+	"context"
+	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/astrolabe-velero/pkg/k8sns"
+	"github.com/vmware-tanzu/astrolabe-velero/pkg/pvc"
 	"github.com/vmware-tanzu/astrolabe/pkg/psql"
 	"github.com/vmware-tanzu/astrolabe/pkg/server"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	"log"
+	"time"
 )
 
+// deleteRetryInterval is how often component snapshots that could not be deleted are retried
+const deleteRetryInterval = 15 * time.Minute
+
 func main() {
 	addonInitFuncs := make(map[string]server.InitFunc)
 	addonInitFuncs["k8sns"] = k8sns.NewKubernetesNamespaceProtectedEntityTypeManagerFromConfig
 	addonInitFuncs["psql"] = psql.NewPSQLProtectedEntityTypeManager
+	addonInitFuncs[pvc.Typename] = pvc.NewPVCProtectedEntityTypeManagerFromConfig
 	server, pem, err := server.ServerInit(addonInitFuncs)
 	if err != nil {
-		log.Fatalln("Error initializing server = %v\n", err)
+		log.Fatalf("Error initializing server = %v\n", err)
 	}
 	petm := pem.GetProtectedEntityTypeManager(k8sns.Typename)
 	if petm == nil {
@@ -40,14 +48,45 @@ func main() {
 	if !ok {
 		log.Fatalln("k8sns PETM returned is not a k8sns.KubernetesNamespaceProtectedEntityTypeManager")
 	}
-	astrolabeBackupAction, err := k8sns.NewAstrolabeBackupItemAction(pem)
+	clusterID, err := k8snsPetm.GetClusterID(context.Background())
+	if err != nil {
+		log.Fatalf("Error retrieving cluster ID %v\n", err)
+	}
+	componentMappings, err := k8snsPetm.GetComponentMappings(context.Background())
 	if err != nil {
-		log.Fatalln("Error initializing AstrolabeBackupItemAction %v\n", err)
+		log.Fatalf("Error loading component mappings %v\n", err)
+	}
+	astrolabeBackupAction, err := k8sns.NewAstrolabeBackupItemAction(k8sns.BackupItemActionOptions{
+		PEM:                   pem,
+		ComponentMappings:     componentMappings,
+		SnapshotParamDefaults: k8snsPetm.GetComponentSnapshotParams(),
+		DiscoveryHelper:       k8snsPetm.GetDiscoveryHelper(),
+		RelatedResourceFinder: k8snsPetm.GetRelatedResourceFinder(),
+		SnapshotIndex:         k8snsPetm.GetSnapshotIndex(),
+		OperationTracker:      k8snsPetm.GetOperationTracker(),
+		ClusterID:             clusterID,
+		UnmappedItemPolicy:    k8snsPetm.GetUnmappedItemPolicy(),
+		Logger:                logrus.StandardLogger(),
+	})
+	if err != nil {
+		log.Fatalf("Error initializing AstrolabeBackupItemAction %v\n", err)
 	}
 	actions := []velero.BackupItemAction{
 		astrolabeBackupAction,
 	}
 	k8snsPetm.SetActions(actions)
+	astrolabeRestoreAction, err := k8sns.NewAstrolabeRestoreItemAction(pem, componentMappings,
+		k8snsPetm.GetOperationTracker(), logrus.StandardLogger())
+	if err != nil {
+		log.Fatalf("Error initializing AstrolabeRestoreItemAction %v\n", err)
+	}
+	k8snsPetm.SetRestoreActions([]velero.RestoreItemAction{
+		astrolabeRestoreAction,
+	})
+	k8snsPetm.SetProtectedEntityManager(pem)
+	retryCtx, cancelRetries := context.WithCancel(context.Background())
+	defer cancelRetries()
+	go k8snsPetm.GetDeleteRetryQueue().RunPeriodically(retryCtx, pem, deleteRetryInterval)
 	defer server.Shutdown()
 
 	// serve API
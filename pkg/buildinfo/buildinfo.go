@@ -0,0 +1,22 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package buildinfo holds the version of astrolabe-velero, set at build time with
+// -ldflags "-X github.com/vmware-tanzu/astrolabe-velero/pkg/buildinfo.Version=<version>"
+package buildinfo
+
+// Version is the astrolabe-velero version recorded in the snapshot annotations
+var Version = "dev"
@@ -4,85 +4,280 @@ import (
 	"context"
 	"fmt"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
-	"github.com/vmware-tanzu/astrolabe/pkg/psql"
-	"github.com/vmware-tanzu/velero-plugin-for-vsphere/pkg/plugin/util"
 	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/discovery"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
+// UnmappedItemPolicy decides what Execute does with an item whose resource has no PE type mapped to it
+type UnmappedItemPolicy string
+
+const (
+	// SkipUnmappedItems logs a warning and backs the item up without a component snapshot
+	SkipUnmappedItems UnmappedItemPolicy = "skip"
+	// FailUnmappedItems fails the backup of the item.  The action then applies to the items of every resource, so
+	// that any namespaced item without a PE type fails.  Cluster scoped items, such as the namespace, are backed up
+	FailUnmappedItems UnmappedItemPolicy = "fail"
+)
+
+// UnmappedItemPolicyParam is the k8sns config param that sets the UnmappedItemPolicy of the backup item action
+const UnmappedItemPolicyParam = "unmappedItemPolicy"
+
+// parseUnmappedItemPolicy validates policy, returning SkipUnmappedItems if it is not set
+func parseUnmappedItemPolicy(policy UnmappedItemPolicy) (UnmappedItemPolicy, error) {
+	switch policy {
+	case "":
+		return SkipUnmappedItems, nil
+	case SkipUnmappedItems, FailUnmappedItems:
+		return policy, nil
+	}
+	return "", errors.New(fmt.Sprintf("unknown unmapped item policy %q", policy))
+}
+
 type AstrolabeBackupItemAction struct{
 	pem astrolabe.ProtectedEntityManager
-	k8sPEMap map[string]string
+	componentMappings []ComponentMapping
+	snapshotParamDefaults map[string]map[string]interface{}
+	discoveryHelper discovery.Helper
+	relatedResourceFinder *RelatedResourceFinder
+	snapshotIndex *SnapshotIndex
+	operationTracker *OperationTracker
+	clusterID string
+	unmappedItemPolicy UnmappedItemPolicy
+	logger logrus.FieldLogger
 }
 
-func NewAstrolabeBackupItemAction(pem astrolabe.ProtectedEntityManager) (AstrolabeBackupItemAction, error){
-	k8sPEMap := map[string]string {
-//		"persistentvolumeclaims": astrolabe.PvcPEType,
-		"postgresqls.acid.zalan.do": psql.Typename,
+// BackupItemActionOptions configures NewAstrolabeBackupItemAction.  PEM, ComponentMappings, DiscoveryHelper and
+// Logger are required, the other fields are optional
+type BackupItemActionOptions struct {
+	PEM astrolabe.ProtectedEntityManager
+	// ComponentMappings maps the items to the PE types that snapshot them
+	ComponentMappings []ComponentMapping
+	// SnapshotParamDefaults holds the snapshot params of each PE type, which the Backup and the item can override
+	SnapshotParamDefaults map[string]map[string]interface{}
+	// DiscoveryHelper resolves the resource of each item from its apiVersion and kind
+	DiscoveryHelper discovery.Helper
+	// RelatedResourceFinder finds the related items of the mappings that are returned as additional items
+	RelatedResourceFinder *RelatedResourceFinder
+	// SnapshotIndex records the snapshots so that a retried backup reuses them
+	SnapshotIndex *SnapshotIndex
+	// OperationTracker takes the snapshots in the background, the items are annotated with the operation IDs
+	OperationTracker *OperationTracker
+	// ClusterID is recorded as the source cluster in the snapshot annotations
+	ClusterID string
+	// UnmappedItemPolicy is the policy for items with no PE type, SkipUnmappedItems if it is not set
+	UnmappedItemPolicy UnmappedItemPolicy
+	Logger             logrus.FieldLogger
+}
+
+// NewAstrolabeBackupItemAction creates the action that snapshots the items mapped to a PE type by the component
+// mappings of options
+func NewAstrolabeBackupItemAction(options BackupItemActionOptions) (AstrolabeBackupItemAction, error){
+	unmappedItemPolicy, err := parseUnmappedItemPolicy(options.UnmappedItemPolicy)
+	if err != nil {
+		return AstrolabeBackupItemAction{}, err
+	}
+	if options.DiscoveryHelper == nil || options.Logger == nil {
+		return AstrolabeBackupItemAction{}, errors.New("DiscoveryHelper and Logger must be set")
+	}
+	if err := validateComponentMappings(options.ComponentMappings); err != nil {
+		return AstrolabeBackupItemAction{}, err
 	}
 	return AstrolabeBackupItemAction{
-		pem: pem,
-		k8sPEMap: k8sPEMap,
+		pem: options.PEM,
+		componentMappings: options.ComponentMappings,
+		snapshotParamDefaults: options.SnapshotParamDefaults,
+		discoveryHelper: options.DiscoveryHelper,
+		relatedResourceFinder: options.RelatedResourceFinder,
+		snapshotIndex: options.SnapshotIndex,
+		operationTracker: options.OperationTracker,
+		clusterID: options.ClusterID,
+		unmappedItemPolicy: unmappedItemPolicy,
+		logger: options.Logger,
 	}, nil
 }
 
 func (recv AstrolabeBackupItemAction) AppliesTo() (velero.ResourceSelector, error) {
-	resources := make([]string, 0, len(recv.k8sPEMap))
-	for resource := range recv.k8sPEMap {
-		resources = append(resources, resource)
+	if recv.unmappedItemPolicy == FailUnmappedItems {
+		return velero.ResourceSelector{
+			IncludedResources: []string{"*"},
+		}, nil
 	}
 	return velero.ResourceSelector{
-		IncludedResources: resources,
+		IncludedResources: componentResources(recv.componentMappings),
 	}, nil
 }
 
+// GetComponentMappings returns the mappings of Kubernetes resources to the PE types that snapshot them as components
+func (recv AstrolabeBackupItemAction) GetComponentMappings() []ComponentMapping {
+	return append([]ComponentMapping{}, recv.componentMappings...)
+}
+
 func (recv AstrolabeBackupItemAction) Execute(item runtime.Unstructured, backup *v1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
 	ctx := context.Background()
-	accessor := meta.NewAccessor()
-
-	selfLink, err := accessor.SelfLink(item)
+	gvr, err := recv.resolveResource(item)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "Failed to retrieve SelfLink")
+		return nil, nil, err
 	}
-	crdName := util.SelfLinkToCRDName(selfLink)
-	peType, found := recv.k8sPEMap[crdName]
-	if !found {
-
+	resource := gvr.GroupResource().String()
+	mapping, mapped, err := recv.findMapping(gvr, item)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !mapped {
+		if recv.unmappedItemPolicy == FailUnmappedItems && isNamespacedItem(item) {
+			return nil, nil, errors.New(fmt.Sprintf("no PE type is mapped to resource %s", resource))
+		}
+		recv.logger.Warnf("No PE type is mapped to resource %s, backing up item without a snapshot", resource)
+		return item, nil, nil
+	}
+	if mapping == nil {
+		recv.logger.Debugf("Item of resource %s does not match any component mapping, backing up item without a snapshot", resource)
+		return item, nil, nil
 	}
 
-	peName, err := accessor.UID(item)
+	peID, err := mapping.getPEID(item)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "Failed to retrieve UID")
+		return nil, nil, err
 	}
-	peID := astrolabe.NewProtectedEntityID(peType, string(peName))
 	pe, err := recv.pem.GetProtectedEntity(ctx, peID)
 	if err != nil {
 		return nil, nil, errors.Wrapf(err, "Could not retrieve PE")
 	}
-	snapshotID, err := pe.Snapshot(ctx, map[string]map[string]interface{}{})
+	var backupObj runtime.Object
+	if backup != nil {
+		backupObj = backup
+	}
+	params, err := buildComponentSnapshotParams(peID.GetPeType(), recv.snapshotParamDefaults, backupObj, item)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "Could not snapshot PE")
+		return nil, nil, errors.Wrapf(err, "Could not build snapshot params for %s", peID.String())
 	}
-	fmt.Printf("snapshotID = %v\n", snapshotID)
-	annotations, err := accessor.Annotations(item)
+	var relatedItems []velero.ResourceIdentifier
+	if recv.relatedResourceFinder != nil {
+		relatedItems, err = recv.relatedResourceFinder.find(ctx, *mapping, item)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	itemUID, err := meta.NewAccessor().UID(item)
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "Could not retrieve annotations")
+		return nil, nil, errors.Wrap(err, "Failed to retrieve UID")
+	}
+	backupUID := ""
+	if backup != nil {
+		backupUID = string(backup.UID)
 	}
-	if annotations == nil {
-		annotations = map[string]string{}
+	if recv.operationTracker != nil && backupUID != "" {
+		operationID, err := recv.operationTracker.Start(backupUID, string(itemUID), peID, func(ctx context.Context) (SnapshotRecord, error) {
+			return recv.snapshotComponent(ctx, pe, resource, params, backupUID, string(itemUID))
+		})
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Could not start snapshot of %s", peID.String())
+		}
+		recv.logger.Infof("Snapshotting %s %s in the background, operation %s", resource, peID.String(), operationID)
+		err = setAnnotations(item, map[string]string{
+			ComponentOperationAnnotation: operationID,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return item, relatedItems, nil
 	}
-	annotations["vmware-tanzu.astrolabe.snapshotID"] = pe.GetID().IDWithSnapshot(snapshotID).String()
-	err = accessor.SetAnnotations(item, annotations)
+	record, err := recv.snapshotComponent(ctx, pe, resource, params, backupUID, string(itemUID))
 	if err != nil {
-		return nil, nil, errors.Wrapf(err, "Could not set annotations")
+		return nil, nil, err
 	}
-	return item, nil, nil
+	err = setSnapshotAnnotations(item, record)
+	if err != nil {
+		return nil, nil, err
+	}
+	return item, relatedItems, nil
+}
+
+func isNamespacedItem(item runtime.Unstructured) bool {
+	namespace, err := meta.NewAccessor().Namespace(item)
+	return err == nil && namespace != ""
+}
+
+// snapshotComponent snapshots pe, or reuses the snapshot taken for the item earlier in the same backup, and returns
+// the record of the snapshot
+func (recv AstrolabeBackupItemAction) snapshotComponent(ctx context.Context, pe astrolabe.ProtectedEntity, resource string,
+	params map[string]map[string]interface{}, backupUID string, itemUID string) (SnapshotRecord, error) {
+	peID := pe.GetID()
+	takeSnapshot := func() (astrolabe.ProtectedEntityID, error) {
+		recv.logger.Infof("Snapshotting %s %s with params %v", resource, peID.String(), params)
+		snapshotID, err := pe.Snapshot(ctx, params)
+		if err != nil {
+			return astrolabe.ProtectedEntityID{}, errors.Wrapf(err, "Could not snapshot PE")
+		}
+		return peID.IDWithSnapshot(snapshotID), nil
+	}
+	var snapshotPEID astrolabe.ProtectedEntityID
+	var err error
+	reused := false
+	if recv.snapshotIndex != nil && backupUID != "" && itemUID != "" {
+		snapshotPEID, reused, err = recv.snapshotIndex.GetOrSnapshot(ctx, recv.pem, backupUID, itemUID, takeSnapshot)
+	} else {
+		snapshotPEID, err = takeSnapshot()
+	}
+	if err != nil {
+		return SnapshotRecord{}, err
+	}
+	if reused {
+		recv.logger.Infof("Reusing snapshot %s of %s %s taken earlier in this backup", snapshotPEID.String(), resource, peID.String())
+	} else {
+		recv.logger.Infof("Snapshotted %s %s, snapshotID = %s", resource, peID.String(), snapshotPEID.GetSnapshotID().String())
+	}
+	return NewSnapshotRecord(snapshotPEID, params, recv.clusterID), nil
+}
+
+// resolveResource returns the resource of item, resolved from its apiVersion and kind
+func (recv AstrolabeBackupItemAction) resolveResource(item runtime.Unstructured) (schema.GroupVersionResource, error) {
+	accessor := meta.NewAccessor()
+	apiVersion, err := accessor.APIVersion(item)
+	if err != nil {
+		return schema.GroupVersionResource{}, errors.Wrap(err, "Failed to retrieve apiVersion")
+	}
+	kind, err := accessor.Kind(item)
+	if err != nil {
+		return schema.GroupVersionResource{}, errors.Wrap(err, "Failed to retrieve kind")
+	}
+	groupVersion, err := schema.ParseGroupVersion(apiVersion)
+	if err != nil {
+		return schema.GroupVersionResource{}, errors.Wrapf(err, "Invalid apiVersion %q", apiVersion)
+	}
+	gvr, _, err := recv.discoveryHelper.KindFor(groupVersion.WithKind(kind))
+	if err != nil {
+		return schema.GroupVersionResource{}, errors.Wrapf(err, "Could not resolve resource for %s, kind %s", apiVersion, kind)
+	}
+	return gvr, nil
 }
 
+// findMapping returns the first mapping that matches item.  mapped is false when no mapping exists for the resource of
+// item at all, a nil mapping with mapped set means the item was excluded by the label selectors of the mappings
+func (recv AstrolabeBackupItemAction) findMapping(gvr schema.GroupVersionResource, item runtime.Unstructured) (*ComponentMapping, bool, error) {
+	mapped := false
+	for i, mapping := range recv.componentMappings {
+		if mapping.GroupResource() != gvr.GroupResource() {
+			continue
+		}
+		mapped = true
+		matches, err := mapping.matches(gvr, item)
+		if err != nil {
+			return nil, true, err
+		}
+		if matches {
+			return &recv.componentMappings[i], true, nil
+		}
+	}
+	return nil, mapped, nil
+}
 
 // AddAnnotations adds the supplied key-values to the annotations on the object
 func AddAnnotations(o *metav1.ObjectMeta, vals map[string]string) {
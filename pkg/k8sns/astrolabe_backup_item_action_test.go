@@ -0,0 +1,192 @@
+package k8sns
+
+import (
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/discovery"
+	"io/ioutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// kindDiscoveryHelper resolves kinds from a fixed map
+type kindDiscoveryHelper struct {
+	discovery.Helper
+	kinds map[schema.GroupVersionKind]schema.GroupVersionResource
+}
+
+func (recv kindDiscoveryHelper) KindFor(gvk schema.GroupVersionKind) (schema.GroupVersionResource, metav1.APIResource, error) {
+	gvr, ok := recv.kinds[gvk]
+	if !ok {
+		return schema.GroupVersionResource{}, metav1.APIResource{}, errors.New("kind not found")
+	}
+	return gvr, metav1.APIResource{Name: gvr.Resource}, nil
+}
+
+func (recv kindDiscoveryHelper) ResourceFor(input schema.GroupVersionResource) (schema.GroupVersionResource, metav1.APIResource, error) {
+	for _, gvr := range recv.kinds {
+		if gvr.GroupResource() == input.GroupResource() {
+			return gvr, metav1.APIResource{Name: gvr.Resource}, nil
+		}
+	}
+	return schema.GroupVersionResource{}, metav1.APIResource{}, errors.New("resource not found")
+}
+
+func (recv kindDiscoveryHelper) Refresh() error {
+	return nil
+}
+
+func newTestDiscoveryHelper() discovery.Helper {
+	return kindDiscoveryHelper{
+		kinds: map[schema.GroupVersionKind]schema.GroupVersionResource{
+			{Version: "v1", Kind: "PersistentVolumeClaim"}:              {Version: "v1", Resource: "persistentvolumeclaims"},
+			{Group: "acid.zalan.do", Version: "v1", Kind: "postgresql"}: {Group: "acid.zalan.do", Version: "v1", Resource: "postgresqls"},
+			{Version: "v1", Kind: "ConfigMap"}:                          {Version: "v1", Resource: "configmaps"},
+			{Version: "v1", Kind: "Namespace"}:                          {Version: "v1", Resource: "namespaces"},
+			{Version: "v1", Kind: "Secret"}:                             {Version: "v1", Resource: "secrets"},
+			{Version: "v1", Kind: "Service"}:                            {Version: "v1", Resource: "services"},
+			{Group: "apps", Version: "v1", Kind: "StatefulSet"}:         {Group: "apps", Version: "v1", Resource: "statefulsets"},
+		},
+	}
+}
+
+func newTestItem(apiVersion string, kind string) *unstructured.Unstructured {
+	item := &unstructured.Unstructured{}
+	item.SetAPIVersion(apiVersion)
+	item.SetKind(kind)
+	item.SetName("test")
+	item.SetUID("test-uid")
+	return item
+}
+
+// newTestBackupItemActionOptions returns the options of a backup item action with the default mappings that takes
+// synchronous snapshots through pem
+func newTestBackupItemActionOptions(pem astrolabe.ProtectedEntityManager) BackupItemActionOptions {
+	return BackupItemActionOptions{
+		PEM:               pem,
+		ComponentMappings: DefaultComponentMappings(),
+		DiscoveryHelper:   newTestDiscoveryHelper(),
+		ClusterID:         "test-cluster",
+		Logger:            logrus.New(),
+	}
+}
+
+func TestResolveResource(t *testing.T) {
+	options := newTestBackupItemActionOptions(nil)
+	options.ComponentMappings = append(options.ComponentMappings, PVCComponentMapping())
+	action, err := NewAstrolabeBackupItemAction(options)
+	if err != nil {
+		t.Fatalf("NewAstrolabeBackupItemAction failed with err %v", err)
+	}
+	tests := map[string]*unstructured.Unstructured{
+		"persistentvolumeclaims":    newTestItem("v1", "PersistentVolumeClaim"),
+		"postgresqls.acid.zalan.do": newTestItem("acid.zalan.do/v1", "postgresql"),
+	}
+	for expected, item := range tests {
+		gvr, err := action.resolveResource(item)
+		if err != nil {
+			t.Fatalf("resolveResource failed with err %v", err)
+		}
+		if resource := gvr.GroupResource().String(); resource != expected {
+			t.Fatalf("expected resource %s, got %s", expected, resource)
+		}
+	}
+	if _, err := action.resolveResource(newTestItem("example.com/v1", "Unknown")); err == nil {
+		t.Fatalf("resolveResource succeeded for an unknown kind")
+	}
+}
+
+func TestExecuteUnmappedItem(t *testing.T) {
+	item := newTestItem("v1", "ConfigMap")
+	item.SetNamespace("test")
+	skipAction, err := NewAstrolabeBackupItemAction(newTestBackupItemActionOptions(nil))
+	if err != nil {
+		t.Fatalf("NewAstrolabeBackupItemAction failed with err %v", err)
+	}
+	returnedItem, _, err := skipAction.Execute(item, &v1.Backup{})
+	if err != nil || returnedItem != item {
+		t.Fatalf("expected unmapped item to be skipped, got %v, %v", returnedItem, err)
+	}
+	options := newTestBackupItemActionOptions(nil)
+	options.UnmappedItemPolicy = FailUnmappedItems
+	failAction, err := NewAstrolabeBackupItemAction(options)
+	if err != nil {
+		t.Fatalf("NewAstrolabeBackupItemAction failed with err %v", err)
+	}
+	if _, _, err := failAction.Execute(item, &v1.Backup{}); err == nil {
+		t.Fatalf("expected unmapped item to fail")
+	}
+	selector, err := failAction.AppliesTo()
+	if err != nil || len(selector.IncludedResources) != 1 || selector.IncludedResources[0] != "*" {
+		t.Fatalf("expected the fail policy to apply to all resources, got %v, %v", selector, err)
+	}
+	namespace := newTestItem("v1", "Namespace")
+	if returnedItem, _, err := failAction.Execute(namespace, &v1.Backup{}); err != nil || returnedItem != namespace {
+		t.Fatalf("expected cluster scoped item to be backed up, got %v, %v", returnedItem, err)
+	}
+	options.UnmappedItemPolicy = "ignore"
+	if _, err := NewAstrolabeBackupItemAction(options); err == nil {
+		t.Fatalf("NewAstrolabeBackupItemAction accepted an unknown policy")
+	}
+}
+
+func TestExecuteReusesSnapshotOfRetriedBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-index")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	livePE := &fakeComponentPE{id: astrolabe.NewProtectedEntityID("psql", "test-uid")}
+	pem := &fakePEM{pes: map[string]*fakeComponentPE{livePE.id.String(): livePE}}
+	index := NewSnapshotIndex(filepath.Join(dir, snapshotIndexFileName), logrus.New())
+	options := newTestBackupItemActionOptions(pem)
+	options.SnapshotIndex = index
+	action, err := NewAstrolabeBackupItemAction(options)
+	if err != nil {
+		t.Fatalf("NewAstrolabeBackupItemAction failed with err %v", err)
+	}
+	execute := func(backupUID types.UID) astrolabe.ProtectedEntityID {
+		backup := &v1.Backup{}
+		backup.UID = backupUID
+		returnedItem, _, err := action.Execute(newTestItem("acid.zalan.do/v1", "postgresql"), backup)
+		if err != nil {
+			t.Fatalf("Execute failed with err %v", err)
+		}
+		snapshotPEID, found, err := getSnapshotAnnotation(returnedItem)
+		if err != nil || !found {
+			t.Fatalf("getSnapshotAnnotation returned found = %t, err = %v", found, err)
+		}
+		pem.pes[snapshotPEID.String()] = &fakeComponentPE{id: snapshotPEID}
+		return snapshotPEID
+	}
+
+	first := execute("backup-1")
+	if retried := execute("backup-1"); retried.String() != first.String() || livePE.snapshots != 1 {
+		t.Fatalf("expected retried backup to reuse %s, got %s after %d snapshots", first.String(), retried.String(), livePE.snapshots)
+	}
+	delete(pem.pes, first.String())
+	if retaken := execute("backup-1"); retaken.String() == first.String() || livePE.snapshots != 2 {
+		t.Fatalf("expected a new snapshot once %s was gone, got %s after %d snapshots", first.String(), retaken.String(), livePE.snapshots)
+	}
+	if other := execute("backup-2"); livePE.snapshots != 3 {
+		t.Fatalf("expected a new snapshot for another backup, got %s after %d snapshots", other.String(), livePE.snapshots)
+	}
+	pem.getErr = errors.New("connection refused")
+	backup := &v1.Backup{}
+	backup.UID = "backup-2"
+	if _, _, err := action.Execute(newTestItem("acid.zalan.do/v1", "postgresql"), backup); err == nil || livePE.snapshots != 3 {
+		t.Fatalf("expected the lookup error to fail the item without a new snapshot, got err %v after %d snapshots", err, livePE.snapshots)
+	}
+	pem.getErr = nil
+	entries, err := index.Entries()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 index entries, got %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/api/meta"
+)
+
+// AstrolabeDeleteItemAction deletes the component snapshots recorded on items by AstrolabeBackupItemAction when their
+// Velero backup is deleted.  Snapshots that cannot be deleted are added to the retry queue, which is retried in the
+// background by DeleteRetryQueue.RunPeriodically
+type AstrolabeDeleteItemAction struct {
+	pem               astrolabe.ProtectedEntityManager
+	componentMappings []ComponentMapping
+	retryQueue        *DeleteRetryQueue
+	snapshotIndex     *SnapshotIndex
+	operationTracker  *OperationTracker
+	logger            logrus.FieldLogger
+}
+
+// NewAstrolabeDeleteItemAction creates the delete item action.  operationTracker resolves the snapshots of items that
+// were snapshotted in the background, it may be nil
+func NewAstrolabeDeleteItemAction(pem astrolabe.ProtectedEntityManager, componentMappings []ComponentMapping,
+	retryQueue *DeleteRetryQueue, snapshotIndex *SnapshotIndex, operationTracker *OperationTracker,
+	logger logrus.FieldLogger) (AstrolabeDeleteItemAction, error) {
+	if err := validateComponentMappings(componentMappings); err != nil {
+		return AstrolabeDeleteItemAction{}, err
+	}
+	return AstrolabeDeleteItemAction{
+		pem:               pem,
+		componentMappings: componentMappings,
+		retryQueue:        retryQueue,
+		snapshotIndex:     snapshotIndex,
+		operationTracker:  operationTracker,
+		logger:            logger,
+	}, nil
+}
+
+func (recv AstrolabeDeleteItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: componentResources(recv.componentMappings),
+	}, nil
+}
+
+// Execute deletes the component snapshot of the item.  Velero logs the returned error but carries on deleting the
+// backup, so failed deletes are queued for retry before the error is returned
+func (recv AstrolabeDeleteItemAction) Execute(input *velero.DeleteItemActionExecuteInput) error {
+	ctx := context.Background()
+	snapshotPEID, found, err := resolveSnapshotAnnotation(input.Item, recv.operationTracker)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+	backupName := ""
+	if input.Backup != nil {
+		backupName = input.Backup.Name
+	}
+	logger := recv.logger.WithField("snapshot", snapshotPEID.String()).WithField("backup", backupName)
+	logger.Info("Deleting component snapshot")
+	if recv.snapshotIndex != nil && input.Backup != nil {
+		// The snapshot is either deleted or queued for retry, either way the backup will not reuse it
+		if err := recv.removeFromIndex(input); err != nil {
+			logger.WithError(err).Warn("Could not remove component snapshot from the snapshot index")
+		}
+	}
+	err = deleteComponentSnapshot(ctx, recv.pem, snapshotPEID.String())
+	if err != nil {
+		logger.WithError(err).Error("Could not delete component snapshot, queueing it for retry")
+		if queueErr := recv.retryQueue.Add(snapshotPEID, backupName, err); queueErr != nil {
+			logger.WithError(queueErr).Error("Could not queue component snapshot for retry")
+		}
+		return errors.Wrapf(err, "Could not delete component snapshot %s", snapshotPEID.String())
+	}
+	return nil
+}
+
+func (recv AstrolabeDeleteItemAction) removeFromIndex(input *velero.DeleteItemActionExecuteInput) error {
+	itemUID, err := meta.NewAccessor().UID(input.Item)
+	if err != nil {
+		return errors.Wrap(err, "Failed to retrieve UID")
+	}
+	return recv.snapshotIndex.Remove(string(input.Backup.UID), string(itemUID))
+}
@@ -0,0 +1,194 @@
+package k8sns
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"io/ioutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// deletablePE fails DeleteSnapshot until failures reaches zero, and counts the attempts
+type deletablePE struct {
+	astrolabe.ProtectedEntity
+	id       astrolabe.ProtectedEntityID
+	failures int
+	attempts int
+	deleted  []astrolabe.ProtectedEntitySnapshotID
+}
+
+func (recv *deletablePE) DeleteSnapshot(ctx context.Context, snapshotToDelete astrolabe.ProtectedEntitySnapshotID,
+	params map[string]map[string]interface{}) (bool, error) {
+	recv.attempts++
+	if recv.failures > 0 {
+		recv.failures--
+		return false, errors.New("storage unavailable")
+	}
+	recv.deleted = append(recv.deleted, snapshotToDelete)
+	return true, nil
+}
+
+// deletablePEM returns pe, getErr if it is set, or a NotFound error once pe is nil
+type deletablePEM struct {
+	astrolabe.ProtectedEntityManager
+	pe     *deletablePE
+	getErr error
+}
+
+func (recv deletablePEM) GetProtectedEntity(ctx context.Context, id astrolabe.ProtectedEntityID) (astrolabe.ProtectedEntity, error) {
+	if recv.getErr != nil {
+		return nil, recv.getErr
+	}
+	if recv.pe == nil {
+		return nil, errors.Wrap(apierrors.NewNotFound(schema.GroupResource{Resource: "snapshots"}, id.String()), "not found")
+	}
+	return recv.pe, nil
+}
+
+func TestDeleteItemActionRetriesFailedDeletes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delete-retry")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotPEID := astrolabe.NewProtectedEntityIDWithSnapshotID("psql", "db-uid", astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+	pe := &deletablePE{failures: 1}
+	pem := deletablePEM{pe: pe}
+	queue := NewDeleteRetryQueue(filepath.Join(dir, pendingDeletesFileName), nil, DefaultDeleteMaxAttempts, 0, logrus.New())
+	action, err := NewAstrolabeDeleteItemAction(pem, DefaultComponentMappings(), queue, nil, nil, logrus.New())
+	if err != nil {
+		t.Fatalf("NewAstrolabeDeleteItemAction failed with err %v", err)
+	}
+	item := newTestItem("acid.zalan.do/v1", "postgresql")
+	item.SetAnnotations(map[string]string{SnapshotIDAnnotation: snapshotPEID.String()})
+	backup := &v1.Backup{}
+	backup.Name = "nightly"
+
+	if err := action.Execute(&velero.DeleteItemActionExecuteInput{Item: item, Backup: backup}); err == nil {
+		t.Fatalf("expected failed delete to be reported")
+	}
+	pending, err := queue.Pending()
+	if err != nil || len(pending) != 1 || pending[0].SnapshotID != snapshotPEID.String() || pending[0].Backup != "nightly" {
+		t.Fatalf("unexpected pending deletes %v, %v", pending, err)
+	}
+
+	// The queue file is reloaded, as after a restart
+	queue = NewDeleteRetryQueue(filepath.Join(dir, pendingDeletesFileName), nil, DefaultDeleteMaxAttempts, 0, logrus.New())
+	if err := queue.Retry(context.Background(), pem); err != nil {
+		t.Fatalf("Retry failed with err %v", err)
+	}
+	pending, err = queue.Pending()
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("expected no pending deletes, got %v, %v", pending, err)
+	}
+	if len(pe.deleted) != 1 || pe.deleted[0] != snapshotPEID.GetSnapshotID() {
+		t.Fatalf("unexpected deleted snapshots %v", pe.deleted)
+	}
+
+	unannotated := newTestItem("acid.zalan.do/v1", "postgresql")
+	if err := action.Execute(&velero.DeleteItemActionExecuteInput{Item: unannotated, Backup: backup}); err != nil {
+		t.Fatalf("Execute failed for an item without a snapshot, err %v", err)
+	}
+}
+
+func TestDeleteRetryQueueBackoffAndMaxAttempts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delete-retry")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotPEID := astrolabe.NewProtectedEntityIDWithSnapshotID("psql", "db-uid", astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+	pe := &deletablePE{failures: 10}
+	pem := deletablePEM{pe: pe}
+
+	queue := NewDeleteRetryQueue(filepath.Join(dir, pendingDeletesFileName), nil, 3, time.Hour, logrus.New())
+	if err := queue.Add(snapshotPEID, "nightly", errors.New("storage unavailable")); err != nil {
+		t.Fatalf("Add failed with err %v", err)
+	}
+	if err := queue.Retry(context.Background(), pem); err != nil || pe.attempts != 0 {
+		t.Fatalf("expected no retry before the backoff, got %d attempts, err %v", pe.attempts, err)
+	}
+
+	queue = NewDeleteRetryQueue(filepath.Join(dir, pendingDeletesFileName), nil, 3, 0, logrus.New())
+	for i := 0; i < 3; i++ {
+		if err := queue.Retry(context.Background(), pem); err != nil {
+			t.Fatalf("Retry failed with err %v", err)
+		}
+	}
+	pending, err := queue.Pending()
+	if err != nil || len(pending) != 0 || pe.attempts != 2 {
+		t.Fatalf("expected the delete to be given up after 3 attempts, got %v after %d retries, err %v", pending, pe.attempts, err)
+	}
+
+	if err := queue.Add(snapshotPEID, "nightly", errors.New("storage unavailable")); err != nil {
+		t.Fatalf("Add failed with err %v", err)
+	}
+	if err := queue.Retry(context.Background(), deletablePEM{}); err != nil {
+		t.Fatalf("Retry failed with err %v", err)
+	}
+	pending, err = queue.Pending()
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("expected a snapshot that is not found to count as deleted, got %v, %v", pending, err)
+	}
+}
+
+func TestDeleteItemActionResolvesOperations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delete-operations")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tracker := NewOperationTracker(filepath.Join(dir, componentOperationsFileName), logrus.New())
+	peID := astrolabe.NewProtectedEntityID("psql", "db-uid")
+	snapshotPEID := peID.IDWithSnapshot(astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+	operationID, err := tracker.Start("backup-1", "db-uid", peID, func(ctx context.Context) (SnapshotRecord, error) {
+		return NewSnapshotRecord(snapshotPEID, nil, "test-cluster"), nil
+	})
+	if err != nil {
+		t.Fatalf("Start failed with err %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := tracker.WaitForBackup(ctx, "backup-1"); err != nil {
+		t.Fatalf("WaitForBackup failed with err %v", err)
+	}
+	pe := &deletablePE{}
+	queue := NewDeleteRetryQueue(filepath.Join(dir, pendingDeletesFileName), nil, DefaultDeleteMaxAttempts, 0, logrus.New())
+	action, err := NewAstrolabeDeleteItemAction(deletablePEM{pe: pe}, DefaultComponentMappings(), queue, nil, tracker, logrus.New())
+	if err != nil {
+		t.Fatalf("NewAstrolabeDeleteItemAction failed with err %v", err)
+	}
+	item := newTestItem("acid.zalan.do/v1", "postgresql")
+	item.SetAnnotations(map[string]string{ComponentOperationAnnotation: operationID})
+	if err := action.Execute(&velero.DeleteItemActionExecuteInput{Item: item, Backup: &v1.Backup{}}); err != nil {
+		t.Fatalf("Execute failed with err %v", err)
+	}
+	if len(pe.deleted) != 1 || pe.deleted[0] != snapshotPEID.GetSnapshotID() {
+		t.Fatalf("expected the snapshot of the operation to be deleted, got %v", pe.deleted)
+	}
+}
+
+func TestDeleteComponentSnapshotNotFound(t *testing.T) {
+	snapshotPEID := astrolabe.NewProtectedEntityIDWithSnapshotID("psql", "db-uid", astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+	notFound := []error{
+		errors.Wrap(apierrors.NewNotFound(schema.GroupResource{Resource: "snapshots"}, "snap-1"), "not found"),
+		errors.Wrap(&os.PathError{Op: "open", Path: "/snapshots/snap-1", Err: os.ErrNotExist}, "could not read info"),
+	}
+	for _, getErr := range notFound {
+		if err := deleteComponentSnapshot(context.Background(), deletablePEM{getErr: getErr}, snapshotPEID.String()); err != nil {
+			t.Fatalf("expected %v to count as deleted, got err %v", getErr, err)
+		}
+	}
+	if err := deleteComponentSnapshot(context.Background(), deletablePEM{getErr: errors.New("connection refused")},
+		snapshotPEID.String()); err == nil {
+		t.Fatalf("expected other errors to fail the delete")
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"strconv"
+)
+
+// Params passed to the component PETM when a snapshot is copied into a new PE
+const (
+	// ComponentNamespaceParam is the namespace the restored item is created in
+	ComponentNamespaceParam = "namespace"
+	// ComponentNameParam is the name of the restored item
+	ComponentNameParam = "name"
+)
+
+// OverwriteComponentsLabel is the label or annotation on a Velero Restore that allows components that still exist to
+// be overwritten from their snapshots, e.g. velero restore create --labels astrolabe.io/overwrite-components=true.
+// Without it existing components are left alone
+const OverwriteComponentsLabel = "astrolabe.io/overwrite-components"
+
+// kubernetesItemCreator is implemented by PETMs whose Copy creates the Kubernetes item for the new PE, for example a
+// PVC provisioned from a snapshot.  Velero must not restore those items itself
+type kubernetesItemCreator interface {
+	CreatesKubernetesItem() bool
+}
+
+// kubernetesItemRewriter is implemented by PETMs whose Copy does not create the Kubernetes item, but whose restored PE
+// is only found by the item once the item is changed, for example a renamed resource or a spec field naming the
+// restored data.  RewriteKubernetesItem updates item, which Velero then restores, to refer to restoredPE
+type kubernetesItemRewriter interface {
+	RewriteKubernetesItem(ctx context.Context, item runtime.Unstructured, restoredPE astrolabe.ProtectedEntity) error
+}
+
+// AstrolabeRestoreItemAction restores the component snapshots recorded on items by AstrolabeBackupItemAction.  The
+// snapshot is copied into a new PE through its type manager.  When the item is restored into its original namespace
+// and its PE still exists, the PE is left alone unless the Restore carries OverwriteComponentsLabel, in which case it
+// is overwritten from the snapshot.
+//
+// How the restored item reaches its PE depends on the PE type:
+//   - PETMs that implement kubernetesItemCreator, such as pvc, create the item themselves in Copy and Velero skips it
+//   - PETMs that implement kubernetesItemRewriter have the item rewritten to refer to the restored PE
+//   - Other PETMs, such as psql, are copied with the namespace and name of the item in ComponentNamespaceParam and
+//     ComponentNameParam and must restore the PE under that name, so the item restored by Velero finds it unchanged.
+//     For psql the postgresql item is recreated by Velero and the database is restored into the cluster of that name
+type AstrolabeRestoreItemAction struct {
+	pem               astrolabe.ProtectedEntityManager
+	componentMappings []ComponentMapping
+	operationTracker  *OperationTracker
+	logger            logrus.FieldLogger
+}
+
+// NewAstrolabeRestoreItemAction creates the action that restores the component snapshots of items.  operationTracker
+// resolves the snapshots taken in the background, it is nil if they are taken synchronously
+func NewAstrolabeRestoreItemAction(pem astrolabe.ProtectedEntityManager, componentMappings []ComponentMapping,
+	operationTracker *OperationTracker, logger logrus.FieldLogger) (AstrolabeRestoreItemAction, error) {
+	if err := validateComponentMappings(componentMappings); err != nil {
+		return AstrolabeRestoreItemAction{}, err
+	}
+	return AstrolabeRestoreItemAction{
+		pem:               pem,
+		componentMappings: componentMappings,
+		operationTracker:  operationTracker,
+		logger:            logger,
+	}, nil
+}
+
+func (recv AstrolabeRestoreItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: componentResources(recv.componentMappings),
+	}, nil
+}
+
+func (recv AstrolabeRestoreItemAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	ctx := context.Background()
+	item := input.Item
+	snapshotPEID, found, err := resolveSnapshotAnnotation(item, recv.operationTracker)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return velero.NewRestoreItemActionExecuteOutput(item), nil
+	}
+	accessor := meta.NewAccessor()
+	targetNamespace, err := accessor.Namespace(item)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to retrieve namespace")
+	}
+	name, err := accessor.Name(item)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to retrieve name")
+	}
+	sourceNamespace := targetNamespace
+	if input.ItemFromBackup != nil {
+		sourceNamespace, err = accessor.Namespace(input.ItemFromBackup)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to retrieve namespace of backed up item")
+		}
+	}
+	logger := recv.logger.WithField("snapshot", snapshotPEID.String()).WithField("item", targetNamespace+"/"+name)
+
+	peType := snapshotPEID.GetPeType()
+	petm := recv.pem.GetProtectedEntityTypeManager(peType)
+	if petm == nil {
+		return nil, errors.New(fmt.Sprintf("no type manager for pe type %s", peType))
+	}
+	createsItem := false
+	if creator, ok := petm.(kubernetesItemCreator); ok {
+		createsItem = creator.CreatesKubernetesItem()
+	}
+	snapshotPE, err := recv.pem.GetProtectedEntity(ctx, snapshotPEID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not retrieve component snapshot %s", snapshotPEID.String())
+	}
+
+	var restoredPE astrolabe.ProtectedEntity
+	livePEID := astrolabe.NewProtectedEntityID(peType, snapshotPEID.GetID())
+	livePE, liveErr := recv.pem.GetProtectedEntity(ctx, livePEID)
+	switch {
+	case liveErr == nil && targetNamespace == sourceNamespace && (createsItem || !overwriteComponents(input)):
+		logger.Infof("Component %s already exists, not restoring it", livePEID.String())
+		return velero.NewRestoreItemActionExecuteOutput(item).WithoutRestore(), nil
+	case liveErr == nil && targetNamespace == sourceNamespace:
+		logger.Infof("Overwriting component %s from snapshot", livePEID.String())
+		err = livePE.Overwrite(ctx, snapshotPE, map[string]map[string]interface{}{}, true)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not overwrite component %s", livePEID.String())
+		}
+		restoredPE = livePE
+	default:
+		logger.Infof("Copying component snapshot into %s/%s", targetNamespace, name)
+		params := map[string]map[string]interface{}{
+			peType: {
+				ComponentNamespaceParam: targetNamespace,
+				ComponentNameParam:      name,
+			},
+		}
+		restoredPE, err = petm.Copy(ctx, snapshotPE, params, astrolabe.AllocateNewObject)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not copy component snapshot %s", snapshotPEID.String())
+		}
+	}
+	restoredID := restoredPE.GetID()
+	logger.Infof("Restored component snapshot into %s", restoredID.String())
+
+	if createsItem {
+		return velero.NewRestoreItemActionExecuteOutput(item).WithoutRestore(), nil
+	}
+	if rewriter, ok := petm.(kubernetesItemRewriter); ok {
+		err = rewriter.RewriteKubernetesItem(ctx, item, restoredPE)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not rewrite item for component %s", restoredID.String())
+		}
+	}
+	err = setAnnotations(item, map[string]string{
+		RestoredFromAnnotation: snapshotPEID.String(),
+		RestoredIDAnnotation:   restoredID.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return velero.NewRestoreItemActionExecuteOutput(item), nil
+}
+
+// overwriteComponents returns true if the Restore allows existing components to be overwritten
+func overwriteComponents(input *velero.RestoreItemActionExecuteInput) bool {
+	if input.Restore == nil {
+		return false
+	}
+	for _, values := range []map[string]string{input.Restore.Labels, input.Restore.Annotations} {
+		if overwrite, err := strconv.ParseBool(values[OverwriteComponentsLabel]); err == nil && overwrite {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package k8sns
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"testing"
+)
+
+// fakeComponentPE records the snapshot it was overwritten from and numbers the snapshots taken of it
+type fakeComponentPE struct {
+	astrolabe.ProtectedEntity
+	id              astrolabe.ProtectedEntityID
+	overwrittenFrom *astrolabe.ProtectedEntityID
+	snapshots       int
+}
+
+func (recv *fakeComponentPE) GetID() astrolabe.ProtectedEntityID {
+	return recv.id
+}
+
+func (recv *fakeComponentPE) GetCombinedInfo(ctx context.Context) ([]astrolabe.ProtectedEntityInfo, error) {
+	return []astrolabe.ProtectedEntityInfo{astrolabe.NewProtectedEntityInfo(recv.id, recv.id.GetID(), -1, nil, nil, nil, nil)}, nil
+}
+
+func (recv *fakeComponentPE) Snapshot(ctx context.Context, params map[string]map[string]interface{}) (astrolabe.ProtectedEntitySnapshotID, error) {
+	recv.snapshots++
+	return astrolabe.NewProtectedEntitySnapshotID(fmt.Sprintf("snap-%d", recv.snapshots)), nil
+}
+
+func (recv *fakeComponentPE) Overwrite(ctx context.Context, sourcePE astrolabe.ProtectedEntity, params map[string]map[string]interface{},
+	overwriteComponents bool) error {
+	sourceID := sourcePE.GetID()
+	recv.overwrittenFrom = &sourceID
+	return nil
+}
+
+// fakeComponentPETM copies snapshots into new PEs named after the copy params, and renames restored items to
+// rewriteName if it is set
+type fakeComponentPETM struct {
+	astrolabe.ProtectedEntityTypeManager
+	createsItem bool
+	rewriteName string
+	copyParams  map[string]map[string]interface{}
+}
+
+func (recv *fakeComponentPETM) Copy(ctx context.Context, pe astrolabe.ProtectedEntity, params map[string]map[string]interface{},
+	options astrolabe.CopyCreateOptions) (astrolabe.ProtectedEntity, error) {
+	recv.copyParams = params
+	return &fakeComponentPE{id: astrolabe.NewProtectedEntityID(pe.GetID().GetPeType(), "copied")}, nil
+}
+
+func (recv *fakeComponentPETM) CreatesKubernetesItem() bool {
+	return recv.createsItem
+}
+
+func (recv *fakeComponentPETM) RewriteKubernetesItem(ctx context.Context, item runtime.Unstructured, restoredPE astrolabe.ProtectedEntity) error {
+	if recv.rewriteName != "" {
+		item.(*unstructured.Unstructured).SetName(recv.rewriteName)
+	}
+	return nil
+}
+
+// fakePEM returns the PEs in pes, a NotFound error for any other ID, or getErr if it is set
+type fakePEM struct {
+	petm   *fakeComponentPETM
+	pes    map[string]*fakeComponentPE
+	getErr error
+}
+
+func (recv *fakePEM) GetProtectedEntity(ctx context.Context, id astrolabe.ProtectedEntityID) (astrolabe.ProtectedEntity, error) {
+	if recv.getErr != nil {
+		return nil, recv.getErr
+	}
+	pe, ok := recv.pes[id.String()]
+	if !ok {
+		return nil, errors.Wrap(apierrors.NewNotFound(schema.GroupResource{Resource: id.GetPeType()}, id.String()), "not found")
+	}
+	return pe, nil
+}
+
+func (recv *fakePEM) GetProtectedEntityTypeManager(peType string) astrolabe.ProtectedEntityTypeManager {
+	return recv.petm
+}
+
+func (recv *fakePEM) ListEntityTypeManagers() []astrolabe.ProtectedEntityTypeManager {
+	return []astrolabe.ProtectedEntityTypeManager{recv.petm}
+}
+
+func newTestRestoreInput(namespace string, sourceNamespace string, snapshotPEID astrolabe.ProtectedEntityID) *velero.RestoreItemActionExecuteInput {
+	item := newTestItem("acid.zalan.do/v1", "postgresql")
+	item.SetNamespace(namespace)
+	item.SetAnnotations(map[string]string{SnapshotIDAnnotation: snapshotPEID.String()})
+	itemFromBackup := item.DeepCopy()
+	itemFromBackup.SetNamespace(sourceNamespace)
+	return &velero.RestoreItemActionExecuteInput{Item: item, ItemFromBackup: itemFromBackup}
+}
+
+func newTestPEM(createsItem bool, liveExists bool) (*fakePEM, astrolabe.ProtectedEntityID) {
+	liveID := astrolabe.NewProtectedEntityID("psql", "db-uid")
+	snapshotPEID := liveID.IDWithSnapshot(astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+	pem := &fakePEM{
+		petm: &fakeComponentPETM{createsItem: createsItem},
+		pes: map[string]*fakeComponentPE{
+			snapshotPEID.String(): {id: snapshotPEID},
+		},
+	}
+	if liveExists {
+		pem.pes[liveID.String()] = &fakeComponentPE{id: liveID}
+	}
+	return pem, snapshotPEID
+}
+
+func TestRestoreItemActionSkipsExistingComponent(t *testing.T) {
+	pem, snapshotPEID := newTestPEM(false, true)
+	action, err := NewAstrolabeRestoreItemAction(pem, DefaultComponentMappings(), nil, logrus.New())
+	if err != nil {
+		t.Fatalf("NewAstrolabeRestoreItemAction failed with err %v", err)
+	}
+	output, err := action.Execute(newTestRestoreInput("db", "db", snapshotPEID))
+	if err != nil {
+		t.Fatalf("Execute failed with err %v", err)
+	}
+	if pem.pes["psql:db-uid"].overwrittenFrom != nil || pem.petm.copyParams != nil {
+		t.Fatalf("existing component restored without %s", OverwriteComponentsLabel)
+	}
+	if !output.SkipRestore {
+		t.Fatalf("expected Velero to skip the item of an existing component")
+	}
+}
+
+func TestRestoreItemActionOverwrite(t *testing.T) {
+	pem, snapshotPEID := newTestPEM(false, true)
+	action, err := NewAstrolabeRestoreItemAction(pem, DefaultComponentMappings(), nil, logrus.New())
+	if err != nil {
+		t.Fatalf("NewAstrolabeRestoreItemAction failed with err %v", err)
+	}
+	input := newTestRestoreInput("db", "db", snapshotPEID)
+	input.Restore = &v1.Restore{}
+	input.Restore.Labels = map[string]string{OverwriteComponentsLabel: "true"}
+	output, err := action.Execute(input)
+	if err != nil {
+		t.Fatalf("Execute failed with err %v", err)
+	}
+	livePE := pem.pes["psql:db-uid"]
+	if livePE.overwrittenFrom == nil || *livePE.overwrittenFrom != snapshotPEID {
+		t.Fatalf("expected live pe to be overwritten from %s", snapshotPEID.String())
+	}
+	annotations := output.UpdatedItem.(*unstructured.Unstructured).GetAnnotations()
+	if annotations[RestoredIDAnnotation] != "psql:db-uid" || annotations[RestoredFromAnnotation] != snapshotPEID.String() {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+	if output.SkipRestore {
+		t.Fatalf("expected item to be restored by Velero")
+	}
+}
+
+func TestRestoreItemActionCopy(t *testing.T) {
+	pem, snapshotPEID := newTestPEM(false, true)
+	action, err := NewAstrolabeRestoreItemAction(pem, DefaultComponentMappings(), nil, logrus.New())
+	if err != nil {
+		t.Fatalf("NewAstrolabeRestoreItemAction failed with err %v", err)
+	}
+	output, err := action.Execute(newTestRestoreInput("db-copy", "db", snapshotPEID))
+	if err != nil {
+		t.Fatalf("Execute failed with err %v", err)
+	}
+	if pem.pes["psql:db-uid"].overwrittenFrom != nil {
+		t.Fatalf("live pe overwritten for a remapped namespace")
+	}
+	if pem.petm.copyParams["psql"][ComponentNamespaceParam] != "db-copy" || pem.petm.copyParams["psql"][ComponentNameParam] != "test" {
+		t.Fatalf("unexpected copy params %v", pem.petm.copyParams)
+	}
+	annotations := output.UpdatedItem.(*unstructured.Unstructured).GetAnnotations()
+	if annotations[RestoredIDAnnotation] != "psql:copied" {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+}
+
+func TestRestoreItemActionRewritesItem(t *testing.T) {
+	pem, snapshotPEID := newTestPEM(false, false)
+	pem.petm.rewriteName = "copied"
+	action, err := NewAstrolabeRestoreItemAction(pem, DefaultComponentMappings(), nil, logrus.New())
+	if err != nil {
+		t.Fatalf("NewAstrolabeRestoreItemAction failed with err %v", err)
+	}
+	output, err := action.Execute(newTestRestoreInput("db", "db", snapshotPEID))
+	if err != nil {
+		t.Fatalf("Execute failed with err %v", err)
+	}
+	if name := output.UpdatedItem.(*unstructured.Unstructured).GetName(); name != "copied" || output.SkipRestore {
+		t.Fatalf("expected the restored item to be rewritten to the copied pe, got %s, skip restore %t", name, output.SkipRestore)
+	}
+}
+
+func TestRestoreItemActionItemCreator(t *testing.T) {
+	pem, snapshotPEID := newTestPEM(true, false)
+	action, err := NewAstrolabeRestoreItemAction(pem, DefaultComponentMappings(), nil, logrus.New())
+	if err != nil {
+		t.Fatalf("NewAstrolabeRestoreItemAction failed with err %v", err)
+	}
+	output, err := action.Execute(newTestRestoreInput("db", "db", snapshotPEID))
+	if err != nil {
+		t.Fatalf("Execute failed with err %v", err)
+	}
+	if pem.petm.copyParams == nil {
+		t.Fatalf("expected snapshot to be copied")
+	}
+	if !output.SkipRestore {
+		t.Fatalf("expected Velero to skip an item created by the type manager")
+	}
+}
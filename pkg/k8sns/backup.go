@@ -0,0 +1,347 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/backup"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"github.com/vmware-tanzu/velero/pkg/podexec"
+	"io"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sync"
+)
+
+const backupResultFileName = "backup-result.json"
+
+// BackupResult holds the warnings and errors Velero logged while backing up a namespace.  Velero keeps going when
+// individual items fail, so a backup with errors still produces a usable, if incomplete, tarball
+type BackupResult struct {
+	Warnings []string `json:"warnings,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+	// UnlistedResources are the resource types Velero could not list, as group resources.  Their items are missing
+	// from the backup
+	UnlistedResources []string `json:"unlistedResources,omitempty"`
+}
+
+// BackupError is returned to readers of the data stream when the backup could not be completed
+type BackupError struct {
+	Err    error
+	Result BackupResult
+}
+
+func (recv BackupError) Error() string {
+	return fmt.Sprintf("namespace backup failed: %v (%d errors, %d warnings logged)", recv.Err,
+		len(recv.Result.Errors), len(recv.Result.Warnings))
+}
+
+func (recv BackupError) Cause() error {
+	return recv.Err
+}
+
+// backupResultHook collects the warnings and errors logged during a backup
+type backupResultHook struct {
+	lock   sync.Mutex
+	result BackupResult
+}
+
+func (recv *backupResultHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+func (recv *backupResultHook) Fire(entry *logrus.Entry) error {
+	message := entry.Message
+	if err, ok := entry.Data[logrus.ErrorKey]; ok {
+		message = fmt.Sprintf("%s: %v", message, err)
+	}
+	recv.lock.Lock()
+	defer recv.lock.Unlock()
+	if groupResource, ok := unlistedResource(entry); ok {
+		recv.addUnlistedResource(groupResource)
+	}
+	if entry.Level == logrus.WarnLevel {
+		recv.result.Warnings = append(recv.result.Warnings, message)
+	} else {
+		recv.result.Errors = append(recv.result.Errors, message)
+	}
+	return nil
+}
+
+func (recv *backupResultHook) getResult() BackupResult {
+	recv.lock.Lock()
+	defer recv.lock.Unlock()
+	result := BackupResult{
+		Warnings: append([]string{}, recv.result.Warnings...),
+		Errors:   append([]string{}, recv.result.Errors...),
+	}
+	if len(recv.result.UnlistedResources) > 0 {
+		result.UnlistedResources = append([]string{}, recv.result.UnlistedResources...)
+	}
+	return result
+}
+
+func (recv *backupResultHook) addUnlistedResource(groupResource string) {
+	for _, unlisted := range recv.result.UnlistedResources {
+		if unlisted == groupResource {
+			return
+		}
+	}
+	recv.result.UnlistedResources = append(recv.result.UnlistedResources, groupResource)
+}
+
+// unlistedResource returns the group resource of an entry Velero logs when it cannot list the items of a resource.
+// The item collector logs the group version and resource as the group and resource fields
+func unlistedResource(entry *logrus.Entry) (string, bool) {
+	if entry.Level > logrus.ErrorLevel || (entry.Message != "Error listing items" && entry.Message != "Error getting dynamic client") {
+		return "", false
+	}
+	resource, ok := entry.Data["resource"].(string)
+	if !ok {
+		return "", false
+	}
+	groupVersion, _ := entry.Data["group"].(string)
+	gv, err := schema.ParseGroupVersion(groupVersion)
+	if err != nil {
+		return "", false
+	}
+	return schema.GroupResource{Group: gv.Group, Resource: resource}.String(), true
+}
+
+// forwardHook passes the entries of the backup logger on to the PE's logger
+type forwardHook struct {
+	target logrus.FieldLogger
+}
+
+func (recv forwardHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (recv forwardHook) Fire(entry *logrus.Entry) error {
+	logger := recv.target.WithFields(entry.Data)
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		logger.Error(entry.Message)
+	case logrus.WarnLevel:
+		logger.Warn(entry.Message)
+	case logrus.InfoLevel:
+		logger.Info(entry.Message)
+	default:
+		logger.Debug(entry.Message)
+	}
+	return nil
+}
+
+// cancellableBackupItemAction fails the items of the backup once ctx is done.  Velero logs the error of each item and
+// keeps going, so without it a cancelled backup would keep running the item actions, and taking component snapshots,
+// to the last item
+type cancellableBackupItemAction struct {
+	ctx    context.Context
+	action velero.BackupItemAction
+}
+
+func (recv cancellableBackupItemAction) AppliesTo() (velero.ResourceSelector, error) {
+	return recv.action.AppliesTo()
+}
+
+func (recv cancellableBackupItemAction) Execute(item runtime.Unstructured, backup *velerov1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	if err := recv.ctx.Err(); err != nil {
+		return nil, nil, errors.Wrap(err, "backup cancelled")
+	}
+	return recv.action.Execute(item, backup)
+}
+
+// cancellablePodCommandExecutor stops running the backup hooks of Velero once ctx is done
+type cancellablePodCommandExecutor struct {
+	ctx      context.Context
+	executor podexec.PodCommandExecutor
+}
+
+func (recv cancellablePodCommandExecutor) ExecutePodCommand(log logrus.FieldLogger, item map[string]interface{}, namespace, name, hookName string,
+	hook *velerov1.ExecHook) error {
+	if err := recv.ctx.Err(); err != nil {
+		return errors.Wrapf(err, "backup cancelled, not running hook %s", hookName)
+	}
+	return recv.executor.ExecutePodCommand(log, item, namespace, name, hookName, hook)
+}
+
+// runBackup streams the Velero backup of the namespace into writer.  If the backup fails, or ctx is cancelled, the
+// writer is closed with the error so that the reader sees the failure instead of a truncated tarball.  Cancelling
+// ctx also fails the remaining items of the backup, and stops its hooks if k8sBackupper was created by newBackupper
+func (recv *KubernetesNamespaceProtectedEntity) runBackup(ctx context.Context, k8sBackupper backup.Backupper, request backup.Request,
+	writer *io.PipeWriter) {
+	backupDone := make(chan struct{})
+	defer close(backupDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// The reader sees the cancellation at once, the backup itself stops at its next item
+			writer.CloseWithError(ctx.Err())
+		case <-backupDone:
+		}
+	}()
+
+	resultHook := &backupResultHook{}
+	backupLogger := logrus.New()
+	backupLogger.Out = ioutil.Discard
+	if recv.backupLog != nil {
+		backupLogger.Out = recv.backupLog
+	}
+	backupLogger.Level = logrus.DebugLevel
+	backupLogger.AddHook(resultHook)
+	backupLogger.AddHook(forwardHook{target: recv.logger.WithField("namespace", recv.name)})
+
+	actions := make([]velero.BackupItemAction, len(recv.actions))
+	for i, action := range recv.actions {
+		actions[i] = cancellableBackupItemAction{ctx: ctx, action: action}
+	}
+	appenders := []tarballAppender{}
+	if recv.petm != nil && recv.petm.operationTracker != nil {
+		appenders = append(appenders, newComponentOperationStamper(ctx, recv.petm.operationTracker, string(request.Backup.UID)))
+	}
+	if recv.podVolumes != nil {
+		appenders = append(appenders, recv.podVolumes)
+	}
+	backupFile := io.Writer(writer)
+	var veleroWriter *io.PipeWriter
+	var appendDone chan error
+	if len(appenders) > 0 {
+		// The tarball written by Velero is passed through so that entries can be added to its end
+		var veleroReader *io.PipeReader
+		veleroReader, veleroWriter = io.Pipe()
+		backupFile = veleroWriter
+		appendDone = make(chan error, 1)
+		go func() {
+			err := appendToTarball(veleroReader, writer, appenders)
+			veleroReader.CloseWithError(err)
+			appendDone <- err
+		}()
+	}
+	err := k8sBackupper.Backup(backupLogger, &request, backupFile, actions, nil)
+	if veleroWriter != nil {
+		veleroWriter.CloseWithError(err)
+		if appendErr := <-appendDone; err == nil {
+			err = appendErr
+		}
+	}
+	result := resultHook.getResult()
+	if recv.backupResult != nil {
+		*recv.backupResult = result
+	}
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		recv.logger.WithError(err).Errorf("Backup of namespace %s failed", recv.name)
+		writer.CloseWithError(BackupError{Err: errors.WithStack(err), Result: result})
+		return
+	}
+	if len(result.Errors) > 0 {
+		recv.logger.Warnf("Backup of namespace %s completed with %d errors", recv.name, len(result.Errors))
+	}
+	writer.Close()
+}
+
+// tarballAppender adds entries to the end of the backup tarball.  holdItem is called with each item Velero writes and
+// returns true for the items the appender writes itself, in appendTo
+type tarballAppender interface {
+	holdItem(header *tar.Header, data []byte) (bool, error)
+	appendTo(tarWriter *tar.Writer) error
+}
+
+// appendToTarball copies the gzipped tarball in source to dest, leaving out the items held by appenders, and has each
+// of the appenders add its entries at the end
+func appendToTarball(source io.Reader, dest io.Writer, appenders []tarballAppender) error {
+	gzipReader, err := gzip.NewReader(source)
+	if err != nil {
+		return errors.Wrap(err, "Could not open backup tarball")
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	gzipWriter := gzip.NewWriter(dest)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "Could not read backup tarball")
+		}
+		if header.Typeflag != tar.TypeReg || !isItemPath(header.Name) {
+			if err := tarWriter.WriteHeader(header); err != nil {
+				return errors.Wrapf(err, "Could not write tar header for %s", header.Name)
+			}
+			if _, err := io.Copy(tarWriter, tarReader); err != nil {
+				return errors.Wrapf(err, "Could not copy %s", header.Name)
+			}
+			continue
+		}
+		data, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return errors.Wrapf(err, "Could not read %s", header.Name)
+		}
+		held := false
+		for _, appender := range appenders {
+			held, err = appender.holdItem(header, data)
+			if err != nil {
+				return err
+			}
+			if held {
+				break
+			}
+		}
+		if held {
+			continue
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return errors.Wrapf(err, "Could not write tar header for %s", header.Name)
+		}
+		if _, err := tarWriter.Write(data); err != nil {
+			return errors.Wrapf(err, "Could not copy %s", header.Name)
+		}
+	}
+	for _, appender := range appenders {
+		if err := appender.appendTo(tarWriter); err != nil {
+			return err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return errors.Wrap(err, "Could not close backup tarball")
+	}
+	return gzipWriter.Close()
+}
+
+// GetBackupResult returns the warnings and errors logged while the snapshot was taken
+func (recv *KubernetesNamespaceProtectedEntity) GetBackupResult(ctx context.Context) (BackupResult, error) {
+	if !recv.id.HasSnapshot() {
+		return BackupResult{}, errors.New("pe " + recv.id.String() + " is not a snapshot")
+	}
+	result := BackupResult{}
+	err := recv.petm.snapshotFiles.readJSON(recv.id, backupResultFileName, &result)
+	if err != nil {
+		return BackupResult{}, errors.Wrapf(err, "Could not read backup result for snapshot %s", recv.id.String())
+	}
+	return result, nil
+}
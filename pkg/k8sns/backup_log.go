@@ -0,0 +1,182 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"compress/gzip"
+	"context"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	backupLogFileName = "backup.log.gz"
+	// failedBackupLogsDirName is the dir, next to the snapshot dirs of a namespace, the logs of its failed snapshots
+	// are kept in
+	failedBackupLogsDirName = ".failed-backup-logs"
+	failedBackupLogSuffix   = ".log.gz"
+	// maxFailedBackupLogs is the number of failed snapshot logs kept for each namespace, older ones are pruned
+	maxFailedBackupLogs = 5
+)
+
+// backupLogFile collects the gzipped log of a backup in a temporary file while the snapshot is being taken.  Once
+// the snapshot has been written the log is stored with it.  The log of a snapshot that failed is kept as well, see
+// GetFailedBackupLogReader
+type backupLogFile struct {
+	file       *os.File
+	gzipWriter *gzip.Writer
+}
+
+func newBackupLogFile() (*backupLogFile, error) {
+	file, err := ioutil.TempFile("", "k8sns-backup-log-")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create backup log file")
+	}
+	return &backupLogFile{
+		file:       file,
+		gzipWriter: gzip.NewWriter(file),
+	}, nil
+}
+
+func (recv *backupLogFile) Write(p []byte) (int, error) {
+	return recv.gzipWriter.Write(p)
+}
+
+// store finishes the log and saves it with the snapshot
+func (recv *backupLogFile) store(snapshotFiles snapshotFileStore, snapshotPEID astrolabe.ProtectedEntityID) error {
+	if err := recv.finish(); err != nil {
+		return err
+	}
+	return snapshotFiles.write(snapshotPEID, backupLogFileName, recv.file)
+}
+
+// storeFailed finishes the log and keeps it as the log of the failed snapshot snapshotPEID.  The oldest failed logs
+// of the namespace are pruned so that only maxFailedBackupLogs are kept
+func (recv *backupLogFile) storeFailed(snapshotFiles snapshotFileStore, snapshotPEID astrolabe.ProtectedEntityID) error {
+	if err := recv.finish(); err != nil {
+		return err
+	}
+	dir := failedBackupLogsDir(snapshotFiles, snapshotPEID.GetID())
+	err := writeFileAtomically(filepath.Join(dir, snapshotPEID.GetSnapshotID().GetID()+failedBackupLogSuffix), recv.file)
+	if err != nil {
+		return err
+	}
+	return pruneFailedBackupLogs(dir)
+}
+
+// finish flushes the log and rewinds the file for reading.  It may be called more than once
+func (recv *backupLogFile) finish() error {
+	if err := recv.gzipWriter.Close(); err != nil {
+		return errors.Wrap(err, "could not finish backup log")
+	}
+	if _, err := recv.file.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "could not rewind backup log")
+	}
+	return nil
+}
+
+// remove deletes the temporary file
+func (recv *backupLogFile) remove() {
+	recv.file.Close()
+	os.Remove(recv.file.Name())
+}
+
+// GetBackupLogReader returns the gzipped log Velero wrote while the snapshot was taken.  The log has an entry for
+// each item that was backed up or skipped, along with any warnings and errors
+func (recv *KubernetesNamespaceProtectedEntity) GetBackupLogReader(ctx context.Context) (io.ReadCloser, error) {
+	if !recv.id.HasSnapshot() {
+		return nil, errors.New("pe " + recv.id.String() + " is not a snapshot")
+	}
+	reader, err := recv.petm.snapshotFiles.reader(recv.id, backupLogFileName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not read backup log for snapshot %s", recv.id.String())
+	}
+	return reader, nil
+}
+
+// GetFailedBackupLogReader returns the gzipped log of a snapshot of this namespace that failed, which was discarded
+// along with its data.  The logs of the latest maxFailedBackupLogs failed snapshots are kept
+func (recv *KubernetesNamespaceProtectedEntity) GetFailedBackupLogReader(ctx context.Context, snapshotID astrolabe.ProtectedEntitySnapshotID) (io.ReadCloser, error) {
+	if recv.id.HasSnapshot() {
+		return nil, errors.New("pe " + recv.id.String() + " is a snapshot, failed snapshot logs are kept for the namespace")
+	}
+	path := filepath.Join(failedBackupLogsDir(recv.petm.snapshotFiles, recv.id.GetID()), snapshotID.GetID()+failedBackupLogSuffix)
+	reader, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not read backup log of failed snapshot %s", recv.id.IDWithSnapshot(snapshotID).String())
+	}
+	return reader, nil
+}
+
+// ListFailedBackupLogs returns the IDs of the failed snapshots of this namespace whose logs are kept, oldest first
+func (recv *KubernetesNamespaceProtectedEntity) ListFailedBackupLogs(ctx context.Context) ([]astrolabe.ProtectedEntitySnapshotID, error) {
+	logs, err := listFailedBackupLogs(failedBackupLogsDir(recv.petm.snapshotFiles, recv.id.GetID()))
+	if err != nil {
+		return nil, err
+	}
+	snapshotIDs := []astrolabe.ProtectedEntitySnapshotID{}
+	for _, log := range logs {
+		snapshotIDs = append(snapshotIDs, astrolabe.NewProtectedEntitySnapshotID(strings.TrimSuffix(log.Name(), failedBackupLogSuffix)))
+	}
+	return snapshotIDs, nil
+}
+
+func failedBackupLogsDir(snapshotFiles snapshotFileStore, peID string) string {
+	return filepath.Join(snapshotFiles.dir, peID, failedBackupLogsDirName)
+}
+
+// listFailedBackupLogs returns the failed snapshot logs in dir, oldest first
+func listFailedBackupLogs(dir string) ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Could not list failed backup logs in %s", dir)
+	}
+	logs := []os.FileInfo{}
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && strings.HasSuffix(entry.Name(), failedBackupLogSuffix) {
+			logs = append(logs, entry)
+		}
+	}
+	sort.SliceStable(logs, func(i, j int) bool {
+		return logs[i].ModTime().Before(logs[j].ModTime())
+	})
+	return logs, nil
+}
+
+// pruneFailedBackupLogs removes the oldest logs in dir beyond maxFailedBackupLogs
+func pruneFailedBackupLogs(dir string) error {
+	logs, err := listFailedBackupLogs(dir)
+	if err != nil {
+		return err
+	}
+	for len(logs) > maxFailedBackupLogs {
+		if err := os.Remove(filepath.Join(dir, logs[0].Name())); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Could not prune failed backup log %s", logs[0].Name())
+		}
+		logs = logs[1:]
+	}
+	return nil
+}
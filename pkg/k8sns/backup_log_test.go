@@ -0,0 +1,114 @@
+package k8sns
+
+import (
+	"compress/gzip"
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func readBackupLog(t *testing.T, reader io.ReadCloser) string {
+	defer reader.Close()
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		t.Fatalf("gzip.NewReader failed with err %v", err)
+	}
+	contents, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		t.Fatalf("ReadAll failed with err %v", err)
+	}
+	return string(contents)
+}
+
+func newTestBackupLog(t *testing.T, contents string) *backupLogFile {
+	backupLog, err := newBackupLogFile()
+	if err != nil {
+		t.Fatalf("newBackupLogFile failed with err %v", err)
+	}
+	if _, err := backupLog.Write([]byte(contents)); err != nil {
+		t.Fatalf("Write failed with err %v", err)
+	}
+	return backupLog
+}
+
+func TestBackupLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sns-snapshots")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	petm := newTestSnapshotsPETM(t, dir, nil)
+	peID := astrolabe.NewProtectedEntityID(Typename, "ns-uid")
+	snapshotPEID := peID.IDWithSnapshot(astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+
+	backupLog := newTestBackupLog(t, "backed up configmap app/settings\n")
+	defer backupLog.remove()
+	if err := backupLog.store(petm.snapshotFiles, snapshotPEID); err != nil {
+		t.Fatalf("store failed with err %v", err)
+	}
+	snapshotPE := &KubernetesNamespaceProtectedEntity{petm: petm, id: snapshotPEID, name: "app", logger: logrus.New()}
+	reader, err := snapshotPE.GetBackupLogReader(ctx)
+	if err != nil {
+		t.Fatalf("GetBackupLogReader failed with err %v", err)
+	}
+	if contents := readBackupLog(t, reader); contents != "backed up configmap app/settings\n" {
+		t.Fatalf("unexpected backup log %q", contents)
+	}
+	livePE := &KubernetesNamespaceProtectedEntity{petm: petm, id: peID, name: "app", logger: logrus.New()}
+	if _, err := livePE.GetBackupLogReader(ctx); err == nil {
+		t.Fatalf("GetBackupLogReader succeeded for a live namespace")
+	}
+	missingPE := &KubernetesNamespaceProtectedEntity{petm: petm, name: "app", logger: logrus.New(),
+		id: peID.IDWithSnapshot(astrolabe.NewProtectedEntitySnapshotID("missing"))}
+	if _, err := missingPE.GetBackupLogReader(ctx); err == nil {
+		t.Fatalf("GetBackupLogReader succeeded for a snapshot without a log")
+	}
+}
+
+func TestFailedBackupLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sns-snapshots")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	petm := newTestSnapshotsPETM(t, dir, nil)
+	peID := astrolabe.NewProtectedEntityID(Typename, "ns-uid")
+	for i := 0; i < maxFailedBackupLogs+2; i++ {
+		backupLog := newTestBackupLog(t, "failed backup "+strconv.Itoa(i))
+		err := backupLog.storeFailed(petm.snapshotFiles, peID.IDWithSnapshot(astrolabe.NewProtectedEntitySnapshotID("snap-"+strconv.Itoa(i))))
+		backupLog.remove()
+		if err != nil {
+			t.Fatalf("storeFailed failed with err %v", err)
+		}
+		// Logs are pruned by modification time
+		past := time.Now().Add(time.Duration(i-maxFailedBackupLogs-2) * time.Minute)
+		path := filepath.Join(failedBackupLogsDir(petm.snapshotFiles, peID.GetID()), "snap-"+strconv.Itoa(i)+failedBackupLogSuffix)
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatalf("Chtimes failed with err %v", err)
+		}
+	}
+	livePE := &KubernetesNamespaceProtectedEntity{petm: petm, id: peID, name: "app", logger: logrus.New()}
+	snapshotIDs, err := livePE.ListFailedBackupLogs(ctx)
+	if err != nil || len(snapshotIDs) != maxFailedBackupLogs || snapshotIDs[0].GetID() != "snap-2" {
+		t.Fatalf("expected the latest %d failed logs, got %v, err %v", maxFailedBackupLogs, snapshotIDs, err)
+	}
+	reader, err := livePE.GetFailedBackupLogReader(ctx, astrolabe.NewProtectedEntitySnapshotID("snap-6"))
+	if err != nil {
+		t.Fatalf("GetFailedBackupLogReader failed with err %v", err)
+	}
+	if contents := readBackupLog(t, reader); contents != "failed backup 6" {
+		t.Fatalf("unexpected failed backup log %q", contents)
+	}
+	if _, err := livePE.GetFailedBackupLogReader(ctx, astrolabe.NewProtectedEntitySnapshotID("snap-0")); err == nil {
+		t.Fatalf("expected the oldest failed log to be pruned")
+	}
+}
@@ -0,0 +1,130 @@
+package k8sns
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/backup"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+type fakeBackupper struct {
+	backupFunc func(log logrus.FieldLogger, backupFile io.Writer) error
+	itemsFunc  func(actions []velero.BackupItemAction) error
+}
+
+func (recv fakeBackupper) Backup(log logrus.FieldLogger, request *backup.Request, backupFile io.Writer,
+	actions []velero.BackupItemAction, volumeSnapshotterGetter backup.VolumeSnapshotterGetter) error {
+	if recv.itemsFunc != nil {
+		return recv.itemsFunc(actions)
+	}
+	return recv.backupFunc(log, backupFile)
+}
+
+func TestRunBackupPropagatesErrors(t *testing.T) {
+	pe := &KubernetesNamespaceProtectedEntity{name: "test", logger: logrus.New(), backupResult: &BackupResult{}}
+	backupper := fakeBackupper{backupFunc: func(log logrus.FieldLogger, backupFile io.Writer) error {
+		backupFile.Write([]byte("partial"))
+		log.Warn("item skipped")
+		log.WithError(errors.New("forbidden")).Error("could not list pods")
+		return errors.New("backup exploded")
+	}}
+	reader, writer := io.Pipe()
+	go pe.runBackup(context.Background(), backupper, backup.Request{}, writer)
+	_, err := ioutil.ReadAll(reader)
+	backupErr, ok := err.(BackupError)
+	if !ok {
+		t.Fatalf("Expected BackupError from reader, got %v", err)
+	}
+	if len(backupErr.Result.Warnings) != 1 || len(backupErr.Result.Errors) != 1 {
+		t.Errorf("Unexpected backup result %v", backupErr.Result)
+	}
+	if pe.backupResult.Errors[0] != "could not list pods: forbidden" {
+		t.Errorf("Unexpected recorded errors %v", pe.backupResult.Errors)
+	}
+}
+
+func TestRunBackupCancelled(t *testing.T) {
+	pe := &KubernetesNamespaceProtectedEntity{name: "test", logger: logrus.New()}
+	ctx, cancel := context.WithCancel(context.Background())
+	backupper := fakeBackupper{backupFunc: func(log logrus.FieldLogger, backupFile io.Writer) error {
+		cancel()
+		for {
+			if _, err := backupFile.Write([]byte("data")); err != nil {
+				return err
+			}
+		}
+	}}
+	reader, writer := io.Pipe()
+	go pe.runBackup(ctx, backupper, backup.Request{}, writer)
+	_, err := ioutil.ReadAll(reader)
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("Expected context.Canceled from reader, got %v", err)
+	}
+}
+
+func TestRunBackupCancelledStopsComponentSnapshots(t *testing.T) {
+	livePE := &fakeComponentPE{id: astrolabe.NewProtectedEntityID("psql", "test-uid")}
+	pem := &fakePEM{pes: map[string]*fakeComponentPE{livePE.id.String(): livePE}}
+	action, err := NewAstrolabeBackupItemAction(newTestBackupItemActionOptions(pem))
+	if err != nil {
+		t.Fatalf("NewAstrolabeBackupItemAction failed with err %v", err)
+	}
+	pe := &KubernetesNamespaceProtectedEntity{name: "test", logger: logrus.New(), actions: []velero.BackupItemAction{action}}
+	ctx, cancel := context.WithCancel(context.Background())
+	itemErrors := []error{}
+	backupDone := make(chan struct{})
+	backupper := fakeBackupper{itemsFunc: func(actions []velero.BackupItemAction) error {
+		defer close(backupDone)
+		// Velero logs the error of each item and goes on to the next one
+		for i := 0; i < 3; i++ {
+			if i == 1 {
+				cancel()
+			}
+			if _, _, err := actions[0].Execute(newTestItem("acid.zalan.do/v1", "postgresql"), &v1.Backup{}); err != nil {
+				itemErrors = append(itemErrors, err)
+			}
+		}
+		return nil
+	}}
+	reader, writer := io.Pipe()
+	go pe.runBackup(ctx, backupper, backup.Request{}, writer)
+	_, err = ioutil.ReadAll(reader)
+	if errors.Cause(err) != context.Canceled {
+		t.Fatalf("Expected context.Canceled from reader, got %v", err)
+	}
+	// The reader sees the cancel before the backup has gone through its items
+	<-backupDone
+	if livePE.snapshots != 1 {
+		t.Fatalf("Expected only the item before the cancel to be snapshotted, got %d snapshots", livePE.snapshots)
+	}
+	if len(itemErrors) != 2 {
+		t.Fatalf("Expected the items after the cancel to fail, got errors %v", itemErrors)
+	}
+}
+
+func TestBackupResultHookRecordsUnlistedResources(t *testing.T) {
+	hook := &backupResultHook{}
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	logger.AddHook(hook)
+	forbidden := errors.New("forbidden")
+	logger.WithField("group", "apps/v1").WithField("resource", "statefulsets").WithError(forbidden).Error("Error listing items")
+	logger.WithField("group", "apps/v1").WithField("resource", "statefulsets").WithError(forbidden).Error("Error listing items")
+	logger.WithField("group", "v1").WithField("resource", "secrets").WithError(forbidden).Error("Error getting dynamic client")
+	logger.WithField("group", "v1").WithField("resource", "pods").Warn("Error listing items")
+	result := hook.getResult()
+	expected := []string{"statefulsets.apps", "secrets"}
+	if !reflect.DeepEqual(result.UnlistedResources, expected) {
+		t.Fatalf("expected unlisted resources %v, got %v", expected, result.UnlistedResources)
+	}
+	if len(result.Errors) != 3 || len(result.Warnings) != 1 {
+		t.Fatalf("unexpected backup result %v", result)
+	}
+}
@@ -0,0 +1,325 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe-velero/pkg/pvc"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"github.com/vmware-tanzu/astrolabe/pkg/psql"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"sync"
+)
+
+// k8sns config params for the component mapping
+const (
+	// ComponentTypesParam is a list of ComponentMappings in the k8sns config
+	ComponentTypesParam = "componentTypes"
+	// ComponentTypesConfigMapParam names a ConfigMap, as "namespace/name", holding ComponentMappings under the
+	// ComponentTypesConfigMapKey key as YAML or JSON
+	ComponentTypesConfigMapParam = "componentTypesConfigMap"
+	ComponentTypesConfigMapKey   = "componentTypes"
+	// SnapshotPVCsParam adds PVCComponentMapping to the default mappings
+	SnapshotPVCsParam = "snapshotPVCs"
+)
+
+// IDSource selects how the ID of a component PE is derived from its Kubernetes item
+type IDSource string
+
+const (
+	IDFromUID      IDSource = "uid"
+	IDFromName     IDSource = "name"
+	IDFromJSONPath IDSource = "jsonPath"
+)
+
+// ComponentMapping maps a Kubernetes resource onto the PE type that snapshots its items as components of the namespace.
+// Version is optional; when it is set only items of that version match.  When LabelSelector is set only matching
+// items are snapshotted.  The items of RelatedResources are backed up along with each component item
+type ComponentMapping struct {
+	Group         string   `json:"group"`
+	Version       string   `json:"version,omitempty"`
+	Resource      string   `json:"resource"`
+	PEType        string   `json:"peType"`
+	IDSource      IDSource `json:"idSource,omitempty"`
+	JSONPath      string   `json:"jsonPath,omitempty"`
+	LabelSelector string   `json:"labelSelector,omitempty"`
+
+	RelatedResources []RelatedResource `json:"relatedResources,omitempty"`
+}
+
+// DefaultComponentMappings returns the mappings used for resources that are not configured.  PVCs are only mapped when
+// the SnapshotPVCs param is set, see PVCComponentMapping
+func DefaultComponentMappings() []ComponentMapping {
+	return []ComponentMapping{
+		{Group: "acid.zalan.do", Resource: "postgresqls", PEType: psql.Typename, IDSource: IDFromUID,
+			RelatedResources: zalandoRelatedResources()},
+	}
+}
+
+// PVCComponentMapping maps PVCs onto pvc PEs, snapshotted as CSI VolumeSnapshots.  It needs the VolumeSnapshot CRDs,
+// so it is opt-in.  The PVCs of Zalando postgresql clusters are excluded, their data is in the psql snapshot
+func PVCComponentMapping() ComponentMapping {
+	return ComponentMapping{Resource: "persistentvolumeclaims", PEType: pvc.Typename, IDSource: IDFromUID,
+		LabelSelector: "application!=spilo"}
+}
+
+func (recv ComponentMapping) GroupResource() schema.GroupResource {
+	return schema.GroupResource{Group: recv.Group, Resource: recv.Resource}
+}
+
+// validate checks the mapping and fills in the default ID source
+func (recv *ComponentMapping) validate() error {
+	if recv.Resource == "" {
+		return errors.New("resource must be set")
+	}
+	if recv.PEType == "" {
+		return errors.New(fmt.Sprintf("peType must be set for %s", recv.GroupResource().String()))
+	}
+	switch recv.IDSource {
+	case "":
+		recv.IDSource = IDFromUID
+	case IDFromUID, IDFromName:
+	case IDFromJSONPath:
+		if _, err := parseJSONPath(recv.JSONPath); err != nil {
+			return errors.Wrapf(err, "invalid jsonPath for %s", recv.GroupResource().String())
+		}
+	default:
+		return errors.New(fmt.Sprintf("unknown idSource %q for %s", recv.IDSource, recv.GroupResource().String()))
+	}
+	if _, err := labels.Parse(recv.LabelSelector); err != nil {
+		return errors.Wrapf(err, "invalid labelSelector for %s", recv.GroupResource().String())
+	}
+	for _, related := range recv.RelatedResources {
+		if err := related.validate(); err != nil {
+			return errors.Wrapf(err, "invalid relatedResources for %s", recv.GroupResource().String())
+		}
+	}
+	return nil
+}
+
+// validateComponentMappings validates each of the mappings and fills in their defaults
+func validateComponentMappings(mappings []ComponentMapping) error {
+	for i := range mappings {
+		if err := mappings[i].validate(); err != nil {
+			return errors.Wrapf(err, "invalid component mapping %d", i)
+		}
+	}
+	return nil
+}
+
+// componentResources returns the resources, as resource.group, that have a mapping
+func componentResources(mappings []ComponentMapping) []string {
+	resources := []string{}
+	seen := map[string]bool{}
+	for _, mapping := range mappings {
+		resource := mapping.GroupResource().String()
+		if !seen[resource] {
+			seen[resource] = true
+			resources = append(resources, resource)
+		}
+	}
+	return resources
+}
+
+// matches returns true if the item of resource gvr is snapshotted by the mapping
+func (recv ComponentMapping) matches(gvr schema.GroupVersionResource, item runtime.Unstructured) (bool, error) {
+	if gvr.GroupResource() != recv.GroupResource() || (recv.Version != "" && recv.Version != gvr.Version) {
+		return false, nil
+	}
+	selector, err := labels.Parse(recv.LabelSelector)
+	if err != nil {
+		return false, err
+	}
+	itemLabels, err := meta.NewAccessor().Labels(item)
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to retrieve labels")
+	}
+	return selector.Matches(labels.Set(itemLabels)), nil
+}
+
+// getPEID returns the ID of the component PE for item
+func (recv ComponentMapping) getPEID(item runtime.Unstructured) (astrolabe.ProtectedEntityID, error) {
+	accessor := meta.NewAccessor()
+	var id string
+	switch recv.IDSource {
+	case IDFromUID, "":
+		uid, err := accessor.UID(item)
+		if err != nil {
+			return astrolabe.ProtectedEntityID{}, errors.Wrap(err, "Failed to retrieve UID")
+		}
+		id = string(uid)
+	case IDFromName:
+		name, err := accessor.Name(item)
+		if err != nil {
+			return astrolabe.ProtectedEntityID{}, errors.Wrap(err, "Failed to retrieve name")
+		}
+		id = name
+	case IDFromJSONPath:
+		jsonPath, err := parseJSONPath(recv.JSONPath)
+		if err != nil {
+			return astrolabe.ProtectedEntityID{}, err
+		}
+		results, err := jsonPath.FindResults(item.UnstructuredContent())
+		if err != nil {
+			return astrolabe.ProtectedEntityID{}, errors.Wrapf(err, "Could not evaluate jsonPath %s", recv.JSONPath)
+		}
+		if len(results) != 1 || len(results[0]) != 1 {
+			return astrolabe.ProtectedEntityID{}, errors.New(fmt.Sprintf("jsonPath %s must select exactly one value", recv.JSONPath))
+		}
+		id = fmt.Sprint(results[0][0].Interface())
+	default:
+		return astrolabe.ProtectedEntityID{}, errors.New(fmt.Sprintf("unknown idSource %q", recv.IDSource))
+	}
+	if id == "" {
+		return astrolabe.ProtectedEntityID{}, errors.New(fmt.Sprintf("empty %s ID for %s item", recv.IDSource, recv.GroupResource().String()))
+	}
+	return astrolabe.NewProtectedEntityID(recv.PEType, id), nil
+}
+
+// parseJSONPath accepts paths with or without the surrounding braces, e.g. "{.spec.volumeID}" or ".spec.volumeID"
+func parseJSONPath(path string) (*jsonpath.JSONPath, error) {
+	if path == "" {
+		return nil, errors.New("jsonPath must be set")
+	}
+	if !strings.HasPrefix(path, "{") {
+		path = "{" + path + "}"
+	}
+	jsonPath := jsonpath.New("id")
+	if err := jsonPath.Parse(path); err != nil {
+		return nil, err
+	}
+	return jsonPath, nil
+}
+
+// ParseComponentMappings parses a YAML or JSON list of ComponentMappings
+func ParseComponentMappings(data []byte) ([]ComponentMapping, error) {
+	mappings := []ComponentMapping{}
+	if err := yaml.UnmarshalStrict(data, &mappings); err != nil {
+		return nil, errors.Wrap(err, "Could not parse component mappings")
+	}
+	if err := validateComponentMappings(mappings); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// LoadComponentMappings reads the ComponentMappings from the k8sns config and from the ConfigMap it names.
+// Entries for a resource replace the default mappings for that resource, the defaults for other resources are kept.
+// PVCComponentMapping is one of the defaults when SnapshotPVCs is set
+func LoadComponentMappings(ctx context.Context, config Config, kubeClient kubernetes.Interface) ([]ComponentMapping, error) {
+	configured := append([]ComponentMapping{}, config.ComponentTypes...)
+	if err := validateComponentMappings(configured); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s param", ComponentTypesParam)
+	}
+	if config.ComponentTypesConfigMap != "" {
+		namespace, name, err := splitConfigMapName(config.ComponentTypesConfigMap)
+		if err != nil {
+			return nil, err
+		}
+		configMap, err := kubeClient.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not retrieve ConfigMap %s", config.ComponentTypesConfigMap)
+		}
+		mappings, err := ParseComponentMappings([]byte(configMap.Data[ComponentTypesConfigMapKey]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid component mappings in ConfigMap %s", config.ComponentTypesConfigMap)
+		}
+		configured = append(configured, mappings...)
+	}
+	configuredResources := map[schema.GroupResource]bool{}
+	for _, mapping := range configured {
+		configuredResources[mapping.GroupResource()] = true
+	}
+	defaults := DefaultComponentMappings()
+	if config.SnapshotPVCs {
+		defaults = append(defaults, PVCComponentMapping())
+	}
+	returnMappings := []ComponentMapping{}
+	for _, mapping := range defaults {
+		if !configuredResources[mapping.GroupResource()] {
+			returnMappings = append(returnMappings, mapping)
+		}
+	}
+	return append(returnMappings, configured...), nil
+}
+
+// lazyComponentMappings defers LoadComponentMappings to the first use of the mappings, so that the type manager can
+// be created while the API server is unreachable.  A failed load is retried on the next use.  Once loaded the mappings
+// are kept, changes to the ComponentTypesConfigMap take effect when the server or plugin is restarted
+type lazyComponentMappings struct {
+	config     Config
+	kubeClient kubernetes.Interface
+	logger     logrus.FieldLogger
+	mutex      sync.Mutex
+	mappings   []ComponentMapping
+}
+
+func newLazyComponentMappings(config Config, kubeClient kubernetes.Interface, logger logrus.FieldLogger) *lazyComponentMappings {
+	return &lazyComponentMappings{
+		config:     config,
+		kubeClient: kubeClient,
+		logger:     logger,
+	}
+}
+
+// get returns the mappings, loading them if they have not been loaded yet
+func (recv *lazyComponentMappings) get(ctx context.Context) ([]ComponentMapping, error) {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	if recv.mappings != nil {
+		return recv.mappings, nil
+	}
+	mappings, err := LoadComponentMappings(ctx, recv.config, recv.kubeClient)
+	if err != nil {
+		return nil, err
+	}
+	for _, mapping := range mappings {
+		recv.logger.Infof("Component mapping %s", mapping.String())
+	}
+	recv.mappings = mappings
+	return mappings, nil
+}
+
+// splitConfigMapName splits the ComponentTypesConfigMapParam value into the namespace and name of the ConfigMap
+func splitConfigMapName(configMapName string) (string, string, error) {
+	parts := strings.Split(configMapName, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New(fmt.Sprintf("%s param must be of the form namespace/name, got %q",
+			ComponentTypesConfigMapParam, configMapName))
+	}
+	return parts[0], parts[1], nil
+}
+
+func (recv ComponentMapping) String() string {
+	idSource := string(recv.IDSource)
+	if recv.IDSource == IDFromJSONPath {
+		idSource += " " + recv.JSONPath
+	}
+	return fmt.Sprintf("%s -> %s (id from %s, labelSelector %q)", recv.GroupResource().String(), recv.PEType, idSource,
+		recv.LabelSelector)
+}
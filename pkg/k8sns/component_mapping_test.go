@@ -0,0 +1,173 @@
+package k8sns
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestParseComponentMappings(t *testing.T) {
+	mappings, err := ParseComponentMappings([]byte(`
+- group: example.com
+  version: v1
+  resource: databases
+  peType: exampledb
+  idSource: jsonPath
+  jsonPath: .spec.databaseID
+  labelSelector: backup=true
+- resource: configmaps
+  peType: cm
+`))
+	if err != nil {
+		t.Fatalf("ParseComponentMappings failed with err %v", err)
+	}
+	if len(mappings) != 2 || mappings[0].GroupResource().String() != "databases.example.com" {
+		t.Fatalf("unexpected mappings %v", mappings)
+	}
+	if mappings[1].IDSource != IDFromUID {
+		t.Fatalf("expected default idSource uid, got %s", mappings[1].IDSource)
+	}
+
+	invalid := []string{
+		`[{"resource": "databases"}]`,
+		`[{"resource": "databases", "peType": "db", "idSource": "label"}]`,
+		`[{"resource": "databases", "peType": "db", "idSource": "jsonPath"}]`,
+		`[{"resource": "databases", "peType": "db", "labelSelector": "a in b"}]`,
+		`[{"resource": "databases", "peType": "db", "unknownField": "x"}]`,
+	}
+	for _, data := range invalid {
+		if _, err := ParseComponentMappings([]byte(data)); err == nil {
+			t.Fatalf("ParseComponentMappings accepted %s", data)
+		}
+	}
+}
+
+func TestComponentMappingPEID(t *testing.T) {
+	item := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "example.com/v1",
+		"kind":       "Database",
+		"metadata": map[string]interface{}{
+			"name":   "orders",
+			"uid":    "db-uid",
+			"labels": map[string]interface{}{"backup": "true"},
+		},
+		"spec": map[string]interface{}{"databaseID": "db-1234"},
+	}}
+	gvr := schema.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "databases"}
+	tests := []struct {
+		mapping  ComponentMapping
+		expected string
+	}{
+		{ComponentMapping{Group: "example.com", Resource: "databases", PEType: "db", IDSource: IDFromUID}, "db-uid"},
+		{ComponentMapping{Group: "example.com", Resource: "databases", PEType: "db", IDSource: IDFromName}, "orders"},
+		{ComponentMapping{Group: "example.com", Resource: "databases", PEType: "db", IDSource: IDFromJSONPath,
+			JSONPath: "{.spec.databaseID}"}, "db-1234"},
+	}
+	for _, test := range tests {
+		peID, err := test.mapping.getPEID(item)
+		if err != nil {
+			t.Fatalf("getPEID failed for %s with err %v", test.mapping.String(), err)
+		}
+		if peID.GetID() != test.expected || peID.GetPeType() != "db" {
+			t.Fatalf("expected ID %s, got %s", test.expected, peID.String())
+		}
+	}
+	missing := ComponentMapping{Resource: "databases", PEType: "db", IDSource: IDFromJSONPath, JSONPath: ".spec.missing"}
+	if _, err := missing.getPEID(item); err == nil {
+		t.Fatalf("getPEID succeeded for a missing jsonPath")
+	}
+
+	selected := ComponentMapping{Group: "example.com", Resource: "databases", PEType: "db", LabelSelector: "backup=true"}
+	if matches, err := selected.matches(gvr, item); err != nil || !matches {
+		t.Fatalf("expected item to match %s, got %v, %v", selected.String(), matches, err)
+	}
+	excluded := ComponentMapping{Group: "example.com", Resource: "databases", PEType: "db", LabelSelector: "backup=false"}
+	if matches, _ := excluded.matches(gvr, item); matches {
+		t.Fatalf("expected item not to match %s", excluded.String())
+	}
+	otherVersion := ComponentMapping{Group: "example.com", Version: "v2", Resource: "databases", PEType: "db"}
+	if matches, _ := otherVersion.matches(gvr, item); matches {
+		t.Fatalf("expected item not to match %s", otherVersion.String())
+	}
+}
+
+func TestLoadComponentMappings(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "astrolabe-components"},
+		Data: map[string]string{
+			ComponentTypesConfigMapKey: `[{"group": "example.com", "resource": "databases", "peType": "exampledb"}]`,
+		},
+	})
+	config := Config{
+		ComponentTypes:          []ComponentMapping{{Resource: "persistentvolumeclaims", PEType: "ivd"}},
+		ComponentTypesConfigMap: "velero/astrolabe-components",
+	}
+	mappings, err := LoadComponentMappings(context.Background(), config, kubeClient)
+	if err != nil {
+		t.Fatalf("LoadComponentMappings failed with err %v", err)
+	}
+	peTypes := map[string]string{}
+	for _, mapping := range mappings {
+		peTypes[mapping.GroupResource().String()] = mapping.PEType
+	}
+	expected := map[string]string{
+		"persistentvolumeclaims":    "ivd",
+		"postgresqls.acid.zalan.do": "psql",
+		"databases.example.com":     "exampledb",
+	}
+	if len(peTypes) != len(expected) || len(mappings) != len(expected) {
+		t.Fatalf("expected mappings %v, got %v", expected, peTypes)
+	}
+	for resource, peType := range expected {
+		if peTypes[resource] != peType {
+			t.Fatalf("expected %s to map to %s, got %s", resource, peType, peTypes[resource])
+		}
+	}
+
+	mappings, err = LoadComponentMappings(context.Background(), Config{}, kubeClient)
+	if err != nil || len(mappings) != 1 || mappings[0].PEType != "psql" {
+		t.Fatalf("expected only the psql mapping without snapshotPVCs, got %v, err %v", mappings, err)
+	}
+	mappings, err = LoadComponentMappings(context.Background(), Config{SnapshotPVCs: true}, kubeClient)
+	if err != nil || len(mappings) != 2 || mappings[1].PEType != "pvc" || mappings[1].LabelSelector != "application!=spilo" {
+		t.Fatalf("expected the pvc mapping with snapshotPVCs, got %v, err %v", mappings, err)
+	}
+
+	if _, err := LoadComponentMappings(context.Background(), Config{ComponentTypesConfigMap: "missing"}, kubeClient); err == nil {
+		t.Fatalf("LoadComponentMappings accepted a ConfigMap name without a namespace")
+	}
+}
+
+func TestLazyComponentMappings(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "velero", Name: "astrolabe-components"},
+		Data: map[string]string{
+			ComponentTypesConfigMapKey: `[{"group": "example.com", "resource": "databases", "peType": "exampledb"}]`,
+		},
+	}
+	lazyMappings := newLazyComponentMappings(Config{ComponentTypesConfigMap: "velero/astrolabe-components"}, kubeClient, logrus.New())
+	if _, err := lazyMappings.get(context.Background()); err == nil {
+		t.Fatalf("expected the load to fail without the ConfigMap")
+	}
+	configMaps := kubeClient.CoreV1().ConfigMaps("velero")
+	if _, err := configMaps.Create(context.Background(), configMap, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Create failed with err %v", err)
+	}
+	mappings, err := lazyMappings.get(context.Background())
+	if err != nil || len(mappings) != 2 {
+		t.Fatalf("expected the failed load to be retried, got %v, err %v", mappings, err)
+	}
+	configMap.Data[ComponentTypesConfigMapKey] = "[]"
+	if _, err := configMaps.Update(context.Background(), configMap, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Update failed with err %v", err)
+	}
+	if mappings, err := lazyMappings.get(context.Background()); err != nil || len(mappings) != 2 {
+		t.Fatalf("expected the loaded mappings to be kept, got %v, err %v", mappings, err)
+	}
+}
@@ -0,0 +1,496 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AsyncComponentSnapshotsParam is the k8sns config param that makes the backup item action take component
+	// snapshots in the background.  Only the in-process server supports it, Velero does not wait for the operations
+	AsyncComponentSnapshotsParam = "asyncComponentSnapshots"
+	// ComponentOperationAnnotation holds the ID of the operation taking the component snapshot of the item, in place
+	// of the snapshot annotations
+	ComponentOperationAnnotation = "astrolabe.io/snapshot-operation"
+
+	componentOperationsFileName = "component-operations.json"
+	operationPollInterval       = time.Second
+	operationProgressInterval   = 30 * time.Second
+)
+
+type OperationPhase string
+
+const (
+	OperationInProgress OperationPhase = "InProgress"
+	OperationCompleted  OperationPhase = "Completed"
+	OperationFailed     OperationPhase = "Failed"
+)
+
+// ComponentOperation is a component snapshot taken in the background for an item of a backup.  Record is set once the
+// operation has completed
+type ComponentOperation struct {
+	ID        string          `json:"id"`
+	BackupUID string          `json:"backupUID"`
+	ItemUID   string          `json:"itemUID"`
+	PEID      string          `json:"peID"`
+	Phase     OperationPhase  `json:"phase"`
+	Error     string          `json:"error,omitempty"`
+	Started   time.Time       `json:"started"`
+	Updated   time.Time       `json:"updated"`
+	Record    *SnapshotRecord `json:"record,omitempty"`
+}
+
+// OperationProgress counts the component operations of a backup by phase
+type OperationProgress struct {
+	Total      int
+	InProgress int
+	Completed  int
+	Failed     int
+}
+
+func (recv OperationProgress) String() string {
+	return fmt.Sprintf("%d of %d component snapshots finished, %d failed", recv.Completed+recv.Failed, recv.Total, recv.Failed)
+}
+
+// OperationTracker runs component snapshots in the background and keeps their state in a JSON file, so that the
+// snapshots can be resolved from the operation IDs on the items after a restart.  Operations that were still running
+// when the process exited are reported as failed
+type OperationTracker struct {
+	path    string
+	mutex   sync.Mutex
+	running map[string]bool
+	// backups holds the context of the operations running for each backup, so they can be cancelled together
+	backups map[string]*backupOperations
+	// discarded lists the backups whose operations have been discarded, no new operations are started for them
+	discarded map[string]bool
+	logger    logrus.FieldLogger
+}
+
+// backupOperations is the context shared by the running operations of a backup
+type backupOperations struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running int
+}
+
+func NewOperationTracker(path string, logger logrus.FieldLogger) *OperationTracker {
+	return &OperationTracker{
+		path:      path,
+		running:   map[string]bool{},
+		backups:   map[string]*backupOperations{},
+		discarded: map[string]bool{},
+		logger:    logger,
+	}
+}
+
+// Start records a new operation for the item itemUID of backup backupUID and calls snapshot in the background.  It
+// returns the ID of the operation.  The context passed to snapshot is cancelled by Cancel or Discard for the backup
+func (recv *OperationTracker) Start(backupUID string, itemUID string, peID astrolabe.ProtectedEntityID,
+	snapshot func(ctx context.Context) (SnapshotRecord, error)) (string, error) {
+	operationUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to create new UUID")
+	}
+	now := time.Now().UTC()
+	operation := ComponentOperation{
+		ID:        operationUUID.String(),
+		BackupUID: backupUID,
+		ItemUID:   itemUID,
+		PEID:      peID.String(),
+		Phase:     OperationInProgress,
+		Started:   now,
+		Updated:   now,
+	}
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	if recv.discarded[backupUID] {
+		return "", errors.New("the component snapshots of backup " + backupUID + " have been discarded")
+	}
+	operations, err := recv.load()
+	if err != nil {
+		return "", err
+	}
+	if err := recv.save(append(operations, operation)); err != nil {
+		return "", err
+	}
+	backup, ok := recv.backups[backupUID]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		backup = &backupOperations{ctx: ctx, cancel: cancel}
+		recv.backups[backupUID] = backup
+	}
+	backup.running++
+	recv.running[operation.ID] = true
+	go recv.run(backup.ctx, operation, snapshot)
+	return operation.ID, nil
+}
+
+func (recv *OperationTracker) run(ctx context.Context, operation ComponentOperation, snapshot func(ctx context.Context) (SnapshotRecord, error)) {
+	logger := recv.logger.WithField("operation", operation.ID).WithField("pe", operation.PEID)
+	record, err := snapshot(ctx)
+	operation.Updated = time.Now().UTC()
+	if err != nil {
+		logger.WithError(err).Error("Component snapshot failed")
+		operation.Phase = OperationFailed
+		operation.Error = err.Error()
+	} else {
+		logger.Infof("Component snapshot %s completed after %s", record.SnapshotID, operation.Updated.Sub(operation.Started))
+		operation.Phase = OperationCompleted
+		operation.Record = &record
+	}
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	delete(recv.running, operation.ID)
+	if backup, ok := recv.backups[operation.BackupUID]; ok {
+		backup.running--
+		if backup.running == 0 {
+			backup.cancel()
+			delete(recv.backups, operation.BackupUID)
+		}
+	}
+	if err := recv.update(operation); err != nil {
+		logger.WithError(err).Error("Could not record the result of the component snapshot")
+	}
+}
+
+// Cancel cancels the context of the running operations of backupUID
+func (recv *OperationTracker) Cancel(backupUID string) {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	if backup, ok := recv.backups[backupUID]; ok {
+		backup.cancel()
+	}
+}
+
+// Discard is called when the snapshot of backupUID fails.  It stops the operations of the backup, waits for them to
+// return and deletes the component snapshots that completed, so that none are left behind without a namespace
+// snapshot referencing them.  The operations are removed once all of their snapshots are deleted
+func (recv *OperationTracker) Discard(ctx context.Context, backupUID string, pem astrolabe.ProtectedEntityManager) error {
+	recv.mutex.Lock()
+	recv.discarded[backupUID] = true
+	recv.mutex.Unlock()
+	recv.Cancel(backupUID)
+	operations, err := recv.WaitForBackup(ctx, backupUID)
+	if err != nil {
+		return err
+	}
+	failed := map[string]error{}
+	for _, operation := range operations {
+		if operation.Phase != OperationCompleted || operation.Record == nil {
+			continue
+		}
+		if pem == nil {
+			failed[operation.Record.SnapshotID] = errors.New("no ProtectedEntityManager set")
+			continue
+		}
+		recv.logger.Infof("Deleting component snapshot %s of discarded backup %s", operation.Record.SnapshotID, backupUID)
+		if err := deleteComponentSnapshot(ctx, pem, operation.Record.SnapshotID); err != nil {
+			failed[operation.Record.SnapshotID] = err
+		}
+	}
+	if len(failed) > 0 {
+		return ComponentDeleteError{Failed: failed}
+	}
+	return recv.RemoveForBackup(backupUID)
+}
+
+// Get returns the operation with the ID operationID
+func (recv *OperationTracker) Get(operationID string) (ComponentOperation, bool, error) {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	operations, err := recv.load()
+	if err != nil {
+		return ComponentOperation{}, false, err
+	}
+	for _, operation := range operations {
+		if operation.ID == operationID {
+			return operation, true, nil
+		}
+	}
+	return ComponentOperation{}, false, nil
+}
+
+// ListForBackup returns the operations started for backupUID and their progress
+func (recv *OperationTracker) ListForBackup(backupUID string) ([]ComponentOperation, OperationProgress, error) {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	operations, err := recv.load()
+	if err != nil {
+		return nil, OperationProgress{}, err
+	}
+	backupOperations := []ComponentOperation{}
+	progress := OperationProgress{}
+	for _, operation := range operations {
+		if operation.BackupUID != backupUID {
+			continue
+		}
+		backupOperations = append(backupOperations, operation)
+		progress.Total++
+		switch operation.Phase {
+		case OperationInProgress:
+			progress.InProgress++
+		case OperationCompleted:
+			progress.Completed++
+		case OperationFailed:
+			progress.Failed++
+		}
+	}
+	return backupOperations, progress, nil
+}
+
+// WaitForBackup waits until all of the operations of backupUID have completed or failed, logging the progress while
+// they run, and returns them
+func (recv *OperationTracker) WaitForBackup(ctx context.Context, backupUID string) ([]ComponentOperation, error) {
+	ticker := time.NewTicker(operationPollInterval)
+	defer ticker.Stop()
+	lastProgress := time.Now()
+	for {
+		operations, progress, err := recv.ListForBackup(backupUID)
+		if err != nil {
+			return nil, err
+		}
+		if progress.InProgress == 0 {
+			return operations, nil
+		}
+		if time.Since(lastProgress) >= operationProgressInterval {
+			recv.logger.WithField("backup", backupUID).Infof("Waiting for component snapshots, %s", progress.String())
+			lastProgress = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "Stopped waiting for component snapshots, %s", progress.String())
+		case <-ticker.C:
+		}
+	}
+}
+
+// RemoveForBackup drops the operations of backupUID once the snapshot of the backup has been deleted
+func (recv *OperationTracker) RemoveForBackup(backupUID string) error {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	operations, err := recv.load()
+	if err != nil {
+		return err
+	}
+	remaining := []ComponentOperation{}
+	for _, operation := range operations {
+		if operation.BackupUID != backupUID {
+			remaining = append(remaining, operation)
+		}
+	}
+	if len(remaining) == len(operations) {
+		return nil
+	}
+	return recv.save(remaining)
+}
+
+func (recv *OperationTracker) update(updated ComponentOperation) error {
+	operations, err := recv.load()
+	if err != nil {
+		return err
+	}
+	for i := range operations {
+		if operations[i].ID == updated.ID {
+			operations[i] = updated
+			return recv.save(operations)
+		}
+	}
+	return errors.New("operation " + updated.ID + " not found")
+}
+
+// load reads the operations.  Operations that are in progress in the file but not running in this process were
+// interrupted and are returned as failed
+func (recv *OperationTracker) load() ([]ComponentOperation, error) {
+	operations := []ComponentOperation{}
+	data, err := ioutil.ReadFile(recv.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return operations, nil
+		}
+		return nil, errors.Wrapf(err, "could not read component operations from %s", recv.path)
+	}
+	if err := json.Unmarshal(data, &operations); err != nil {
+		return nil, errors.Wrapf(err, "could not parse component operations in %s", recv.path)
+	}
+	for i := range operations {
+		if operations[i].Phase == OperationInProgress && !recv.running[operations[i].ID] {
+			operations[i].Phase = OperationFailed
+			operations[i].Error = "interrupted before the component snapshot completed"
+		}
+	}
+	return operations, nil
+}
+
+func (recv *OperationTracker) save(operations []ComponentOperation) error {
+	data, err := json.MarshalIndent(operations, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not marshal component operations")
+	}
+	return writeFileAtomically(recv.path, bytes.NewReader(data))
+}
+
+// resolveSnapshotAnnotation returns the component snapshot ID of item, from its snapshot annotations or, for a
+// snapshot taken in the background, from the operation named by its operation annotation.  tracker may be nil
+func resolveSnapshotAnnotation(item runtime.Object, tracker *OperationTracker) (astrolabe.ProtectedEntityID, bool, error) {
+	snapshotPEID, found, err := getSnapshotAnnotation(item)
+	if err != nil || found {
+		return snapshotPEID, found, err
+	}
+	annotations, err := meta.NewAccessor().Annotations(item)
+	if err != nil {
+		return astrolabe.ProtectedEntityID{}, false, errors.Wrap(err, "Could not retrieve annotations")
+	}
+	operationID := annotations[ComponentOperationAnnotation]
+	if operationID == "" {
+		return astrolabe.ProtectedEntityID{}, false, nil
+	}
+	if tracker == nil {
+		return astrolabe.ProtectedEntityID{}, true, errors.New("item references component operation " + operationID +
+			" but asynchronous component snapshots are not enabled")
+	}
+	operation, found, err := tracker.Get(operationID)
+	if err != nil {
+		return astrolabe.ProtectedEntityID{}, true, err
+	}
+	if !found {
+		return astrolabe.ProtectedEntityID{}, true, errors.New("component operation " + operationID + " not found")
+	}
+	if operation.Phase != OperationCompleted || operation.Record == nil {
+		return astrolabe.ProtectedEntityID{}, true, errors.New(fmt.Sprintf("component operation %s is %s: %s", operationID,
+			operation.Phase, operation.Error))
+	}
+	snapshotPEID, err = operation.Record.GetSnapshotPEID()
+	return snapshotPEID, true, err
+}
+
+// componentOperationsError lists the component snapshots of a backup that failed
+type componentOperationsError struct {
+	failed []ComponentOperation
+}
+
+func (recv componentOperationsError) Error() string {
+	messages := make([]string, 0, len(recv.failed))
+	for _, operation := range recv.failed {
+		messages = append(messages, fmt.Sprintf("%s: %s", operation.PEID, operation.Error))
+	}
+	return fmt.Sprintf("%d component snapshots failed: %s", len(recv.failed), strings.Join(messages, "; "))
+}
+
+// heldItem is an item of the backup tarball waiting for the snapshot of its component
+type heldItem struct {
+	header      *tar.Header
+	item        *unstructured.Unstructured
+	operationID string
+}
+
+// componentOperationStamper waits for the component snapshots started in the background during a backup before the
+// backup tarball is finished, so that the snapshot is only committed once they have all completed.  The items that
+// carry an operation annotation are held back and written at the end of the tarball with the snapshot annotations of
+// their completed operations, so the stored snapshot does not depend on the OperationTracker
+type componentOperationStamper struct {
+	ctx       context.Context
+	tracker   *OperationTracker
+	backupUID string
+	held      []heldItem
+}
+
+func newComponentOperationStamper(ctx context.Context, tracker *OperationTracker, backupUID string) *componentOperationStamper {
+	return &componentOperationStamper{
+		ctx:       ctx,
+		tracker:   tracker,
+		backupUID: backupUID,
+	}
+}
+
+func (recv *componentOperationStamper) holdItem(header *tar.Header, data []byte) (bool, error) {
+	item := &unstructured.Unstructured{}
+	if err := item.UnmarshalJSON(data); err != nil {
+		// Not an item that the backup item action could have annotated
+		return false, nil
+	}
+	operationID := item.GetAnnotations()[ComponentOperationAnnotation]
+	if operationID == "" {
+		return false, nil
+	}
+	recv.held = append(recv.held, heldItem{header: header, item: item, operationID: operationID})
+	return true, nil
+}
+
+// appendTo waits for the operations of the backup and writes the held items.  Any failed operation fails the backup
+func (recv *componentOperationStamper) appendTo(tarWriter *tar.Writer) error {
+	operations, err := recv.tracker.WaitForBackup(recv.ctx, recv.backupUID)
+	if err != nil {
+		return errors.Wrap(err, "Failed waiting for component snapshots")
+	}
+	completed := map[string]ComponentOperation{}
+	failed := []ComponentOperation{}
+	for _, operation := range operations {
+		if operation.Phase == OperationCompleted && operation.Record != nil {
+			completed[operation.ID] = operation
+		} else {
+			failed = append(failed, operation)
+		}
+	}
+	if len(failed) > 0 {
+		return componentOperationsError{failed: failed}
+	}
+	for _, held := range recv.held {
+		operation, ok := completed[held.operationID]
+		if !ok {
+			return errors.New("component operation " + held.operationID + " of " + held.header.Name + " not found")
+		}
+		annotations := held.item.GetAnnotations()
+		delete(annotations, ComponentOperationAnnotation)
+		held.item.SetAnnotations(annotations)
+		if err := setSnapshotAnnotations(held.item, *operation.Record); err != nil {
+			return err
+		}
+		data, err := held.item.MarshalJSON()
+		if err != nil {
+			return errors.Wrapf(err, "Could not marshal %s", held.header.Name)
+		}
+		header := *held.header
+		header.Size = int64(len(data))
+		if err := tarWriter.WriteHeader(&header); err != nil {
+			return errors.Wrapf(err, "Could not write tar header for %s", header.Name)
+		}
+		if _, err := tarWriter.Write(data); err != nil {
+			return errors.Wrapf(err, "Could not write %s to tarball", header.Name)
+		}
+	}
+	if len(operations) > 0 {
+		recv.tracker.logger.WithField("backup", recv.backupUID).Infof("%d component snapshots finished", len(operations))
+	}
+	return nil
+}
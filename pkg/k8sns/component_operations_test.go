@@ -0,0 +1,239 @@
+package k8sns
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"io"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAsyncComponentSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "component-operations")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	livePE := &fakeComponentPE{id: astrolabe.NewProtectedEntityID("psql", "test-uid")}
+	pem := &fakePEM{pes: map[string]*fakeComponentPE{livePE.id.String(): livePE}}
+	tracker := NewOperationTracker(filepath.Join(dir, componentOperationsFileName), logrus.New())
+	options := newTestBackupItemActionOptions(pem)
+	options.OperationTracker = tracker
+	action, err := NewAstrolabeBackupItemAction(options)
+	if err != nil {
+		t.Fatalf("NewAstrolabeBackupItemAction failed with err %v", err)
+	}
+	backup := &v1.Backup{}
+	backup.UID = "backup-1"
+	returnedItem, _, err := action.Execute(newTestItem("acid.zalan.do/v1", "postgresql"), backup)
+	if err != nil {
+		t.Fatalf("Execute failed with err %v", err)
+	}
+	if _, found, _ := getSnapshotAnnotation(returnedItem); found {
+		t.Fatalf("expected only an operation annotation on the item, got %v", returnedItem.UnstructuredContent())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	operations, err := tracker.WaitForBackup(ctx, "backup-1")
+	if err != nil || len(operations) != 1 || operations[0].Phase != OperationCompleted {
+		t.Fatalf("expected one completed operation, got %v, %v", operations, err)
+	}
+	snapshotPEID, found, err := resolveSnapshotAnnotation(returnedItem, tracker)
+	if err != nil || !found {
+		t.Fatalf("resolveSnapshotAnnotation returned found = %t, err = %v", found, err)
+	}
+	if snapshotPEID.GetID() != "test-uid" || snapshotPEID.GetSnapshotID().GetID() != "snap-1" {
+		t.Fatalf("unexpected snapshot %s", snapshotPEID.String())
+	}
+	if _, _, err := resolveSnapshotAnnotation(returnedItem, nil); err == nil {
+		t.Fatalf("expected an operation annotation to fail to resolve without a tracker")
+	}
+
+	if err := tracker.RemoveForBackup("backup-1"); err != nil {
+		t.Fatalf("RemoveForBackup failed with err %v", err)
+	}
+	if _, progress, err := tracker.ListForBackup("backup-1"); err != nil || progress.Total != 0 {
+		t.Fatalf("expected no operations after RemoveForBackup, got %v, %v", progress, err)
+	}
+}
+
+func TestFailedAndInterruptedOperations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "component-operations")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, componentOperationsFileName)
+	tracker := NewOperationTracker(path, logrus.New())
+	peID := astrolabe.NewProtectedEntityID("psql", "db-uid")
+	_, err = tracker.Start("backup-1", "item-1", peID, func(ctx context.Context) (SnapshotRecord, error) {
+		return SnapshotRecord{}, errors.New("storage unavailable")
+	})
+	if err != nil {
+		t.Fatalf("Start failed with err %v", err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	_, err = tracker.Start("backup-1", "item-2", peID, func(ctx context.Context) (SnapshotRecord, error) {
+		<-release
+		return SnapshotRecord{}, errors.New("released")
+	})
+	if err != nil {
+		t.Fatalf("Start failed with err %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*operationPollInterval)
+	defer cancel()
+	if _, err := tracker.WaitForBackup(ctx, "backup-1"); err == nil {
+		t.Fatalf("expected WaitForBackup to time out while an operation is running")
+	}
+	_, progress, err := tracker.ListForBackup("backup-1")
+	if err != nil || progress.Total != 2 || progress.Failed != 1 || progress.InProgress != 1 {
+		t.Fatalf("unexpected progress %v, %v", progress, err)
+	}
+
+	// A new tracker on the same file, as after a restart, does not have the operation running
+	restarted := NewOperationTracker(path, logrus.New())
+	operations, err := restarted.WaitForBackup(context.Background(), "backup-1")
+	if err != nil || len(operations) != 2 {
+		t.Fatalf("expected two finished operations, got %v, %v", operations, err)
+	}
+	for _, operation := range operations {
+		if operation.Phase != OperationFailed || operation.Error == "" {
+			t.Fatalf("expected operation %s to have failed, got %v", operation.ID, operation)
+		}
+	}
+}
+
+func TestComponentOperationStamper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "component-operations")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tracker := NewOperationTracker(filepath.Join(dir, componentOperationsFileName), logrus.New())
+	peID := astrolabe.NewProtectedEntityID("psql", "db-uid")
+	release := make(chan struct{})
+	operationID, err := tracker.Start("backup-1", "db-uid", peID, func(ctx context.Context) (SnapshotRecord, error) {
+		<-release
+		return NewSnapshotRecord(peID.IDWithSnapshot(astrolabe.NewProtectedEntitySnapshotID("snap-1")), nil, "test-cluster"), nil
+	})
+	if err != nil {
+		t.Fatalf("Start failed with err %v", err)
+	}
+	item := newTestItem("acid.zalan.do/v1", "postgresql")
+	item.SetAnnotations(map[string]string{ComponentOperationAnnotation: operationID})
+	itemJSON, err := item.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON failed with err %v", err)
+	}
+	itemPath := "resources/postgresqls.acid.zalan.do/namespaces/test/test.json"
+	source := newTestTarball(t, map[string]string{
+		itemPath: string(itemJSON),
+		"resources/configmaps/namespaces/test/config.json": "{}",
+	})
+	close(release)
+	dest := &bytes.Buffer{}
+	stamper := newComponentOperationStamper(context.Background(), tracker, "backup-1")
+	if err := appendToTarball(source, dest, []tarballAppender{stamper}); err != nil {
+		t.Fatalf("appendToTarball failed with err %v", err)
+	}
+	gzipReader, err := gzip.NewReader(dest)
+	if err != nil {
+		t.Fatalf("gzip.NewReader failed with err %v", err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	names := []string{}
+	var stamped *unstructured.Unstructured
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Reading tarball failed with err %v", err)
+		}
+		names = append(names, header.Name)
+		if header.Name == itemPath {
+			contents, _ := ioutil.ReadAll(tarReader)
+			stamped = &unstructured.Unstructured{}
+			if err := stamped.UnmarshalJSON(contents); err != nil {
+				t.Fatalf("Could not parse stamped item, err %v", err)
+			}
+		}
+	}
+	if len(names) != 2 || names[1] != itemPath || stamped == nil {
+		t.Fatalf("Expected the held item at the end of the tarball, got %v", names)
+	}
+	snapshotPEID, found, err := getSnapshotAnnotation(stamped)
+	if err != nil || !found || snapshotPEID.GetSnapshotID().GetID() != "snap-1" {
+		t.Fatalf("Expected the snapshot annotation on the stamped item, got %v, %t, %v", snapshotPEID, found, err)
+	}
+	if _, found := stamped.GetAnnotations()[ComponentOperationAnnotation]; found {
+		t.Fatalf("Operation annotation left on the stamped item: %v", stamped.GetAnnotations())
+	}
+
+	_, err = tracker.Start("backup-2", "db-uid", peID, func(ctx context.Context) (SnapshotRecord, error) {
+		return SnapshotRecord{}, errors.New("storage unavailable")
+	})
+	if err != nil {
+		t.Fatalf("Start failed with err %v", err)
+	}
+	stamper = newComponentOperationStamper(context.Background(), tracker, "backup-2")
+	source = newTestTarball(t, map[string]string{"resources/configmaps/namespaces/test/config.json": "{}"})
+	if err := appendToTarball(source, ioutil.Discard, []tarballAppender{stamper}); err == nil {
+		t.Fatalf("Expected a failed component snapshot to fail the tarball")
+	}
+}
+
+func TestDiscardOperations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "component-operations")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tracker := NewOperationTracker(filepath.Join(dir, componentOperationsFileName), logrus.New())
+	peID := astrolabe.NewProtectedEntityID("psql", "db-uid")
+	snapshotPEID := peID.IDWithSnapshot(astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+	_, err = tracker.Start("backup-1", "item-1", peID, func(ctx context.Context) (SnapshotRecord, error) {
+		return NewSnapshotRecord(snapshotPEID, nil, "test-cluster"), nil
+	})
+	if err != nil {
+		t.Fatalf("Start failed with err %v", err)
+	}
+	_, err = tracker.Start("backup-1", "item-2", peID, func(ctx context.Context) (SnapshotRecord, error) {
+		<-ctx.Done()
+		return SnapshotRecord{}, ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("Start failed with err %v", err)
+	}
+	pe := &deletablePE{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := tracker.Discard(ctx, "backup-1", deletablePEM{pe: pe}); err != nil {
+		t.Fatalf("Discard failed with err %v", err)
+	}
+	if len(pe.deleted) != 1 || pe.deleted[0] != snapshotPEID.GetSnapshotID() {
+		t.Fatalf("Expected the completed component snapshot to be deleted, got %v", pe.deleted)
+	}
+	if _, progress, err := tracker.ListForBackup("backup-1"); err != nil || progress.Total != 0 {
+		t.Fatalf("Expected no operations after Discard, got %v, %v", progress, err)
+	}
+	_, err = tracker.Start("backup-1", "item-3", peID, func(ctx context.Context) (SnapshotRecord, error) {
+		return NewSnapshotRecord(snapshotPEID, nil, "test-cluster"), nil
+	})
+	if err == nil {
+		t.Fatalf("Expected Start to fail for a discarded backup")
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"strings"
+)
+
+const (
+	// ComponentSnapshotParamsParam is the k8sns config param holding the default snapshot params of each component PE
+	// type, e.g. {"psql": {"backupType": "logical"}}
+	ComponentSnapshotParamsParam = "componentSnapshotParams"
+	// ComponentSnapshotParamsAnnotationPrefix followed by a PE type is an annotation, on an item or on a Velero Backup,
+	// holding a JSON object of snapshot params for that PE type, e.g. astrolabe.io/snapshot-params.psql
+	ComponentSnapshotParamsAnnotationPrefix = "astrolabe.io/snapshot-params."
+	// ComponentSnapshotParamsLabelSuffix is the suffix of the label prefix that sets a single snapshot param on a Velero
+	// Backup, e.g. psql.snapshot-params.astrolabe.io/backupType=base.  Labels cannot hold JSON, so each param is a
+	// separate string label
+	ComponentSnapshotParamsLabelSuffix = ".snapshot-params.astrolabe.io"
+)
+
+// buildComponentSnapshotParams assembles the params for the snapshot of item by a PE of type peType.  Later sources
+// override earlier ones param by param: the config defaults, the labels of backup, the annotation on backup and finally
+// the annotation on item.  backup may be nil
+func buildComponentSnapshotParams(peType string, defaults map[string]map[string]interface{}, backup runtime.Object,
+	item runtime.Object) (map[string]map[string]interface{}, error) {
+	peParams := map[string]interface{}{}
+	for key, value := range defaults[peType] {
+		peParams[key] = value
+	}
+	if backup != nil {
+		accessor := meta.NewAccessor()
+		backupLabels, err := accessor.Labels(backup)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to retrieve backup labels")
+		}
+		labelPrefix := peType + ComponentSnapshotParamsLabelSuffix + "/"
+		for key, value := range backupLabels {
+			if strings.HasPrefix(key, labelPrefix) {
+				peParams[strings.TrimPrefix(key, labelPrefix)] = value
+			}
+		}
+		if err := mergeSnapshotParamsAnnotation(peParams, peType, backup); err != nil {
+			return nil, errors.Wrap(err, "invalid snapshot params on backup")
+		}
+	}
+	if err := mergeSnapshotParamsAnnotation(peParams, peType, item); err != nil {
+		return nil, err
+	}
+	return map[string]map[string]interface{}{
+		peType: peParams,
+	}, nil
+}
+
+// mergeSnapshotParamsAnnotation adds the params in the snapshot params annotation for peType on obj to peParams
+func mergeSnapshotParamsAnnotation(peParams map[string]interface{}, peType string, obj runtime.Object) error {
+	annotations, err := meta.NewAccessor().Annotations(obj)
+	if err != nil {
+		return errors.Wrap(err, "Could not retrieve annotations")
+	}
+	key := ComponentSnapshotParamsAnnotationPrefix + peType
+	value, ok := annotations[key]
+	if !ok {
+		return nil
+	}
+	annotationParams := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(value), &annotationParams); err != nil {
+		return errors.Wrapf(err, "%s annotation must be a JSON object", key)
+	}
+	for paramKey, paramValue := range annotationParams {
+		peParams[paramKey] = paramValue
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package k8sns
+
+import (
+	v1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"testing"
+)
+
+func TestBuildComponentSnapshotParams(t *testing.T) {
+	defaults := map[string]map[string]interface{}{
+		"psql": {"backupType": "logical", "compress": true, "retention": "7d"},
+	}
+	backup := &v1.Backup{}
+	backup.Labels = map[string]string{
+		"psql" + ComponentSnapshotParamsLabelSuffix + "/backupType": "base",
+		"psql" + ComponentSnapshotParamsLabelSuffix + "/retention":  "30d",
+		"pvc" + ComponentSnapshotParamsLabelSuffix + "/retention":   "1d",
+	}
+	backup.Annotations = map[string]string{
+		ComponentSnapshotParamsAnnotationPrefix + "psql": `{"retention": "90d"}`,
+	}
+	item := newTestItem("acid.zalan.do/v1", "postgresql")
+	item.SetAnnotations(map[string]string{
+		ComponentSnapshotParamsAnnotationPrefix + "psql": `{"compress": false}`,
+	})
+
+	params, err := buildComponentSnapshotParams("psql", defaults, backup, item)
+	if err != nil {
+		t.Fatalf("buildComponentSnapshotParams failed with err %v", err)
+	}
+	expected := map[string]interface{}{"backupType": "base", "compress": false, "retention": "90d"}
+	if len(params) != 1 || len(params["psql"]) != len(expected) {
+		t.Fatalf("expected params %v, got %v", expected, params)
+	}
+	for key, value := range expected {
+		if params["psql"][key] != value {
+			t.Fatalf("expected %s = %v, got %v", key, value, params["psql"][key])
+		}
+	}
+
+	params, err = buildComponentSnapshotParams("psql", nil, nil, newTestItem("acid.zalan.do/v1", "postgresql"))
+	if err != nil || len(params["psql"]) != 0 {
+		t.Fatalf("expected empty params without any source, got %v, %v", params, err)
+	}
+}
+
+func TestInvalidComponentSnapshotParams(t *testing.T) {
+	item := newTestItem("acid.zalan.do/v1", "postgresql")
+	item.SetAnnotations(map[string]string{
+		ComponentSnapshotParamsAnnotationPrefix + "psql": `backupType=base`,
+	})
+	if _, err := buildComponentSnapshotParams("psql", nil, nil, item); err == nil {
+		t.Fatalf("expected an annotation that is not a JSON object to be rejected")
+	}
+}
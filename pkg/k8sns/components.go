@@ -0,0 +1,156 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sort"
+	"strings"
+)
+
+// ComponentDeleteError lists the component snapshots that could not be deleted, keyed by component snapshot ID
+type ComponentDeleteError struct {
+	Failed map[string]error
+}
+
+func (recv ComponentDeleteError) Error() string {
+	ids := make([]string, 0, len(recv.Failed))
+	for id := range recv.Failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	messages := make([]string, 0, len(ids))
+	for _, id := range ids {
+		messages = append(messages, fmt.Sprintf("%s: %v", id, recv.Failed[id]))
+	}
+	return fmt.Sprintf("failed to delete %d component snapshots: %s", len(ids), strings.Join(messages, "; "))
+}
+
+// deleteComponentSnapshots deletes each of the component snapshots through the ProtectedEntityManager and drops them
+// from the snapshot index.  All of the snapshots are attempted; failures are collected into a ComponentDeleteError
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) deleteComponentSnapshots(ctx context.Context,
+	componentIDs []astrolabe.ProtectedEntityID, params map[string]map[string]interface{}) error {
+	if len(componentIDs) == 0 {
+		return nil
+	}
+	if recv.pem == nil {
+		return errors.New("no ProtectedEntityManager set, cannot delete component snapshots")
+	}
+	failed := map[string]error{}
+	for _, componentID := range componentIDs {
+		if !componentID.HasSnapshot() {
+			failed[componentID.String()] = errors.New("component ID does not reference a snapshot")
+			continue
+		}
+		componentPE, err := recv.pem.GetProtectedEntity(ctx, componentID)
+		if isNotFound(err) {
+			recv.logger.Warnf("Component snapshot %s not found, it may already have been removed", componentID.String())
+			recv.removeFromSnapshotIndex(componentID)
+			continue
+		}
+		if err != nil {
+			failed[componentID.String()] = errors.Wrap(err, "could not retrieve component pe")
+			continue
+		}
+		deleted, err := componentPE.DeleteSnapshot(ctx, componentID.GetSnapshotID(), params)
+		if isNotFound(err) {
+			deleted, err = false, nil
+		}
+		if err != nil {
+			failed[componentID.String()] = err
+			continue
+		}
+		if !deleted {
+			recv.logger.Warnf("Component snapshot %s was not deleted, it may already have been removed", componentID.String())
+		}
+		recv.removeFromSnapshotIndex(componentID)
+	}
+	if len(failed) > 0 {
+		return ComponentDeleteError{Failed: failed}
+	}
+	return nil
+}
+
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) removeFromSnapshotIndex(componentID astrolabe.ProtectedEntityID) {
+	if recv.snapshotIndex == nil {
+		return
+	}
+	if err := recv.snapshotIndex.RemoveSnapshot(componentID.String()); err != nil {
+		recv.logger.WithError(err).Warnf("Could not remove component snapshot %s from the snapshot index", componentID.String())
+	}
+}
+
+// getLiveComponentIDs lists the resources in the namespace that have a component PE type and returns the IDs of
+// their PEs.  As in findMapping, an object is claimed by the first mapping that matches it, so an object matched by
+// several mappings is only returned once.  Resource types that are not served by the cluster, for example because the
+// operator's CRD has not been installed, are skipped
+func (recv *KubernetesNamespaceProtectedEntity) getLiveComponentIDs(ctx context.Context) ([]astrolabe.ProtectedEntityID, error) {
+	returnComponents := []astrolabe.ProtectedEntityID{}
+	mappings, err := recv.petm.GetComponentMappings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(mappings) == 0 {
+		return returnComponents, nil
+	}
+	clients := recv.petm.clients
+	claimed := map[types.UID]bool{}
+	for _, mapping := range mappings {
+		resource := mapping.GroupResource().String()
+		gvr, apiResource, err := clients.discoveryHelper.ResourceFor(mapping.GroupResource().WithVersion(mapping.Version))
+		if err != nil {
+			recv.logger.WithError(err).Debugf("Resource %s is not served by the cluster, skipping", resource)
+			continue
+		}
+		resourceClient, err := clients.dynamicFactory.ClientForGroupVersionResource(gvr.GroupVersion(), apiResource, recv.name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not create client for %s", gvr.String())
+		}
+		items, err := resourceClient.List(metav1.ListOptions{LabelSelector: mapping.LabelSelector})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not list %s in namespace %s", resource, recv.name)
+		}
+		for i := range items.Items {
+			uid := items.Items[i].GetUID()
+			if claimed[uid] {
+				continue
+			}
+			matches, err := mapping.matches(gvr, &items.Items[i])
+			if err != nil {
+				return nil, errors.Wrapf(err, "Could not match %s %s", resource, items.Items[i].GetName())
+			}
+			if !matches {
+				continue
+			}
+			claimed[uid] = true
+			componentID, err := mapping.getPEID(&items.Items[i])
+			if err != nil {
+				return nil, errors.Wrapf(err, "Could not get component ID for %s %s", resource, items.Items[i].GetName())
+			}
+			returnComponents = append(returnComponents, componentID)
+		}
+	}
+	sort.Slice(returnComponents, func(i, j int) bool {
+		return returnComponents[i].String() < returnComponents[j].String()
+	})
+	return returnComponents, nil
+}
@@ -0,0 +1,49 @@
+package k8sns
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/client"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"testing"
+)
+
+func TestGetLiveComponentIDsFirstMatch(t *testing.T) {
+	newPostgresql := func(name string, uid string, labels map[string]string) *unstructured.Unstructured {
+		item := newTestItem("acid.zalan.do/v1", "postgresql")
+		item.SetNamespace("test")
+		item.SetName(name)
+		item.SetUID(types.UID(uid))
+		item.SetLabels(labels)
+		return item
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newPostgresql("gold", "gold-uid", map[string]string{"tier": "gold"}),
+		newPostgresql("plain", "plain-uid", nil))
+	mappings := []ComponentMapping{
+		{Group: "acid.zalan.do", Resource: "postgresqls", PEType: "psqlgold", IDSource: IDFromUID, LabelSelector: "tier=gold"},
+		{Group: "acid.zalan.do", Resource: "postgresqls", PEType: "psql", IDSource: IDFromUID},
+		{Group: "acid.zalan.do", Resource: "postgresqls", PEType: "psqlname", IDSource: IDFromName},
+	}
+	if err := validateComponentMappings(mappings); err != nil {
+		t.Fatalf("validateComponentMappings failed with err %v", err)
+	}
+	petm := &KubernetesNamespaceProtectedEntityTypeManager{
+		clients: &veleroClients{
+			dynamicFactory:  client.NewDynamicFactory(dynamicClient),
+			discoveryHelper: newTestDiscoveryHelper(),
+		},
+		componentMappings: &lazyComponentMappings{mappings: mappings},
+	}
+	pe := &KubernetesNamespaceProtectedEntity{petm: petm, name: "test", logger: logrus.New()}
+	componentIDs, err := pe.getLiveComponentIDs(context.Background())
+	if err != nil {
+		t.Fatalf("getLiveComponentIDs failed with err %v", err)
+	}
+	if len(componentIDs) != 2 || componentIDs[0].String() != "psql:plain-uid" || componentIDs[1].String() != "psqlgold:gold-uid" {
+		t.Fatalf("Expected each postgresql to be claimed by its first matching mapping, got %v", componentIDs)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/util/collections"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"strconv"
+	"strings"
+)
+
+// Defaults for the Kubernetes client, the same as the Velero server's
+const (
+	DefaultClientQPS   = 20.0
+	DefaultClientBurst = 30
+)
+
+// Config is the k8sns config, decoded from the params of the k8sns PE type config file
+type Config struct {
+	// Kubeconfig is the path of the kubeconfig file.  When it is empty the kubeconfig is loaded from $KUBECONFIG or
+	// ~/.kube/config as kubectl does, falling back to the in-cluster config
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// KubeconfigPath is a deprecated alias for Kubeconfig
+	KubeconfigPath string `json:"kubeconfigPath,omitempty"`
+	// Context is the kubeconfig context to use instead of the current context
+	Context   string `json:"context,omitempty"`
+	MasterURL string `json:"masterURL,omitempty"`
+	// QPS and Burst limit the requests of the Kubernetes clients
+	QPS   float32 `json:"qps,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+
+	// SnapshotsDir is the directory the namespace snapshots and their files are kept in, along with the snapshot index
+	// and the delete retry queue.  It must be on persistent storage, in the Velero pod as well as in the server
+	SnapshotsDir string `json:"snapshotsDir"`
+
+	// PodVolumeRestoreHelperImage is the image of the init container pod volumes are restored through, it must provide
+	// sh, sleep and tar.  DefaultPodVolumeRestoreHelperImage is used if it is not set
+	PodVolumeRestoreHelperImage string `json:"podVolumeRestoreHelperImage,omitempty"`
+
+	// IncludedNamespaces and ExcludedNamespaces filter the namespaces returned by GetProtectedEntities.  Both accept
+	// globs, an empty IncludedNamespaces includes all namespaces
+	IncludedNamespaces []string `json:"includedNamespaces,omitempty"`
+	ExcludedNamespaces []string `json:"excludedNamespaces,omitempty"`
+
+	// ComponentTypes and the mappings in ComponentTypesConfigMap are merged with the defaults by LoadComponentMappings.
+	// The ConfigMap is read when the mappings are first used, changes to it need a restart
+	ComponentTypes          []ComponentMapping `json:"componentTypes,omitempty"`
+	ComponentTypesConfigMap string             `json:"componentTypesConfigMap,omitempty"`
+	// SnapshotPVCs snapshots the PVCs of the namespace with CSI VolumeSnapshots, see PVCComponentMapping.  The
+	// VolumeSnapshot CRDs must be installed
+	SnapshotPVCs boolParam `json:"snapshotPVCs,omitempty"`
+	// ComponentSnapshotParams holds the default snapshot params of each component PE type
+	ComponentSnapshotParams map[string]map[string]interface{} `json:"componentSnapshotParams,omitempty"`
+	AsyncComponentSnapshots boolParam                         `json:"asyncComponentSnapshots,omitempty"`
+	// UnmappedItemPolicy is the policy of the backup item action for items with no PE type, SkipUnmappedItems if it
+	// is not set
+	UnmappedItemPolicy UnmappedItemPolicy `json:"unmappedItemPolicy,omitempty"`
+}
+
+// boolParam is a bool param that may also be given as a string, e.g. "true", as ConfigMap values are
+type boolParam bool
+
+func (recv *boolParam) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch typedValue := value.(type) {
+	case nil:
+		*recv = false
+	case bool:
+		*recv = boolParam(typedValue)
+	case string:
+		parsed, err := strconv.ParseBool(typedValue)
+		if err != nil {
+			return errors.Wrapf(err, "invalid bool %q", typedValue)
+		}
+		*recv = boolParam(parsed)
+	default:
+		return errors.New(fmt.Sprintf("expected a bool, got %s", string(data)))
+	}
+	return nil
+}
+
+// ParseConfig decodes the k8sns params into a Config, fills in the defaults and validates it.  Unknown params are
+// rejected, so that misspelled keys are not silently ignored
+func ParseConfig(params map[string]interface{}, logger logrus.FieldLogger) (Config, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return Config{}, errors.Wrap(err, "invalid k8sns config")
+	}
+	config := Config{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return Config{}, errors.Wrap(err, "invalid k8sns config")
+	}
+	if config.KubeconfigPath != "" {
+		if config.Kubeconfig != "" && config.Kubeconfig != config.KubeconfigPath {
+			return Config{}, errors.New(fmt.Sprintf("invalid k8sns config: kubeconfig %q and its deprecated alias kubeconfigPath %q differ",
+				config.Kubeconfig, config.KubeconfigPath))
+		}
+		logger.Warn("The k8sns kubeconfigPath param is deprecated, use kubeconfig")
+		config.Kubeconfig = config.KubeconfigPath
+		config.KubeconfigPath = ""
+	}
+	if config.QPS == 0 {
+		config.QPS = DefaultClientQPS
+	}
+	if config.Burst == 0 {
+		config.Burst = DefaultClientBurst
+	}
+	if config.PodVolumeRestoreHelperImage == "" {
+		config.PodVolumeRestoreHelperImage = DefaultPodVolumeRestoreHelperImage
+	}
+	if config.UnmappedItemPolicy == "" {
+		config.UnmappedItemPolicy = SkipUnmappedItems
+	}
+	if config.ComponentSnapshotParams == nil {
+		config.ComponentSnapshotParams = map[string]map[string]interface{}{}
+	}
+	if err := config.validate(); err != nil {
+		return Config{}, errors.Wrap(err, "invalid k8sns config")
+	}
+	return config, nil
+}
+
+// validate checks the config.  The defaults of the ComponentTypes are filled in as they are validated
+func (recv *Config) validate() error {
+	problems := []string{}
+	if recv.SnapshotsDir == "" {
+		problems = append(problems, SnapshotsDirKey+" must be set")
+	}
+	if recv.QPS < 0 {
+		problems = append(problems, fmt.Sprintf("qps must be positive, got %v", recv.QPS))
+	}
+	if recv.Burst < 0 {
+		problems = append(problems, fmt.Sprintf("burst must be positive, got %d", recv.Burst))
+	}
+	if err := validateComponentMappings(recv.ComponentTypes); err != nil {
+		problems = append(problems, ComponentTypesParam+": "+err.Error())
+	}
+	if recv.ComponentTypesConfigMap != "" {
+		if _, _, err := splitConfigMapName(recv.ComponentTypesConfigMap); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if _, err := parseUnmappedItemPolicy(recv.UnmappedItemPolicy); err != nil {
+		problems = append(problems, UnmappedItemPolicyParam+": "+err.Error())
+	}
+	for _, err := range collections.ValidateIncludesExcludes(recv.IncludedNamespaces, recv.ExcludedNamespaces) {
+		problems = append(problems, "namespace filters: "+err.Error())
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// restConfig builds the config of the Kubernetes clients.  The kubeconfig is loaded with the default rules of kubectl,
+// Kubeconfig, Context and MasterURL override them when set
+func (recv Config) restConfig() (*rest.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if recv.Kubeconfig != "" {
+		loadingRules.ExplicitPath = recv.Kubeconfig
+	}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules,
+		&clientcmd.ConfigOverrides{
+			CurrentContext: recv.Context,
+			ClusterInfo:    clientcmdapi.Cluster{Server: recv.MasterURL},
+		}).ClientConfig()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load Kubernetes config (kubeconfig %q, context %q)", recv.Kubeconfig, recv.Context)
+	}
+	config.QPS = recv.QPS
+	config.Burst = recv.Burst
+	return config, nil
+}
+
+// namespaceFilter returns the filter applied to the namespaces by GetProtectedEntities
+func (recv Config) namespaceFilter() *collections.IncludesExcludes {
+	return collections.NewIncludesExcludes().Includes(recv.IncludedNamespaces...).Excludes(recv.ExcludedNamespaces...)
+}
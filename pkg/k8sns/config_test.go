@@ -0,0 +1,85 @@
+package k8sns
+
+import (
+	"github.com/sirupsen/logrus"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig(map[string]interface{}{
+		"kubeconfigPath":     "/tmp/kubeconfig",
+		SnapshotsDirKey:      "/tmp/snapshots",
+		"excludedNamespaces": []interface{}{"kube-*"},
+		ComponentTypesParam: []interface{}{
+			map[string]interface{}{"group": "example.com", "resource": "databases", "peType": "exampledb"},
+		},
+		ComponentSnapshotParamsParam: map[string]interface{}{
+			"psql": map[string]interface{}{"backupType": "logical"},
+		},
+		AsyncComponentSnapshotsParam: "true",
+		UnmappedItemPolicyParam:      "fail",
+	}, logrus.New())
+	if err != nil {
+		t.Fatalf("ParseConfig failed with err %v", err)
+	}
+	if config.Kubeconfig != "/tmp/kubeconfig" {
+		t.Fatalf("Expected kubeconfigPath to set kubeconfig, got %q", config.Kubeconfig)
+	}
+	if config.QPS != DefaultClientQPS || config.Burst != DefaultClientBurst {
+		t.Fatalf("Expected default qps and burst, got %v and %d", config.QPS, config.Burst)
+	}
+	if config.PodVolumeRestoreHelperImage != DefaultPodVolumeRestoreHelperImage {
+		t.Fatalf("Expected the default restore helper image, got %q", config.PodVolumeRestoreHelperImage)
+	}
+	if len(config.ComponentTypes) != 1 || config.ComponentTypes[0].IDSource != IDFromUID {
+		t.Fatalf("Expected componentTypes to be decoded with their defaults, got %v", config.ComponentTypes)
+	}
+	if config.ComponentSnapshotParams["psql"]["backupType"] != "logical" || !config.AsyncComponentSnapshots {
+		t.Fatalf("Unexpected component settings %v, %v", config.ComponentSnapshotParams, config.AsyncComponentSnapshots)
+	}
+	if config.UnmappedItemPolicy != FailUnmappedItems {
+		t.Fatalf("Expected the fail unmapped item policy, got %q", config.UnmappedItemPolicy)
+	}
+	filter := config.namespaceFilter()
+	if !filter.ShouldInclude("default") || filter.ShouldInclude("kube-system") {
+		t.Fatalf("Namespace filter did not exclude kube-* only")
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]interface{}
+		expected string
+	}{
+		{"missing snapshotsDir", map[string]interface{}{}, "snapshotsDir must be set"},
+		{"unknown key", map[string]interface{}{SnapshotsDirKey: "/tmp", "kubeconfgi": "/tmp/kubeconfig"}, "unknown field \"kubeconfgi\""},
+		{"wrong type", map[string]interface{}{SnapshotsDirKey: "/tmp", "masterURL": 6443}, "masterURL"},
+		{"negative qps", map[string]interface{}{SnapshotsDirKey: "/tmp", "qps": -1}, "qps must be positive"},
+		{"conflicting kubeconfig", map[string]interface{}{SnapshotsDirKey: "/tmp", "kubeconfig": "/a", "kubeconfigPath": "/b"}, "differ"},
+		{"namespace filters", map[string]interface{}{SnapshotsDirKey: "/tmp", "includedNamespaces": []interface{}{"a"},
+			"excludedNamespaces": []interface{}{"a"}}, "namespace filters"},
+		{"invalid componentTypes", map[string]interface{}{SnapshotsDirKey: "/tmp",
+			ComponentTypesParam: []interface{}{map[string]interface{}{"resource": "databases"}}}, "peType must be set"},
+		{"unknown componentTypes field", map[string]interface{}{SnapshotsDirKey: "/tmp",
+			ComponentTypesParam: []interface{}{map[string]interface{}{"resource": "databases", "peTypes": "db"}}}, "peTypes"},
+		{"componentTypesConfigMap without namespace", map[string]interface{}{SnapshotsDirKey: "/tmp",
+			ComponentTypesConfigMapParam: "components"}, "namespace/name"},
+		{"componentSnapshotParams not an object", map[string]interface{}{SnapshotsDirKey: "/tmp",
+			ComponentSnapshotParamsParam: "base"}, "componentSnapshotParams"},
+		{"asyncComponentSnapshots not a bool", map[string]interface{}{SnapshotsDirKey: "/tmp",
+			AsyncComponentSnapshotsParam: "sometimes"}, "invalid bool"},
+		{"unknown unmappedItemPolicy", map[string]interface{}{SnapshotsDirKey: "/tmp",
+			UnmappedItemPolicyParam: "ignore"}, "unknown unmapped item policy"},
+	}
+	for _, test := range tests {
+		_, err := ParseConfig(test.params, logrus.New())
+		if err == nil {
+			t.Fatalf("%s: expected ParseConfig to fail", test.name)
+		}
+		if !strings.Contains(err.Error(), test.expected) {
+			t.Fatalf("%s: expected error containing %q, got %v", test.name, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"io/ioutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const pendingDeletesFileName = "pending-deletes.json"
+
+// Defaults for how often a failed component snapshot delete is retried
+const (
+	// DefaultDeleteMaxAttempts is the number of attempts after which a delete is given up
+	DefaultDeleteMaxAttempts = 10
+	// DefaultDeleteRetryBackoff is the wait before the first retry, which doubles with every further attempt
+	DefaultDeleteRetryBackoff = time.Minute
+	// maxDeleteRetryBackoff caps the wait between retries
+	maxDeleteRetryBackoff = 6 * time.Hour
+)
+
+// PendingDelete is a component snapshot that could not be deleted and will be retried
+type PendingDelete struct {
+	SnapshotID   string    `json:"snapshotID"`
+	Backup       string    `json:"backup,omitempty"`
+	Attempts     int       `json:"attempts"`
+	LastError    string    `json:"lastError"`
+	FirstFailure time.Time `json:"firstFailure"`
+	LastAttempt  time.Time `json:"lastAttempt"`
+}
+
+// nextAttempt returns when the delete is due to be retried.  The wait doubles with each failed attempt
+func (recv PendingDelete) nextAttempt(backoff time.Duration) time.Time {
+	wait := backoff
+	for i := 1; i < recv.Attempts && wait < maxDeleteRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxDeleteRetryBackoff {
+		wait = maxDeleteRetryBackoff
+	}
+	return recv.LastAttempt.Add(wait)
+}
+
+// DeleteRetryQueue keeps the component snapshots that could not be deleted in a JSON file, so that deletes are retried
+// after a restart as well.  Deletes are retried with an exponential backoff and given up after maxAttempts.  Once a
+// delete succeeds or is given up the snapshot is dropped from snapshotIndex, if it is set
+type DeleteRetryQueue struct {
+	path          string
+	snapshotIndex *SnapshotIndex
+	maxAttempts   int
+	backoff       time.Duration
+	mutex         sync.Mutex
+	logger        logrus.FieldLogger
+}
+
+func NewDeleteRetryQueue(path string, snapshotIndex *SnapshotIndex, maxAttempts int, backoff time.Duration,
+	logger logrus.FieldLogger) *DeleteRetryQueue {
+	return &DeleteRetryQueue{
+		path:          path,
+		snapshotIndex: snapshotIndex,
+		maxAttempts:   maxAttempts,
+		backoff:       backoff,
+		logger:        logger,
+	}
+}
+
+// Add records a failed delete of snapshotPEID.  If the snapshot is already queued its attempt count is increased
+func (recv *DeleteRetryQueue) Add(snapshotPEID astrolabe.ProtectedEntityID, backup string, deleteErr error) error {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	pending, err := recv.load()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for i := range pending {
+		if pending[i].SnapshotID == snapshotPEID.String() {
+			pending[i].Attempts++
+			pending[i].LastError = deleteErr.Error()
+			pending[i].LastAttempt = now
+			return recv.save(pending)
+		}
+	}
+	pending = append(pending, PendingDelete{
+		SnapshotID:   snapshotPEID.String(),
+		Backup:       backup,
+		Attempts:     1,
+		LastError:    deleteErr.Error(),
+		FirstFailure: now,
+		LastAttempt:  now,
+	})
+	return recv.save(pending)
+}
+
+// Pending returns the queued deletes
+func (recv *DeleteRetryQueue) Pending() ([]PendingDelete, error) {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	return recv.load()
+}
+
+// Retry attempts each of the queued deletes that are due again.  Deletes that succeed are removed from the queue, as
+// are deletes that fail for the maxAttempts time, which are logged so the snapshot can be removed by hand
+func (recv *DeleteRetryQueue) Retry(ctx context.Context, pem astrolabe.ProtectedEntityManager) error {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	pending, err := recv.load()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	remaining := []PendingDelete{}
+	for _, pendingDelete := range pending {
+		if ctx.Err() != nil || time.Now().Before(pendingDelete.nextAttempt(recv.backoff)) {
+			remaining = append(remaining, pendingDelete)
+			continue
+		}
+		err := deleteComponentSnapshot(ctx, pem, pendingDelete.SnapshotID)
+		if err != nil {
+			pendingDelete.Attempts++
+			pendingDelete.LastError = err.Error()
+			pendingDelete.LastAttempt = time.Now().UTC()
+			if pendingDelete.Attempts >= recv.maxAttempts {
+				recv.logger.WithError(err).Errorf("Giving up deleting component snapshot %s of backup %s after %d attempts",
+					pendingDelete.SnapshotID, pendingDelete.Backup, pendingDelete.Attempts)
+				recv.removeFromIndex(pendingDelete.SnapshotID)
+				continue
+			}
+			recv.logger.WithError(err).Warnf("Retry %d of delete of component snapshot %s failed", pendingDelete.Attempts,
+				pendingDelete.SnapshotID)
+			remaining = append(remaining, pendingDelete)
+			continue
+		}
+		recv.logger.Infof("Deleted component snapshot %s after %d failed attempts", pendingDelete.SnapshotID, pendingDelete.Attempts)
+		recv.removeFromIndex(pendingDelete.SnapshotID)
+	}
+	return recv.save(remaining)
+}
+
+// removeFromIndex drops a snapshot that is no longer retried from the snapshot index
+func (recv *DeleteRetryQueue) removeFromIndex(snapshotID string) {
+	if recv.snapshotIndex == nil {
+		return
+	}
+	if err := recv.snapshotIndex.RemoveSnapshot(snapshotID); err != nil {
+		recv.logger.WithError(err).Warnf("Could not remove component snapshot %s from the snapshot index", snapshotID)
+	}
+}
+
+// RunPeriodically retries the queued deletes once straight away and then every interval until ctx is done
+func (recv *DeleteRetryQueue) RunPeriodically(ctx context.Context, pem astrolabe.ProtectedEntityManager, interval time.Duration) {
+	if err := recv.Retry(ctx, pem); err != nil {
+		recv.logger.WithError(err).Error("Could not retry pending component snapshot deletes")
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := recv.Retry(ctx, pem); err != nil {
+				recv.logger.WithError(err).Error("Could not retry pending component snapshot deletes")
+			}
+		}
+	}
+}
+
+func (recv *DeleteRetryQueue) load() ([]PendingDelete, error) {
+	pending := []PendingDelete{}
+	data, err := ioutil.ReadFile(recv.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pending, nil
+		}
+		return nil, errors.Wrapf(err, "could not read pending deletes from %s", recv.path)
+	}
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil, errors.Wrapf(err, "could not parse pending deletes in %s", recv.path)
+	}
+	return pending, nil
+}
+
+func (recv *DeleteRetryQueue) save(pending []PendingDelete) error {
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not marshal pending deletes")
+	}
+	return writeFileAtomically(recv.path, bytes.NewReader(data))
+}
+
+// deleteComponentSnapshot deletes the component snapshot with the ID snapshotIDStr.  A snapshot that is not found or
+// that the PE reports as not deleted is treated as already removed
+func deleteComponentSnapshot(ctx context.Context, pem astrolabe.ProtectedEntityManager, snapshotIDStr string) error {
+	snapshotPEID, err := astrolabe.NewProtectedEntityIDFromString(snapshotIDStr)
+	if err != nil {
+		return errors.Wrapf(err, "invalid component snapshot ID %q", snapshotIDStr)
+	}
+	if !snapshotPEID.HasSnapshot() {
+		return errors.New("component ID " + snapshotIDStr + " does not reference a snapshot")
+	}
+	pe, err := pem.GetProtectedEntity(ctx, snapshotPEID)
+	if err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "could not retrieve component snapshot %s", snapshotIDStr)
+	}
+	_, err = pe.DeleteSnapshot(ctx, snapshotPEID.GetSnapshotID(), map[string]map[string]interface{}{})
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// isNotFound returns true if err says that a PE or snapshot does not exist.  Astrolabe has no not found error of its
+// own, PEs backed by Kubernetes objects return NotFound API errors and PEs backed by the local snapshot repository
+// return the os not exist errors of their files
+func isNotFound(err error) bool {
+	cause := errors.Cause(err)
+	return apierrors.IsNotFound(cause) || os.IsNotExist(cause)
+}
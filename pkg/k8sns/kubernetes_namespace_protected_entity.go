@@ -27,13 +27,12 @@ import (
 	"github.com/vmware-tanzu/velero/pkg/archive"
 	"github.com/vmware-tanzu/velero/pkg/backup"
 	"github.com/vmware-tanzu/velero/pkg/builder"
-	"github.com/vmware-tanzu/velero/pkg/client"
-	"github.com/vmware-tanzu/velero/pkg/discovery"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
-	"github.com/vmware-tanzu/velero/pkg/podexec"
 	"github.com/vmware-tanzu/velero/pkg/util/filesystem"
 	"io"
-	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"strings"
 )
 
 type KubernetesNamespaceProtectedEntity struct {
@@ -42,6 +41,13 @@ type KubernetesNamespaceProtectedEntity struct {
 	name      string
 	logger    logrus.FieldLogger
 	actions   []velero.BackupItemAction
+	snapshotParams snapshotParams
+	backupResult   *BackupResult
+	backupLog      io.Writer
+	// backupUID is the UID of the Velero Backup taken by GetDataReader, which keys the component operations
+	backupUID      types.UID
+	// podVolumes collects the pod volume archives added to the end of the tarball taken by GetDataReader
+	podVolumes     *podVolumeArchives
 }
 
 func NewKubernetesNamespaceProtectedEntity(petm *KubernetesNamespaceProtectedEntityTypeManager, nsPEID astrolabe.ProtectedEntityID,
@@ -57,78 +63,42 @@ func NewKubernetesNamespaceProtectedEntity(petm *KubernetesNamespaceProtectedEnt
 }
 
 
-func (recv *KubernetesNamespaceProtectedEntity) GetDataReader(context.Context) (io.ReadCloser, error) {
+// GetDataReader returns the Velero backup tarball of the namespace.  For a live namespace the backup is streamed as
+// it is taken; a failed or cancelled backup is reported as an error from Read
+func (recv *KubernetesNamespaceProtectedEntity) GetDataReader(ctx context.Context) (io.ReadCloser, error) {
 	if !recv.id.HasSnapshot() {
-		vc := client.VeleroConfig{}
-		f := client.NewFactory("astrolabe", vc)
-
-		veleroClient, err := f.Client()
-		if err != nil {
-			return nil, err
-		}
-		discoveryClient := veleroClient.Discovery()
-
-		dynamicClient, err := f.DynamicClient()
-		if err != nil {
-			return nil, err
-		}
-
-		discoveryHelper, err := discovery.NewHelper(discoveryClient, recv.logger)
-		if err != nil {
-			return nil, err
-		}
-		dynamicFactory := client.NewDynamicFactory(dynamicClient)
-
-		kubeClient, err := f.KubeClient()
-		if err != nil {
-			return nil, err
-		}
-
-		kubeClientConfig, err := f.ClientConfig()
-		if err != nil {
-			return nil, err
-		}
-		podCommandExecutor := podexec.NewPodCommandExecutor(kubeClientConfig, kubeClient.CoreV1().RESTClient())
-		defaultVolumesToRestic := false
-		k8sBackupper, err := backup.NewKubernetesBackupper(veleroClient.VeleroV1(),
-			discoveryHelper,
-			dynamicFactory,
-			podCommandExecutor,
-			nil,
-			0,
-			defaultVolumesToRestic)
-		if err != nil {
-			return nil, err
+		clients := recv.petm.clients
+		clients.refreshDiscovery()
+		backupUID := recv.backupUID
+		if backupUID == "" {
+			snapshotUUID, err := uuid.NewRandom()
+			if err != nil {
+				return nil, err
+			}
+			backupUID = types.UID(snapshotUUID.String())
 		}
 
-		snapshotUUID, err := uuid.NewRandom()
+		backupper, err := clients.newBackupper(ctx)
 		if err != nil {
 			return nil, err
 		}
-
 		reader, writer := io.Pipe()
-		backupParams := 	builder.ForBackup(velerov1.DefaultNamespace, "astrolabe-" + snapshotUUID.String()).
-			IncludedNamespaces(recv.name).DefaultVolumesToRestic(false).Result()
+		backupBuilder := builder.ForBackup(velerov1.DefaultNamespace, "astrolabe-"+string(backupUID)).
+			IncludedNamespaces(recv.name).DefaultVolumesToRestic(false)
+		backupParams := recv.snapshotParams.applyTo(backupBuilder).Result()
+		backupParams.UID = backupUID
 
 		request := backup.Request{
 			Backup:                    backupParams,
 		}
 
-		go recv.runBackup(k8sBackupper, request, writer)
+		go recv.runBackup(ctx, backupper, request, writer)
 
 		return reader, nil
 	}
 	return recv.petm.internalRepo.GetDataReaderForSnapshot(recv.id)
 }
 
-func (recv * KubernetesNamespaceProtectedEntity)runBackup(k8sBackupper backup.Backupper, request backup.Request, writer io.WriteCloser) {
-	defer writer.Close()
-	k8sBackupper.Backup(recv.logger, &request, writer, recv.actions, nil)
-}
-
-func (recv *KubernetesNamespaceProtectedEntity) GetMetadataReader(context.Context) (io.ReadCloser, error) {
-	return nil, nil
-}
 
 
 
@@ -162,20 +132,60 @@ func (recv *KubernetesNamespaceProtectedEntity) GetInfo(ctx context.Context) (as
 	}
 
 	components, err := recv.getComponentIDs(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get component IDs")
+	}
+	// Snapshots report their stored size, live namespaces the cached estimate of the size of their items.  A live
+	// namespace that cannot be listed reports -1
+	var size int64 = -1
+	var stats *SnapshotStats
+	if recv.id.HasSnapshot() {
+		stats, err = recv.getStoredStats(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not get snapshot stats")
+		}
+		if stats != nil {
+			size = stats.CompressedBytes
+		}
+	} else {
+		size, err = recv.getLiveSize(ctx)
+		if err != nil {
+			recv.logger.WithError(err).Warnf("Could not estimate the size of namespace %s", recv.name)
+		}
+	}
 	retVal := astrolabe.NewProtectedEntityInfo(
 		recv.id,
 		recv.name,
-		-1,
+		size,
 		data,
 		md,
 		combined,
 		components)
-	return retVal, nil
+	return NamespaceProtectedEntityInfo{
+		ProtectedEntityInfo: retVal,
+		stats:               stats,
+	}, nil
 }
 
+// GetCombinedInfo returns the info for the namespace followed by the combined info of each of its components
 func (recv *KubernetesNamespaceProtectedEntity) GetCombinedInfo(ctx context.Context) ([]astrolabe.ProtectedEntityInfo, error) {
-	return nil, nil
-
+	info, err := recv.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	combinedInfo := []astrolabe.ProtectedEntityInfo{info}
+	components, err := recv.getComponentPEs(ctx, info.GetComponentIDs())
+	if err != nil {
+		return nil, err
+	}
+	for _, component := range components {
+		componentInfo, err := component.GetCombinedInfo(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not get combined info for component %s", component.GetID().String())
+		}
+		combinedInfo = append(combinedInfo, componentInfo...)
+	}
+	return combinedInfo, nil
 }
 
 func (recv *KubernetesNamespaceProtectedEntity) Snapshot(ctx context.Context, params map[string]map[string]interface{}) (astrolabe.ProtectedEntitySnapshotID, error) {
@@ -187,37 +197,255 @@ func (recv *KubernetesNamespaceProtectedEntity) Snapshot(ctx context.Context, pa
 		return astrolabe.ProtectedEntitySnapshotID{}, errors.Wrap(err, "Failed to create new UUID")
 	}
 	snapshotID := astrolabe.NewProtectedEntitySnapshotID(snapshotUUID.String())
-	err = recv.petm.internalRepo.WriteProtectedEntity(ctx, recv, snapshotID)
+	parsedParams, err := parseSnapshotParams(params)
+	if err != nil {
+		return astrolabe.ProtectedEntitySnapshotID{}, errors.Wrap(err, "Invalid snapshot params")
+	}
+	// The snapshot repo reads the data through GetDataReader, so the params are carried on a copy of the PE
+	snapshotPE := *recv
+	snapshotPE.snapshotParams = parsedParams
+	snapshotPE.backupResult = &BackupResult{}
+	snapshotPE.backupUID = types.UID(snapshotUUID.String())
+	backupLog, err := newBackupLogFile()
+	if err != nil {
+		return astrolabe.ProtectedEntitySnapshotID{}, err
+	}
+	defer backupLog.remove()
+	snapshotPE.backupLog = backupLog
+	podVolumeAction, err := recv.newPodVolumeBackupAction(ctx, parsedParams.defaultVolumesToFsBackup)
 	if err != nil {
+		return astrolabe.ProtectedEntitySnapshotID{}, err
+	}
+	if podVolumeAction != nil {
+		defer podVolumeAction.archives.remove()
+		snapshotPE.podVolumes = podVolumeAction.archives
+		snapshotPE.actions = append(append([]velero.BackupItemAction{}, recv.actions...), *podVolumeAction)
+	}
+	recv.logger.Infof("Snapshotting namespace %s with %s", recv.name, parsedParams.String())
+	// The resources are counted from the snapshot data once it is written
+	metadata, err := recv.getNamespaceMetadata(ctx)
+	if err != nil {
+		return astrolabe.ProtectedEntitySnapshotID{}, errors.Wrap(err, "Failed to retrieve namespace metadata")
+	}
+	snapshotTimestamp := metav1.Now()
+	metadata.SnapshotTimestamp = &snapshotTimestamp
+	snapshotPEID := recv.id.IDWithSnapshot(snapshotID)
+	err = recv.petm.internalRepo.WriteProtectedEntity(ctx, &snapshotPE, snapshotID)
+	if err != nil {
+		recv.discardSnapshot(snapshotPEID, backupLog)
 		return astrolabe.ProtectedEntitySnapshotID{}, errors.Wrap(err, "Failed to create new snapshot")
 	}
+	err = recv.storeSnapshotFiles(snapshotPEID, *snapshotPE.backupResult, backupLog, metadata)
+	if err != nil {
+		recv.discardSnapshot(snapshotPEID, backupLog)
+		return astrolabe.ProtectedEntitySnapshotID{}, err
+	}
+	if recv.petm.operationTracker != nil {
+		// The snapshot annotations of the component operations are stored in the snapshot itself
+		if err := recv.petm.operationTracker.RemoveForBackup(string(snapshotPE.backupUID)); err != nil {
+			recv.logger.WithError(err).Warnf("Could not remove the component operations of snapshot %s", snapshotPEID.String())
+		}
+	}
+	if recv.petm.snapshotIndex != nil {
+		// The backup of a snapshot is never retried, its component snapshots are referenced from the snapshot itself
+		if err := recv.petm.snapshotIndex.RemoveForBackup(string(snapshotPE.backupUID)); err != nil {
+			recv.logger.WithError(err).Warnf("Could not remove the component snapshots of snapshot %s from the snapshot index",
+				snapshotPEID.String())
+		}
+	}
 	return snapshotID, nil
 }
 
+// discardSnapshot removes a snapshot that could not be completed from the snapshot repo, along with any files stored
+// for it and the component snapshots taken for it, in the background or recorded in the snapshot index as they were
+// taken.  It runs even when the snapshot failed because its context was cancelled.  Component snapshots that could not
+// be deleted are put on the delete retry queue.  The backup log is kept, see GetFailedBackupLogReader.  Failures are
+// only logged, the error that made the snapshot fail is the one returned to the caller
+func (recv *KubernetesNamespaceProtectedEntity) discardSnapshot(snapshotPEID astrolabe.ProtectedEntityID, backupLog *backupLogFile) {
+	recv.logger.Infof("Discarding incomplete snapshot %s", snapshotPEID.String())
+	if err := backupLog.storeFailed(recv.petm.snapshotFiles, snapshotPEID); err != nil {
+		recv.logger.WithError(err).Errorf("Could not keep the backup log of incomplete snapshot %s", snapshotPEID.String())
+	} else {
+		recv.logger.Warnf("Kept the backup log of incomplete snapshot %s, it can be read with GetFailedBackupLogReader",
+			snapshotPEID.String())
+	}
+	// The backup taken for a snapshot has the snapshot ID as its UID
+	backupUID := snapshotPEID.GetSnapshotID().GetID()
+	if recv.petm.operationTracker != nil {
+		err := recv.petm.operationTracker.Discard(context.Background(), backupUID, recv.petm.pem)
+		if err != nil {
+			recv.queueFailedComponentDeletes(snapshotPEID, err)
+		}
+	}
+	if recv.petm.snapshotIndex != nil {
+		err := recv.petm.snapshotIndex.Discard(context.Background(), backupUID, recv.petm.pem)
+		if err != nil {
+			recv.queueFailedComponentDeletes(snapshotPEID, err)
+		}
+	}
+	if _, err := recv.petm.internalRepo.DeleteProtectedEntity(context.Background(), snapshotPEID); err != nil {
+		recv.logger.WithError(err).Errorf("Could not delete incomplete snapshot %s", snapshotPEID.String())
+	}
+	if err := recv.petm.snapshotFiles.delete(snapshotPEID); err != nil {
+		recv.logger.WithError(err).Errorf("Could not delete files of incomplete snapshot %s", snapshotPEID.String())
+	}
+}
+
+// queueFailedComponentDeletes puts the component snapshots listed by a ComponentDeleteError on the delete retry queue.
+// Other errors are logged
+func (recv *KubernetesNamespaceProtectedEntity) queueFailedComponentDeletes(snapshotPEID astrolabe.ProtectedEntityID, err error) {
+	deleteErr, ok := errors.Cause(err).(ComponentDeleteError)
+	if !ok || recv.petm.deleteRetryQueue == nil {
+		recv.logger.WithError(err).Errorf("Could not discard the component snapshots of incomplete snapshot %s",
+			snapshotPEID.String())
+		return
+	}
+	for componentID, componentErr := range deleteErr.Failed {
+		componentPEID, parseErr := astrolabe.NewProtectedEntityIDFromString(componentID)
+		if parseErr == nil {
+			parseErr = recv.petm.deleteRetryQueue.Add(componentPEID, snapshotPEID.String(), componentErr)
+		}
+		if parseErr != nil {
+			recv.logger.WithError(parseErr).Errorf("Could not queue the delete of component snapshot %s of incomplete snapshot %s",
+				componentID, snapshotPEID.String())
+		}
+	}
+}
+
+// storeSnapshotFiles saves the files kept alongside the data of a snapshot once the data has been written.  The stats
+// and the resource inventory of the metadata are taken from the stored data
+func (recv *KubernetesNamespaceProtectedEntity) storeSnapshotFiles(snapshotPEID astrolabe.ProtectedEntityID, backupResult BackupResult,
+	backupLog *backupLogFile, metadata *NamespaceMetadata) error {
+	err := recv.petm.snapshotFiles.writeJSON(snapshotPEID, backupResultFileName, backupResult)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write backup result")
+	}
+	err = backupLog.store(recv.petm.snapshotFiles, snapshotPEID)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write backup log")
+	}
+	stats, inventory, err := recv.petm.computeSnapshotStats(snapshotPEID)
+	if err != nil {
+		return errors.Wrap(err, "Failed to compute snapshot stats")
+	}
+	err = recv.petm.snapshotFiles.writeJSON(snapshotPEID, statsFileName, stats)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write snapshot stats")
+	}
+	metadata.SnapshotStats = &stats
+	metadata.Resources = inventory
+	metadata.UnlistedResources = backupResult.UnlistedResources
+	err = recv.petm.snapshotFiles.writeJSON(snapshotPEID, metadataFileName, metadata)
+	if err != nil {
+		return errors.Wrap(err, "Failed to write snapshot metadata")
+	}
+	return nil
+}
+
 func (recv *KubernetesNamespaceProtectedEntity) ListSnapshots(ctx context.Context) ([]astrolabe.ProtectedEntitySnapshotID, error) {
 	return recv.petm.internalRepo.ListSnapshotsForPEID(recv.id)
 
 }
+// DeleteSnapshot removes the snapshot from the local snapshot repository.  If the deleteComponents k8sns param is
+// set, the component snapshots referenced by the snapshot are deleted first.  When any of them cannot be deleted the
+// namespace snapshot is kept, so the references to the remaining component snapshots are not lost, and a
+// ComponentDeleteError listing the failures is returned
 func (recv *KubernetesNamespaceProtectedEntity) DeleteSnapshot(ctx context.Context, snapshotToDelete astrolabe.ProtectedEntitySnapshotID, params map[string]map[string]interface{}) (bool, error) {
-	return false, nil
-
+	snapshotPEID := recv.id.IDWithSnapshot(snapshotToDelete)
+	deleteComponents, err := getBoolParam(params, DeleteComponentsParam)
+	if err != nil {
+		return false, err
+	}
+	if deleteComponents {
+		snapshotPE, err := NewKubernetesNamespaceProtectedEntity(recv.petm, snapshotPEID, recv.name, recv.actions)
+		if err != nil {
+			return false, err
+		}
+		componentIDs, err := snapshotPE.getComponentIDs(ctx)
+		if err != nil {
+			return false, errors.Wrapf(err, "Could not get components for snapshot %s", snapshotPEID.String())
+		}
+		err = recv.petm.deleteComponentSnapshots(ctx, componentIDs, params)
+		if err != nil {
+			return false, err
+		}
+	}
+	deleted, err := recv.petm.internalRepo.DeleteProtectedEntity(ctx, snapshotPEID)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to delete snapshot %s", snapshotPEID.String())
+	}
+	err = recv.petm.snapshotFiles.delete(snapshotPEID)
+	if err != nil {
+		return deleted, errors.Wrapf(err, "Failed to delete files for snapshot %s", snapshotPEID.String())
+	}
+	if recv.petm.operationTracker != nil {
+		err = recv.petm.operationTracker.RemoveForBackup(snapshotToDelete.GetID())
+		if err != nil {
+			return deleted, errors.Wrapf(err, "Failed to remove component operations for snapshot %s", snapshotPEID.String())
+		}
+	}
+	if recv.petm.snapshotIndex != nil {
+		err = recv.petm.snapshotIndex.RemoveForBackup(snapshotToDelete.GetID())
+		if err != nil {
+			return deleted, errors.Wrapf(err, "Failed to remove snapshot %s from the snapshot index", snapshotPEID.String())
+		}
+	}
+	return deleted, nil
 }
+// GetInfoForSnapshot returns the info of one of the snapshots of this namespace.  The name is taken from the info
+// stored with the snapshot, the transports and components are those of the snapshot PE
 func (recv *KubernetesNamespaceProtectedEntity) GetInfoForSnapshot(ctx context.Context,
 	snapshotID astrolabe.ProtectedEntitySnapshotID) (*astrolabe.ProtectedEntityInfo, error) {
-	return nil, nil
-
+	snapshotPEID := recv.id.IDWithSnapshot(snapshotID)
+	storedInfo, err := recv.petm.internalRepo.GetPEInfoForID(ctx, snapshotPEID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not get stored info for snapshot %s", snapshotPEID.String())
+	}
+	snapshotPE, err := NewKubernetesNamespaceProtectedEntity(recv.petm, snapshotPEID, storedInfo.GetName(), recv.actions)
+	if err != nil {
+		return nil, err
+	}
+	info, err := snapshotPE.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
 }
 
+// GetComponents returns the component PEs of the namespace.  For a live namespace these are the resources in the
+// namespace that are snapshotted as PEs by the backup item actions, for a snapshot they are the component snapshots
+// that were taken along with it
 func (recv *KubernetesNamespaceProtectedEntity) GetComponents(ctx context.Context) ([]astrolabe.ProtectedEntity, error) {
-	return nil, nil
+	componentIDs, err := recv.getComponentIDs(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get component IDs")
+	}
+	return recv.getComponentPEs(ctx, componentIDs)
+}
+
+func (recv *KubernetesNamespaceProtectedEntity) getComponentPEs(ctx context.Context, componentIDs []astrolabe.ProtectedEntityID) ([]astrolabe.ProtectedEntity, error) {
+	returnComponents := []astrolabe.ProtectedEntity{}
+	if len(componentIDs) == 0 {
+		return returnComponents, nil
+	}
+	if recv.petm.pem == nil {
+		return nil, errors.New("no ProtectedEntityManager set, cannot retrieve component pes")
+	}
+	for _, componentID := range componentIDs {
+		componentPE, err := recv.petm.pem.GetProtectedEntity(ctx, componentID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not retrieve component pe %s", componentID.String())
+		}
+		returnComponents = append(returnComponents, componentPE)
+	}
+	return returnComponents, nil
 }
 
 func (recv *KubernetesNamespaceProtectedEntity) getComponentIDs(ctx context.Context) ([]astrolabe.ProtectedEntityID, error) {
-	returnComponents := []astrolabe.ProtectedEntityID{}
 	if !recv.id.HasSnapshot() {
-		// We should look for our components in the
-		return returnComponents, nil
+		return recv.getLiveComponentIDs(ctx)
 	}
+	returnComponents := []astrolabe.ProtectedEntityID{}
 	// get items out of backup tarball into a temp directory
 	tarReader, err := recv.petm.internalRepo.GetDataReaderForSnapshot(recv.id)
 	if err != nil {
@@ -233,30 +461,30 @@ func (recv *KubernetesNamespaceProtectedEntity) getComponentIDs(ctx context.Cont
 	defer fs.RemoveAll(dir)
 
 	backupResources, err := archive.NewParser(logger, fs).Parse(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing backup")
+	}
 	for resourceTypeName, resourceItems := range backupResources {
-		fmt.Println("Resource Type = %s\n", resourceTypeName)
+		recv.logger.Debugf("Resource Type = %s", resourceTypeName)
 		for namespace, resources := range resourceItems.ItemsByNamespace {
-			fmt.Println("Namespace = %s", namespace)
+			recv.logger.Debugf("Namespace = %s", namespace)
 			// Process individual items from the backup
 			for _, item := range resources {
 				itemPath := archive.GetItemFilePath(dir, resourceTypeName, namespace, item)
 
 				// obj is the Unstructured item from the backup
 				obj, err := archive.Unmarshal(fs, itemPath)
-				if err == nil {
-					accessor := meta.NewAccessor()
-					annotations, err := accessor.Annotations(obj)
-					if err == nil {
-						if annotations != nil {
-							componentSnapshotIDStr := annotations["vmware-tanzu.astrolabe.snapshotID"]
-							if componentSnapshotIDStr != "" {
-								componentSnapshotID, err := astrolabe.NewProtectedEntityIDFromString(componentSnapshotIDStr)
-								if err == nil {
-									returnComponents = append(returnComponents, componentSnapshotID)
-								}
-							}
-						}
-					}
+				if err != nil {
+					recv.logger.WithError(err).Warnf("Could not read item %s from snapshot", itemPath)
+					continue
+				}
+				componentSnapshotID, found, err := resolveSnapshotAnnotation(obj, recv.petm.operationTracker)
+				if err != nil {
+					recv.logger.WithError(err).Warnf("Ignoring component snapshot annotation on %s", itemPath)
+					continue
+				}
+				if found {
+					returnComponents = append(returnComponents, componentSnapshotID)
 				}
 			}
 		}
@@ -269,7 +497,49 @@ func (recv *KubernetesNamespaceProtectedEntity) GetID() astrolabe.ProtectedEntit
 	return recv.id
 }
 
+// Overwrite restores the resources in the snapshot sourcePE into this namespace using Velero's restore machinery.
+// Items of the snapshot that exist in the namespace are deleted first, so that they are recreated as they were in the
+// snapshot, see deleteItemsToOverwrite.  params select what is restored, see parseRestoreParams.  If
+// overwriteComponents is set, the restore item actions registered with the type manager are run so that component
+// PEs are restored as well.  Velero's warnings are logged, as Overwrite has no way to return them
 func (recv *KubernetesNamespaceProtectedEntity) Overwrite(ctx context.Context, sourcePE astrolabe.ProtectedEntity, params map[string]map[string]interface{},
 	overwriteComponents bool) error {
+	if recv.id.HasSnapshot() {
+		return errors.New(fmt.Sprintf("pe %s is a snapshot, cannot overwrite", recv.id.String()))
+	}
+	sourceID := sourcePE.GetID()
+	if sourceID.GetPeType() != Typename {
+		return errors.New(fmt.Sprintf("source pe %s is not a %s pe", sourceID.String(), Typename))
+	}
+	if !sourceID.HasSnapshot() {
+		return errors.New(fmt.Sprintf("source pe %s is not a snapshot", sourceID.String()))
+	}
+	sourceInfo, err := recv.petm.internalRepo.GetPEInfoForID(ctx, sourceID)
+	if err != nil {
+		return errors.Wrapf(err, "Could not get info for source pe %s", sourceID.String())
+	}
+	overwriteParams, err := parseRestoreParams(params)
+	if err != nil {
+		return err
+	}
+	err = recv.petm.deleteItemsToOverwrite(ctx, sourceID, sourceInfo.GetName(), recv.name, overwriteParams)
+	if err != nil {
+		return errors.Wrapf(err, "Could not delete the items of namespace %s to overwrite", recv.name)
+	}
+	var restoreActions []velero.RestoreItemAction
+	if overwriteComponents {
+		restoreActions = recv.petm.restoreActions
+	}
+	result, err := recv.petm.restoreFromSnapshot(ctx, sourceID, sourceInfo.GetName(), recv.name, overwriteParams, restoreActions)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to restore snapshot %s into namespace %s", sourceID.String(), recv.name)
+	}
+	if result.HasErrors() {
+		return RestoreError{Result: result}
+	}
+	if warnings := resultMessages(result.Warnings); len(warnings) > 0 {
+		recv.logger.Warnf("Overwrite of namespace %s from snapshot %s completed with %d warnings: %s", recv.name,
+			sourceID.String(), len(warnings), strings.Join(warnings, "; "))
+	}
 	return nil
 }
@@ -0,0 +1,356 @@
+package k8sns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	listers "github.com/vmware-tanzu/velero/pkg/generated/listers/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"github.com/vmware-tanzu/velero/pkg/restore"
+	"io"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeSnapshotRepo keeps the infos and tarballs of snapshots in memory.  Like the local snapshot repository it returns
+// os not exist errors for snapshots it does not have
+type fakeSnapshotRepo struct {
+	infos map[string]astrolabe.ProtectedEntityInfo
+	data  map[string][]byte
+}
+
+func newFakeSnapshotRepo() *fakeSnapshotRepo {
+	return &fakeSnapshotRepo{
+		infos: map[string]astrolabe.ProtectedEntityInfo{},
+		data:  map[string][]byte{},
+	}
+}
+
+// addSnapshot stores a snapshot of namespace with a tarball holding entries
+func (recv *fakeSnapshotRepo) addSnapshot(t *testing.T, snapshotPEID astrolabe.ProtectedEntityID, namespace string, entries map[string]string) {
+	recv.infos[snapshotPEID.String()] = astrolabe.NewProtectedEntityInfo(snapshotPEID, namespace, -1, nil, nil, nil, nil)
+	recv.data[snapshotPEID.String()] = newTestTarball(t, entries).Bytes()
+}
+
+func (recv *fakeSnapshotRepo) WriteProtectedEntity(ctx context.Context, pe astrolabe.ProtectedEntity, snapshotID astrolabe.ProtectedEntitySnapshotID) error {
+	return errors.New("not supported by fakeSnapshotRepo")
+}
+
+func (recv *fakeSnapshotRepo) ListSnapshotsForPEID(peid astrolabe.ProtectedEntityID) ([]astrolabe.ProtectedEntitySnapshotID, error) {
+	snapshotIDs := []astrolabe.ProtectedEntitySnapshotID{}
+	for _, info := range recv.infos {
+		if info.GetID().GetPeType() == peid.GetPeType() && info.GetID().GetID() == peid.GetID() {
+			snapshotIDs = append(snapshotIDs, info.GetID().GetSnapshotID())
+		}
+	}
+	return snapshotIDs, nil
+}
+
+func (recv *fakeSnapshotRepo) GetPEInfoForID(ctx context.Context, peid astrolabe.ProtectedEntityID) (astrolabe.ProtectedEntityInfo, error) {
+	info, ok := recv.infos[peid.String()]
+	if !ok {
+		return nil, errors.Wrap(&os.PathError{Op: "open", Path: peid.String(), Err: os.ErrNotExist}, "could not read info")
+	}
+	return info, nil
+}
+
+func (recv *fakeSnapshotRepo) GetDataReaderForSnapshot(peid astrolabe.ProtectedEntityID) (io.ReadCloser, error) {
+	data, ok := recv.data[peid.String()]
+	if !ok {
+		return nil, errors.Wrap(&os.PathError{Op: "open", Path: peid.String(), Err: os.ErrNotExist}, "could not read data")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (recv *fakeSnapshotRepo) DeleteProtectedEntity(ctx context.Context, peid astrolabe.ProtectedEntityID) (bool, error) {
+	_, ok := recv.infos[peid.String()]
+	delete(recv.infos, peid.String())
+	delete(recv.data, peid.String())
+	return ok, nil
+}
+
+// fakeRestorer records the restore requests and creates the namespace each restore targets
+type fakeRestorer struct {
+	kubeClient kubernetes.Interface
+	requests   []restore.Request
+}
+
+func (recv *fakeRestorer) Restore(request restore.Request, actions []velero.RestoreItemAction,
+	snapshotLocationLister listers.VolumeSnapshotLocationLister, volumeSnapshotterGetter restore.VolumeSnapshotterGetter) (restore.Result, restore.Result) {
+	recv.requests = append(recv.requests, request)
+	namespace := request.Restore.Spec.IncludedNamespaces[0]
+	if mapped, ok := request.Restore.Spec.NamespaceMapping[namespace]; ok {
+		namespace = mapped
+	}
+	_, err := recv.kubeClient.CoreV1().Namespaces().Create(context.Background(), &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace, UID: types.UID(namespace + "-uid")},
+	}, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return restore.Result{}, restore.Result{Velero: []string{err.Error()}}
+	}
+	return restore.Result{}, restore.Result{}
+}
+
+// newTestSnapshotsPETM returns a type manager keeping its snapshots in a fakeSnapshotRepo and its index and delete
+// retry queue under dir, with pem looking up the component PEs
+func newTestSnapshotsPETM(t *testing.T, dir string, pem astrolabe.ProtectedEntityManager) *KubernetesNamespaceProtectedEntityTypeManager {
+	snapshotFiles, err := newSnapshotFileStore(dir)
+	if err != nil {
+		t.Fatalf("newSnapshotFileStore failed with err %v", err)
+	}
+	snapshotIndex := NewSnapshotIndex(filepath.Join(dir, snapshotIndexFileName), logrus.New())
+	return &KubernetesNamespaceProtectedEntityTypeManager{
+		logger:        logrus.New(),
+		internalRepo:  newFakeSnapshotRepo(),
+		snapshotFiles: snapshotFiles,
+		pem:           pem,
+		snapshotIndex: snapshotIndex,
+		deleteRetryQueue: NewDeleteRetryQueue(filepath.Join(dir, pendingDeletesFileName), snapshotIndex, DefaultDeleteMaxAttempts,
+			time.Minute, logrus.New()),
+	}
+}
+
+// newTestClusterPETM returns a newTestSnapshotsPETM whose clients are backed by a fake clientset holding namespaces, a
+// fake dynamic client holding items and a fakeRestorer
+func newTestClusterPETM(t *testing.T, dir string, pem astrolabe.ProtectedEntityManager, namespaces []runtime.Object,
+	items []runtime.Object) (*KubernetesNamespaceProtectedEntityTypeManager, *fakeRestorer) {
+	petm := newTestSnapshotsPETM(t, dir, pem)
+	kubeClient := kubefake.NewSimpleClientset(namespaces...)
+	restorer := &fakeRestorer{kubeClient: kubeClient}
+	petm.clientset = kubeClient
+	petm.clients = &veleroClients{
+		kubeClient:      kubeClient,
+		dynamicClient:   dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), items...),
+		discoveryHelper: newTestDiscoveryHelper(),
+		restorer:        restorer,
+		logger:          logrus.New(),
+	}
+	petm.componentMappings = &lazyComponentMappings{mappings: DefaultComponentMappings()}
+	return petm, restorer
+}
+
+func TestDiscardSnapshotDeletesIndexedComponents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sns-snapshots")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	pe := &deletablePE{failures: 1}
+	petm := newTestSnapshotsPETM(t, dir, deletablePEM{pe: pe})
+	snapshotPEID := astrolabe.NewProtectedEntityIDWithSnapshotID(Typename, "ns-uid", astrolabe.NewProtectedEntitySnapshotID("snap-ns"))
+	// The component snapshots taken synchronously by the backup of the snapshot, keyed by the snapshot ID
+	for _, id := range []string{"snap-1", "snap-2"} {
+		componentPEID := astrolabe.NewProtectedEntityIDWithSnapshotID("psql", id, astrolabe.NewProtectedEntitySnapshotID(id))
+		_, _, err := petm.snapshotIndex.GetOrSnapshot(ctx, petm.pem, "snap-ns", id, func() (astrolabe.ProtectedEntityID, error) {
+			return componentPEID, nil
+		})
+		if err != nil {
+			t.Fatalf("GetOrSnapshot failed with err %v", err)
+		}
+	}
+	namespacePE := &KubernetesNamespaceProtectedEntity{petm: petm, id: astrolabe.NewProtectedEntityID(Typename, "ns-uid"),
+		name: "app", logger: logrus.New()}
+	backupLog, err := newBackupLogFile()
+	if err != nil {
+		t.Fatalf("newBackupLogFile failed with err %v", err)
+	}
+	defer backupLog.remove()
+	namespacePE.discardSnapshot(snapshotPEID, backupLog)
+
+	if pe.attempts != 2 || len(pe.deleted) != 1 {
+		t.Fatalf("expected both component snapshots to be deleted, got %d attempts, %v deleted", pe.attempts, pe.deleted)
+	}
+	entries, err := petm.snapshotIndex.Entries()
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected the index entries of the snapshot to be removed, got %v, %v", entries, err)
+	}
+	pending, err := petm.deleteRetryQueue.Pending()
+	if err != nil || len(pending) != 1 || pending[0].Backup != snapshotPEID.String() {
+		t.Fatalf("expected the failed component delete to be queued, got %v, %v", pending, err)
+	}
+	failedLogs, err := namespacePE.ListFailedBackupLogs(ctx)
+	if err != nil || len(failedLogs) != 1 || failedLogs[0] != snapshotPEID.GetSnapshotID() {
+		t.Fatalf("expected the backup log of the discarded snapshot to be kept, got %v, %v", failedLogs, err)
+	}
+}
+
+// newTestComponentItemJSON returns the JSON of a postgresql item in namespace app annotated with componentPEID
+func newTestComponentItemJSON(t *testing.T, name string, componentPEID astrolabe.ProtectedEntityID) string {
+	item := newTestNamespacedItem("acid.zalan.do/v1", "postgresql", "app", name, nil)
+	item.SetAnnotations(map[string]string{SnapshotIDAnnotation: componentPEID.String()})
+	data, err := json.Marshal(item.Object)
+	if err != nil {
+		t.Fatalf("Marshal failed with err %v", err)
+	}
+	return string(data)
+}
+
+// newTestComponentSnapshot stores a snapshot of namespace app holding a postgresql item annotated with the snapshot of
+// its component, and returns the snapshot and component snapshot IDs
+func newTestComponentSnapshot(t *testing.T, petm *KubernetesNamespaceProtectedEntityTypeManager) (astrolabe.ProtectedEntityID,
+	astrolabe.ProtectedEntityID) {
+	snapshotPEID := astrolabe.NewProtectedEntityIDWithSnapshotID(Typename, "ns-uid", astrolabe.NewProtectedEntitySnapshotID("snap-ns"))
+	componentPEID := astrolabe.NewProtectedEntityIDWithSnapshotID("psql", "db-uid", astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+	petm.internalRepo.(*fakeSnapshotRepo).addSnapshot(t, snapshotPEID, "app", map[string]string{
+		"resources/postgresqls.acid.zalan.do/namespaces/app/db.json": newTestComponentItemJSON(t, "db", componentPEID),
+		"resources/configmaps/namespaces/app/settings.json":          newTestItemJSON(t, "v1", "ConfigMap", "app", "settings", nil),
+	})
+	return snapshotPEID, componentPEID
+}
+
+func TestGetInfoForSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sns-snapshots")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	petm := newTestSnapshotsPETM(t, dir, nil)
+	snapshotPEID, componentPEID := newTestComponentSnapshot(t, petm)
+	if err := petm.snapshotFiles.writeJSON(snapshotPEID, statsFileName, SnapshotStats{CompressedBytes: 1234}); err != nil {
+		t.Fatalf("writeJSON failed with err %v", err)
+	}
+	// The live namespace has been renamed since the snapshot was taken
+	livePE := &KubernetesNamespaceProtectedEntity{petm: petm, id: astrolabe.NewProtectedEntityID(Typename, "ns-uid"),
+		name: "renamed", logger: logrus.New()}
+
+	info, err := livePE.GetInfoForSnapshot(context.Background(), snapshotPEID.GetSnapshotID())
+	if err != nil {
+		t.Fatalf("GetInfoForSnapshot failed with err %v", err)
+	}
+	if (*info).GetID() != snapshotPEID || (*info).GetName() != "app" || (*info).GetSize() != 1234 {
+		t.Fatalf("expected info for %s named app of size 1234, got %s named %s of size %d", snapshotPEID.String(),
+			(*info).GetID().String(), (*info).GetName(), (*info).GetSize())
+	}
+	components := (*info).GetComponentIDs()
+	if len(components) != 1 || components[0] != componentPEID {
+		t.Fatalf("expected component %s, got %v", componentPEID.String(), components)
+	}
+
+	_, err = livePE.GetInfoForSnapshot(context.Background(), astrolabe.NewProtectedEntitySnapshotID("missing"))
+	if err == nil || !os.IsNotExist(errors.Cause(err)) {
+		t.Fatalf("expected a not exist error for a missing snapshot, got %v", err)
+	}
+}
+
+func TestGetCombinedInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sns-snapshots")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	pem := &fakePEM{pes: map[string]*fakeComponentPE{}}
+	petm := newTestSnapshotsPETM(t, dir, pem)
+	snapshotPEID, componentPEID := newTestComponentSnapshot(t, petm)
+	pem.pes[componentPEID.String()] = &fakeComponentPE{id: componentPEID}
+	snapshotPE := &KubernetesNamespaceProtectedEntity{petm: petm, id: snapshotPEID, name: "app", logger: logrus.New()}
+
+	combinedInfo, err := snapshotPE.GetCombinedInfo(context.Background())
+	if err != nil {
+		t.Fatalf("GetCombinedInfo failed with err %v", err)
+	}
+	if len(combinedInfo) != 2 || combinedInfo[0].GetID() != snapshotPEID || combinedInfo[1].GetID() != componentPEID {
+		t.Fatalf("expected the info of %s followed by that of %s, got %v", snapshotPEID.String(), componentPEID.String(),
+			combinedInfo)
+	}
+	// Sizes are unknown without stored stats
+	if combinedInfo[0].GetSize() != -1 {
+		t.Fatalf("expected size -1 without stored stats, got %d", combinedInfo[0].GetSize())
+	}
+
+	delete(pem.pes, componentPEID.String())
+	if _, err := snapshotPE.GetCombinedInfo(context.Background()); err == nil {
+		t.Fatalf("expected GetCombinedInfo to fail when a component cannot be retrieved")
+	}
+}
+
+func TestDeleteSnapshotDeletesComponents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sns-snapshots")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	pe := &deletablePE{failures: 1}
+	petm := newTestSnapshotsPETM(t, dir, deletablePEM{pe: pe})
+	repo := petm.internalRepo.(*fakeSnapshotRepo)
+	namespacePE := &KubernetesNamespaceProtectedEntity{petm: petm, id: astrolabe.NewProtectedEntityID(Typename, "ns-uid"),
+		name: "app", logger: logrus.New()}
+	entries := map[string]string{}
+	for _, name := range []string{"db-1", "db-2"} {
+		componentPEID := astrolabe.NewProtectedEntityIDWithSnapshotID("psql", name, astrolabe.NewProtectedEntitySnapshotID("snap-"+name))
+		entries["resources/postgresqls.acid.zalan.do/namespaces/app/"+name+".json"] = newTestComponentItemJSON(t, name, componentPEID)
+		_, _, err := petm.snapshotIndex.GetOrSnapshot(ctx, petm.pem, "snap-ns", name, func() (astrolabe.ProtectedEntityID, error) {
+			return componentPEID, nil
+		})
+		if err != nil {
+			t.Fatalf("GetOrSnapshot failed with err %v", err)
+		}
+	}
+	snapshotPEID := namespacePE.id.IDWithSnapshot(astrolabe.NewProtectedEntitySnapshotID("snap-ns"))
+	repo.addSnapshot(t, snapshotPEID, "app", entries)
+	if err := petm.snapshotFiles.writeJSON(snapshotPEID, statsFileName, SnapshotStats{}); err != nil {
+		t.Fatalf("writeJSON failed with err %v", err)
+	}
+
+	// Without deleteComponents only the namespace snapshot is deleted
+	otherPEID := namespacePE.id.IDWithSnapshot(astrolabe.NewProtectedEntitySnapshotID("snap-other"))
+	repo.addSnapshot(t, otherPEID, "app", entries)
+	deleted, err := namespacePE.DeleteSnapshot(ctx, otherPEID.GetSnapshotID(), map[string]map[string]interface{}{})
+	if err != nil || !deleted || pe.attempts != 0 {
+		t.Fatalf("expected only the namespace snapshot to be deleted, got %v, %v, %d component deletes", deleted, err,
+			pe.attempts)
+	}
+
+	// One of the component snapshots fails to delete, the namespace snapshot and its files are kept
+	params := map[string]map[string]interface{}{Typename: {DeleteComponentsParam: true}}
+	_, err = namespacePE.DeleteSnapshot(ctx, snapshotPEID.GetSnapshotID(), params)
+	deleteErr, ok := errors.Cause(err).(ComponentDeleteError)
+	if !ok || len(deleteErr.Failed) != 1 {
+		t.Fatalf("expected a ComponentDeleteError for one component, got %v", err)
+	}
+	if pe.attempts != 2 || len(pe.deleted) != 1 {
+		t.Fatalf("expected both component snapshots to be attempted, got %d attempts, %v deleted", pe.attempts, pe.deleted)
+	}
+	if _, ok := repo.infos[snapshotPEID.String()]; !ok {
+		t.Fatalf("expected snapshot %s to be kept", snapshotPEID.String())
+	}
+	if err := petm.snapshotFiles.readJSON(snapshotPEID, statsFileName, &SnapshotStats{}); err != nil {
+		t.Fatalf("expected the files of snapshot %s to be kept, got %v", snapshotPEID.String(), err)
+	}
+	indexEntries, err := petm.snapshotIndex.Entries()
+	if err != nil || len(indexEntries) != 1 || deleteErr.Failed[indexEntries[0].SnapshotID] == nil {
+		t.Fatalf("expected only the failed component snapshot to be left in the index, got %v, %v", indexEntries, err)
+	}
+
+	// Once the components are deleted the namespace snapshot, its files and its index entries are removed
+	deleted, err = namespacePE.DeleteSnapshot(ctx, snapshotPEID.GetSnapshotID(), params)
+	if err != nil || !deleted {
+		t.Fatalf("expected snapshot %s to be deleted, got %v, %v", snapshotPEID.String(), deleted, err)
+	}
+	if len(repo.infos) != 0 {
+		t.Fatalf("expected no snapshots to be left, got %v", repo.infos)
+	}
+	err = petm.snapshotFiles.readJSON(snapshotPEID, statsFileName, &SnapshotStats{})
+	if !os.IsNotExist(errors.Cause(err)) {
+		t.Fatalf("expected the files of snapshot %s to be deleted, got %v", snapshotPEID.String(), err)
+	}
+	indexEntries, err = petm.snapshotIndex.Entries()
+	if err != nil || len(indexEntries) != 0 {
+		t.Fatalf("expected the index entries of the snapshot to be removed, got %v, %v", indexEntries, err)
+	}
+}
@@ -18,52 +18,83 @@ package k8sns
 
 import (
 	"context"
+	"fmt"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
 	"github.com/vmware-tanzu/astrolabe/pkg/localsnap"
+	"github.com/vmware-tanzu/velero/pkg/discovery"
 	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"github.com/vmware-tanzu/velero/pkg/util/collections"
+	"io"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
+	"path/filepath"
+	"strings"
 )
 
 type KubernetesNamespaceProtectedEntityTypeManager struct {
-	clientset  *kubernetes.Clientset
+	clientset  kubernetes.Interface
 	logger     logrus.FieldLogger
 	s3Config   astrolabe.S3Config
-	internalRepo localsnap.LocalSnapshotRepo
+	internalRepo snapshotRepository
 	actions []velero.BackupItemAction
+	restoreActions []velero.RestoreItemAction
+	pem          astrolabe.ProtectedEntityManager
+	snapshotFiles snapshotFileStore
+	clients      *veleroClients
+	componentMappings *lazyComponentMappings
+	componentSnapshotParams map[string]map[string]interface{}
+	deleteRetryQueue  *DeleteRetryQueue
+	snapshotIndex     *SnapshotIndex
+	operationTracker  *OperationTracker
+	namespaceFilter   *collections.IncludesExcludes
+	podVolumeRestoreHelperImage string
+	liveSizes         *liveSizeCache
+	unmappedItemPolicy UnmappedItemPolicy
 }
+
+// snapshotRepository stores the snapshot tarballs and their info, implemented by localsnap.LocalSnapshotRepo
+type snapshotRepository interface {
+	WriteProtectedEntity(ctx context.Context, pe astrolabe.ProtectedEntity, snapshotID astrolabe.ProtectedEntitySnapshotID) error
+	ListSnapshotsForPEID(peid astrolabe.ProtectedEntityID) ([]astrolabe.ProtectedEntitySnapshotID, error)
+	GetPEInfoForID(ctx context.Context, peid astrolabe.ProtectedEntityID) (astrolabe.ProtectedEntityInfo, error)
+	GetDataReaderForSnapshot(peid astrolabe.ProtectedEntityID) (io.ReadCloser, error)
+	DeleteProtectedEntity(ctx context.Context, peid astrolabe.ProtectedEntityID) (bool, error)
+}
+
+var _ snapshotRepository = localsnap.LocalSnapshotRepo{}
+
 const 	SnapshotsDirKey = "snapshotsDir"
 const Typename = "k8sns"
 
+// DeleteComponentsParam is the k8sns param that makes DeleteSnapshot delete the component snapshots as well
+const DeleteComponentsParam = "deleteComponents"
+
+// CopyNamespaceParam is the k8sns param that names the namespace created by Copy
+const CopyNamespaceParam = "namespace"
+
 func NewKubernetesNamespaceProtectedEntityTypeManagerFromConfig(params map[string]interface{}, s3Config astrolabe.S3Config,
 	logger logrus.FieldLogger) (astrolabe.ProtectedEntityTypeManager, error) {
-	masterURLObj := params["masterURL"]
-	masterURL := ""
-	if masterURLObj != nil {
-		masterURL = masterURLObj.(string)
+	k8snsConfig, err := ParseConfig(params, logger)
+	if err != nil {
+		return nil, err
 	}
 
-	snapshotsDir, hasSnapshotsDir := params[SnapshotsDirKey].(string)
-	if !hasSnapshotsDir {
-		return nil, errors.New("no " + SnapshotsDirKey + " param found")
+	localSnapshotRepo, err := localsnap.NewLocalSnapshotRepo(Typename, k8snsConfig.SnapshotsDir)
+	if err != nil {
+		return nil, err
 	}
-
-	localSnapshotRepo, err := localsnap.NewLocalSnapshotRepo(Typename, snapshotsDir)
+	snapshotFiles, err := newSnapshotFileStore(k8snsConfig.SnapshotsDir)
 	if err != nil {
 		return nil, err
 	}
 
-	kubeconfgPathObj := params["kubeconfig"]
-	kubeconfigPath := ""
-	if kubeconfgPathObj != nil {
-		kubeconfigPath = kubeconfgPathObj.(string)
-	}
-	config, err := clientcmd.BuildConfigFromFlags(masterURL, kubeconfigPath)
+	config, err := k8snsConfig.restConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -71,11 +102,30 @@ func NewKubernetesNamespaceProtectedEntityTypeManagerFromConfig(params map[strin
 	if err != nil {
 		return nil, err
 	}
+	clients, err := newVeleroClients(config, clientset, logger)
+	if err != nil {
+		return nil, err
+	}
+	snapshotIndex := NewSnapshotIndex(filepath.Join(snapshotFiles.dir, snapshotIndexFileName), logger)
 	returnTypeManager := KubernetesNamespaceProtectedEntityTypeManager{
 		clientset: clientset,
 		logger:    logger,
 		s3Config:  s3Config,
 		internalRepo: localSnapshotRepo,
+		snapshotFiles: snapshotFiles,
+		clients: clients,
+		componentMappings: newLazyComponentMappings(k8snsConfig, clientset, logger),
+		componentSnapshotParams: k8snsConfig.ComponentSnapshotParams,
+		namespaceFilter: k8snsConfig.namespaceFilter(),
+		podVolumeRestoreHelperImage: k8snsConfig.PodVolumeRestoreHelperImage,
+		snapshotIndex: snapshotIndex,
+		deleteRetryQueue: NewDeleteRetryQueue(filepath.Join(snapshotFiles.dir, pendingDeletesFileName), snapshotIndex,
+			DefaultDeleteMaxAttempts, DefaultDeleteRetryBackoff, logger),
+		liveSizes: newLiveSizeCache(defaultLiveSizeTTL),
+		unmappedItemPolicy: k8snsConfig.UnmappedItemPolicy,
+	}
+	if k8snsConfig.AsyncComponentSnapshots {
+		returnTypeManager.operationTracker = NewOperationTracker(filepath.Join(snapshotFiles.dir, componentOperationsFileName), logger)
 	}
 	return &returnTypeManager, nil
 }
@@ -85,10 +135,72 @@ func (recv *KubernetesNamespaceProtectedEntityTypeManager) SetActions(actions []
 	recv.actions = actions
 }
 
+// SetRestoreActions sets the Velero restore item actions that are run when components are restored along with
+// a namespace
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) SetRestoreActions(actions []velero.RestoreItemAction) {
+	recv.restoreActions = actions
+}
+
+// SetProtectedEntityManager sets the ProtectedEntityManager used to look up the component PEs of a namespace
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) SetProtectedEntityManager(pem astrolabe.ProtectedEntityManager) {
+	recv.pem = pem
+}
+
+// GetComponentMappings returns the component mappings loaded from the config, for the item actions.  The mappings
+// are loaded on the first call, so changes to the ComponentTypesConfigMap need a restart
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) GetComponentMappings(ctx context.Context) ([]ComponentMapping, error) {
+	return recv.componentMappings.get(ctx)
+}
+
+// GetComponentSnapshotParams returns the default snapshot params of each component PE type loaded from the config
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) GetComponentSnapshotParams() map[string]map[string]interface{} {
+	return recv.componentSnapshotParams
+}
+
+// GetUnmappedItemPolicy returns the policy of the backup item action for items with no PE type, from the config
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) GetUnmappedItemPolicy() UnmappedItemPolicy {
+	return recv.unmappedItemPolicy
+}
+
+// GetDeleteRetryQueue returns the queue of component snapshots whose delete failed, kept under the snapshots directory
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) GetDeleteRetryQueue() *DeleteRetryQueue {
+	return recv.deleteRetryQueue
+}
+
+// GetSnapshotIndex returns the index of the component snapshots taken for each backup, kept under the snapshots
+// directory
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) GetSnapshotIndex() *SnapshotIndex {
+	return recv.snapshotIndex
+}
+
+// GetOperationTracker returns the tracker of the component snapshots taken in the background, or nil if they are
+// taken synchronously
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) GetOperationTracker() *OperationTracker {
+	return recv.operationTracker
+}
+
+// GetRelatedResourceFinder returns the finder of the items related to component items, using the clients of the type
+// manager
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) GetRelatedResourceFinder() *RelatedResourceFinder {
+	return NewRelatedResourceFinder(recv.clients.dynamicClient, recv.clients.discoveryHelper, recv.logger)
+}
+
+// GetDiscoveryHelper returns the discovery helper shared by the Velero clients of the type manager
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) GetDiscoveryHelper() discovery.Helper {
+	return recv.clients.discoveryHelper
+}
+
+// GetClusterID returns the ID of the cluster the type manager is connected to, see GetClusterID
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) GetClusterID(ctx context.Context) (string, error) {
+	return GetClusterID(ctx, recv.clientset)
+}
+
 func (recv KubernetesNamespaceProtectedEntityTypeManager) GetTypeName() string {
 	return Typename
 }
 
+// GetProtectedEntity returns the namespace PE for id.  Live namespaces left out by the namespace filters of the config
+// are not found, as they are not returned by GetProtectedEntities.  Snapshots are returned whatever their namespace
 func (recv KubernetesNamespaceProtectedEntityTypeManager) GetProtectedEntity(ctx context.Context, id astrolabe.ProtectedEntityID) (
 	astrolabe.ProtectedEntity, error) {
 	if (id.HasSnapshot()) {
@@ -102,6 +214,9 @@ func (recv KubernetesNamespaceProtectedEntityTypeManager) GetProtectedEntity(ctx
 		if err != nil {
 			return nil, errors.Wrap(err, "could not get namespace for id")
 		}
+		if !recv.namespaceFilter.ShouldInclude(namespace.Name) {
+			return nil, apierrors.NewNotFound(v1.Resource("namespaces"), namespace.Name)
+		}
 		return NewKubernetesNamespaceProtectedEntity(&recv, id, namespace.Name, recv.actions)
 	}
 }
@@ -126,6 +241,9 @@ func (recv KubernetesNamespaceProtectedEntityTypeManager) GetProtectedEntities(c
 	}
 	var returnList []astrolabe.ProtectedEntityID
 	for _, namespace := range namespaceList.Items {
+		if !recv.namespaceFilter.ShouldInclude(namespace.Name) {
+			continue
+		}
 		returnList = append(returnList, astrolabe.NewProtectedEntityID(recv.GetTypeName(),
 			string(namespace.UID)))
 	}
@@ -133,14 +251,94 @@ func (recv KubernetesNamespaceProtectedEntityTypeManager) GetProtectedEntities(c
 	return returnList, nil
 }
 
+// Copy restores the namespace snapshot pe into a new namespace.  The name of the namespace to create is taken from
+// the "namespace" key of the k8sns params.  With AllocateNewObject the copy fails if the namespace already exists,
+// with UpdateExistingObject the snapshot is restored into the existing namespace.  Namespace UIDs are assigned by
+// the API server, so AllocateObjectWithID is not supported
 func (recv KubernetesNamespaceProtectedEntityTypeManager) Copy(ctx context.Context, pe astrolabe.ProtectedEntity, params map[string]map[string]interface{},
 	options astrolabe.CopyCreateOptions) (astrolabe.ProtectedEntity, error) {
-	return nil, nil
+	sourceID := pe.GetID()
+	if sourceID.GetPeType() != Typename {
+		return nil, errors.New(fmt.Sprintf("source pe %s is not a %s pe", sourceID.String(), Typename))
+	}
+	if !sourceID.HasSnapshot() {
+		return nil, errors.New(fmt.Sprintf("source pe %s is not a snapshot, only snapshots can be copied", sourceID.String()))
+	}
+	targetNamespace, err := getCopyNamespace(params)
+	if err != nil {
+		return nil, err
+	}
+	copyParams, err := parseRestoreParams(params)
+	if err != nil {
+		return nil, err
+	}
+	switch options {
+	case astrolabe.AllocateNewObject, astrolabe.UpdateExistingObject:
+	case astrolabe.AllocateObjectWithID:
+		return nil, errors.New("AllocateObjectWithID is not supported for " + Typename)
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown copy option %d", options))
+	}
+	namespaceExists := false
+	_, err = recv.clientset.CoreV1().Namespaces().Get(ctx, targetNamespace, metav1.GetOptions{})
+	if err == nil {
+		namespaceExists = true
+		if options != astrolabe.UpdateExistingObject {
+			return nil, errors.New(fmt.Sprintf("namespace %s already exists", targetNamespace))
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "Could not check for namespace %s", targetNamespace)
+	}
+
+	sourceInfo, err := recv.internalRepo.GetPEInfoForID(ctx, sourceID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not get info for source pe %s", sourceID.String())
+	}
+	if namespaceExists {
+		// UpdateExistingObject, items that exist are overwritten as by Overwrite
+		err = recv.deleteItemsToOverwrite(ctx, sourceID, sourceInfo.GetName(), targetNamespace, copyParams)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not delete the items of namespace %s to overwrite", targetNamespace)
+		}
+	}
+	result, err := recv.restoreFromSnapshot(ctx, sourceID, sourceInfo.GetName(), targetNamespace, copyParams, recv.restoreActions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to restore snapshot %s into namespace %s", sourceID.String(), targetNamespace)
+	}
+	if result.HasErrors() {
+		return nil, RestoreError{Result: result}
+	}
+
+	namespace, err := recv.clientset.CoreV1().Namespaces().Get(ctx, targetNamespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not retrieve restored namespace %s", targetNamespace)
+	}
+	newID := astrolabe.NewProtectedEntityID(Typename, string(namespace.UID))
+	return NewKubernetesNamespaceProtectedEntity(&recv, newID, namespace.Name, recv.actions)
 }
 
 func (recv KubernetesNamespaceProtectedEntityTypeManager) CopyFromInfo(ctx context.Context, info astrolabe.ProtectedEntityInfo, params map[string]map[string]interface{},
 	options astrolabe.CopyCreateOptions) (astrolabe.ProtectedEntity, error) {
-	return nil, nil
+	pe, err := recv.GetProtectedEntity(ctx, info.GetID())
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not get source pe %s", info.GetID().String())
+	}
+	return recv.Copy(ctx, pe, params, options)
+}
+
+func getCopyNamespace(params map[string]map[string]interface{}) (string, error) {
+	namespaceObj, ok := params[Typename][CopyNamespaceParam]
+	if !ok {
+		return "", errors.New("no " + CopyNamespaceParam + " param found in " + Typename + " params")
+	}
+	namespace, ok := namespaceObj.(string)
+	if !ok {
+		return "", errors.New(fmt.Sprintf("%s param must be a string, got %T", CopyNamespaceParam, namespaceObj))
+	}
+	if validationErrors := validation.IsDNS1123Label(namespace); len(validationErrors) > 0 {
+		return "", errors.New(fmt.Sprintf("invalid namespace name %q: %s", namespace, strings.Join(validationErrors, ", ")))
+	}
+	return namespace, nil
 }
 
 func (recv KubernetesNamespaceProtectedEntityTypeManager) Delete(ctx context.Context, id astrolabe.ProtectedEntityID) error {
@@ -4,14 +4,30 @@ import (
 	"context"
 	"github.com/sirupsen/logrus"
 	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"os"
 	"strings"
 	"testing"
 )
 
 func TestSnapshot(t *testing.T) {
+	kubeconfig := os.Getenv("KUBECONFIG")
+	if kubeconfig == "" {
+		t.Skip("KUBECONFIG not set, TestSnapshot needs a cluster")
+	}
+	snapshotsDir, err := ioutil.TempDir("", "k8sns-snapshots")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(snapshotsDir)
 	context := context.Background()
 	params := map[string]interface{} {
-		"kubeconfigPath" : "/home/dsmithuchida/.kube/config",
+		"kubeconfig" : kubeconfig,
+		SnapshotsDirKey : snapshotsDir,
 	}
 	logger := logrus.New()
 	k8sPETM, err := NewKubernetesNamespaceProtectedEntityTypeManagerFromConfig(params, astrolabe.S3Config{URLBase: "k8sns/"}, logger)
@@ -37,3 +53,63 @@ func TestSnapshot(t *testing.T) {
 		}
 	}
 }
+
+func TestCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "k8sns-snapshots")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	existing := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "existing", UID: "existing-uid"}}
+	liveSettings := newTestNamespacedItem("v1", "ConfigMap", "existing", "settings", nil)
+	petm, restorer := newTestClusterPETM(t, dir, nil, []runtime.Object{existing}, []runtime.Object{liveSettings})
+	snapshotPEID := astrolabe.NewProtectedEntityIDWithSnapshotID(Typename, "source-uid", astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+	petm.internalRepo.(*fakeSnapshotRepo).addSnapshot(t, snapshotPEID, "source", map[string]string{
+		"resources/configmaps/namespaces/source/settings.json": newTestItemJSON(t, "v1", "ConfigMap", "source", "settings", nil),
+	})
+	sourcePE, err := NewKubernetesNamespaceProtectedEntity(petm, snapshotPEID, "source", nil)
+	if err != nil {
+		t.Fatalf("NewKubernetesNamespaceProtectedEntity failed with err %v", err)
+	}
+	copyParams := func(namespace string) map[string]map[string]interface{} {
+		return map[string]map[string]interface{}{Typename: {CopyNamespaceParam: namespace}}
+	}
+
+	copied, err := petm.Copy(ctx, sourcePE, copyParams("copy"), astrolabe.AllocateNewObject)
+	if err != nil {
+		t.Fatalf("Copy into a new namespace failed with err %v", err)
+	}
+	if copied.GetID().GetID() != "copy-uid" || len(restorer.requests) != 1 ||
+		restorer.requests[0].Restore.Spec.NamespaceMapping["source"] != "copy" {
+		t.Fatalf("expected the snapshot to be restored into namespace copy, got %s after %d restores", copied.GetID().String(),
+			len(restorer.requests))
+	}
+
+	if _, err := petm.Copy(ctx, sourcePE, copyParams("existing"), astrolabe.AllocateNewObject); err == nil || len(restorer.requests) != 1 {
+		t.Fatalf("expected AllocateNewObject to fail for an existing namespace without a restore, got err %v", err)
+	}
+	configMaps := petm.clients.dynamicClient.Resource(v1.SchemeGroupVersion.WithResource("configmaps")).Namespace("existing")
+	if _, err := configMaps.Get(ctx, "settings", metav1.GetOptions{}); err != nil {
+		t.Fatalf("expected the failed copy to leave the existing items, got err %v", err)
+	}
+
+	updated, err := petm.Copy(ctx, sourcePE, copyParams("existing"), astrolabe.UpdateExistingObject)
+	if err != nil {
+		t.Fatalf("Copy into an existing namespace failed with err %v", err)
+	}
+	if updated.GetID().GetID() != "existing-uid" || len(restorer.requests) != 2 {
+		t.Fatalf("expected the snapshot to be restored into namespace existing, got %s after %d restores", updated.GetID().String(),
+			len(restorer.requests))
+	}
+	if _, err := configMaps.Get(ctx, "settings", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected the existing item to be deleted so that it is restored from the snapshot, got err %v", err)
+	}
+
+	if _, err := petm.Copy(ctx, sourcePE, copyParams("other"), astrolabe.AllocateObjectWithID); err == nil {
+		t.Fatalf("expected AllocateObjectWithID to be rejected")
+	}
+	if _, err := petm.Copy(ctx, sourcePE, copyParams("Not_A_Namespace"), astrolabe.AllocateNewObject); err == nil {
+		t.Fatalf("expected an invalid namespace name to be rejected")
+	}
+}
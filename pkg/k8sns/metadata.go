@@ -0,0 +1,213 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sort"
+	"strings"
+)
+
+const (
+	// NamespaceMetadataVersion is the version of the NamespaceMetadata document
+	NamespaceMetadataVersion = "v1"
+	metadataFileName         = "metadata.json"
+)
+
+// NamespaceMetadata is the document returned by GetMetadataReader.  It describes the namespace without the
+// resources themselves so that catalog tools can inspect a snapshot without unpacking its data
+type NamespaceMetadata struct {
+	Version           string             `json:"version"`
+	Name              string             `json:"name"`
+	UID               string             `json:"uid"`
+	Labels            map[string]string  `json:"labels,omitempty"`
+	Annotations       map[string]string  `json:"annotations,omitempty"`
+	ResourceQuotas    []v1.ResourceQuota `json:"resourceQuotas,omitempty"`
+	LimitRanges       []v1.LimitRange    `json:"limitRanges,omitempty"`
+	Resources         []ResourceCount    `json:"resources"`
+	ServerVersion     string             `json:"serverVersion"`
+	SnapshotTimestamp *metav1.Time       `json:"snapshotTimestamp,omitempty"`
+	SnapshotStats     *SnapshotStats     `json:"snapshotStats,omitempty"`
+	// UnlistedResources are the resource types that could not be listed, as group resources.  Their items are missing
+	// from Resources and, for a snapshot, from the snapshot
+	UnlistedResources []string `json:"unlistedResources,omitempty"`
+}
+
+// ResourceCount is the number of items of one resource type in the namespace and the size of their JSON encoding
+type ResourceCount struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	Count    int    `json:"count"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// GetMetadataReader returns a JSON encoded NamespaceMetadata document.  For a live namespace the document is built
+// from the cluster, for a snapshot the document saved when the snapshot was taken is returned.  The resources of a
+// snapshot are counted from its data, so they reflect the snapshot params
+func (recv *KubernetesNamespaceProtectedEntity) GetMetadataReader(ctx context.Context) (io.ReadCloser, error) {
+	if recv.id.HasSnapshot() {
+		reader, err := recv.petm.snapshotFiles.reader(recv.id, metadataFileName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not read metadata for snapshot %s", recv.id.String())
+		}
+		return reader, nil
+	}
+	metadata, err := recv.getLiveMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not marshal metadata")
+	}
+	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+}
+
+// getLiveMetadata returns the metadata of the live namespace, along with the inventory of its resources
+func (recv *KubernetesNamespaceProtectedEntity) getLiveMetadata(ctx context.Context) (*NamespaceMetadata, error) {
+	metadata, err := recv.getNamespaceMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Resources, metadata.UnlistedResources, err = recv.getResourceInventory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// getNamespaceMetadata returns the metadata of the live namespace without the resource inventory, which is filled in
+// from the snapshot data when a snapshot is taken
+func (recv *KubernetesNamespaceProtectedEntity) getNamespaceMetadata(ctx context.Context) (*NamespaceMetadata, error) {
+	coreV1 := recv.petm.clientset.CoreV1()
+	namespace, err := coreV1.Namespaces().Get(ctx, recv.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not retrieve namespace %s", recv.name)
+	}
+	resourceQuotas, err := coreV1.ResourceQuotas(recv.name).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not list resource quotas")
+	}
+	limitRanges, err := coreV1.LimitRanges(recv.name).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not list limit ranges")
+	}
+	serverVersion, err := recv.petm.clientset.Discovery().ServerVersion()
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not retrieve server version")
+	}
+	for i := range resourceQuotas.Items {
+		resourceQuotas.Items[i].ManagedFields = nil
+	}
+	for i := range limitRanges.Items {
+		limitRanges.Items[i].ManagedFields = nil
+	}
+	return &NamespaceMetadata{
+		Version:        NamespaceMetadataVersion,
+		Name:           namespace.Name,
+		UID:            string(namespace.UID),
+		Labels:         namespace.Labels,
+		Annotations:    namespace.Annotations,
+		ResourceQuotas: resourceQuotas.Items,
+		LimitRanges:    limitRanges.Items,
+		Resources:      []ResourceCount{},
+		ServerVersion:  serverVersion.GitVersion,
+	}, nil
+}
+
+// getResourceInventory counts the items of every namespaced resource type in the live namespace.  Each resource is
+// listed once, in its preferred version.  Resource types that cannot be listed are skipped, as Velero does when it
+// backs up the namespace, and returned as group resources
+func (recv *KubernetesNamespaceProtectedEntity) getResourceInventory(ctx context.Context) ([]ResourceCount, []string, error) {
+	clients := recv.petm.clients
+	inventory := []ResourceCount{}
+	unlisted := []string{}
+	for _, resourceList := range clients.discoveryHelper.Resources() {
+		gv, err := schema.ParseGroupVersion(resourceList.GroupVersion)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Could not parse group version %s", resourceList.GroupVersion)
+		}
+		for _, resource := range resourceList.APIResources {
+			if !resource.Namespaced || strings.Contains(resource.Name, "/") || !hasVerb(resource, "list") {
+				continue
+			}
+			groupResource := schema.GroupResource{Group: gv.Group, Resource: resource.Name}
+			preferredGVR, _, err := clients.discoveryHelper.ResourceFor(groupResource.WithVersion(""))
+			if err == nil && preferredGVR.Version != gv.Version {
+				continue
+			}
+			resourceClient, err := clients.dynamicFactory.ClientForGroupVersionResource(gv, resource, recv.name)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "Could not create client for %s", gv.WithResource(resource.Name).String())
+			}
+			items, err := resourceClient.List(metav1.ListOptions{})
+			if err != nil {
+				recv.logger.WithError(err).Warnf("Could not list %s, skipping", gv.WithResource(resource.Name).String())
+				unlisted = append(unlisted, groupResource.String())
+				continue
+			}
+			if len(items.Items) == 0 {
+				continue
+			}
+			var size int64
+			for _, item := range items.Items {
+				itemJSON, err := item.MarshalJSON()
+				if err != nil {
+					return nil, nil, errors.Wrapf(err, "Could not marshal %s %s", resource.Name, item.GetName())
+				}
+				size += int64(len(itemJSON))
+			}
+			inventory = append(inventory, ResourceCount{
+				Group:    gv.Group,
+				Version:  gv.Version,
+				Resource: resource.Name,
+				Count:    len(items.Items),
+				Bytes:    size,
+			})
+		}
+	}
+	sortInventory(inventory)
+	sort.Strings(unlisted)
+	return inventory, unlisted, nil
+}
+
+func sortInventory(inventory []ResourceCount) {
+	sort.Slice(inventory, func(i, j int) bool {
+		if inventory[i].Group != inventory[j].Group {
+			return inventory[i].Group < inventory[j].Group
+		}
+		return inventory[i].Resource < inventory[j].Resource
+	})
+}
+
+func hasVerb(resource metav1.APIResource, verb string) bool {
+	for _, curVerb := range resource.Verbs {
+		if curVerb == verb {
+			return true
+		}
+	}
+	return false
+}
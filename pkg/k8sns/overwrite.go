@@ -0,0 +1,202 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"github.com/vmware-tanzu/velero/pkg/util/collections"
+	"io"
+	"io/ioutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"strings"
+	"time"
+)
+
+const overwriteDeletePollInterval = time.Second
+
+// snapshotItem is a namespaced item stored in a snapshot tarball
+type snapshotItem struct {
+	groupResource schema.GroupResource
+	name          string
+	labels        map[string]string
+}
+
+// parseItemPath splits the path of an item in a snapshot tarball, resources/<resource>/namespaces/<ns>/<name>.json or
+// resources/<resource>/cluster/<name>.json, into its resource, namespace and name.  Velero writes the preferred
+// version of each item under <version>-preferredversion as well, those copies are not parsed so that every item is
+// returned once
+func parseItemPath(path string) (groupResource schema.GroupResource, namespace string, name string, ok bool) {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(segments) < 4 || segments[0] != "resources" || !strings.HasSuffix(path, ".json") {
+		return schema.GroupResource{}, "", "", false
+	}
+	groupResource = schema.ParseGroupResource(segments[1])
+	switch {
+	case len(segments) == 5 && segments[2] == "namespaces":
+		return groupResource, segments[3], strings.TrimSuffix(segments[4], ".json"), true
+	case len(segments) == 4 && segments[2] == "cluster":
+		return groupResource, "", strings.TrimSuffix(segments[3], ".json"), true
+	}
+	return schema.GroupResource{}, "", "", false
+}
+
+// readSnapshotItems returns the items of namespace in the gzipped snapshot tarball
+func readSnapshotItems(tarball io.Reader, namespace string) ([]snapshotItem, error) {
+	items := []snapshotItem{}
+	err := walkTarball(tarball, func(header *tar.Header, reader io.Reader) (bool, error) {
+		groupResource, itemNamespace, name, ok := parseItemPath(header.Name)
+		if !ok || header.Typeflag != tar.TypeReg || itemNamespace != namespace {
+			return true, nil
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return false, errors.Wrapf(err, "Could not read %s from snapshot tarball", header.Name)
+		}
+		item := unstructured.Unstructured{}
+		if err := json.Unmarshal(data, &item.Object); err != nil {
+			return false, errors.Wrapf(err, "Could not decode %s from snapshot tarball", header.Name)
+		}
+		items = append(items, snapshotItem{groupResource: groupResource, name: name, labels: item.GetLabels()})
+		return true, nil
+	})
+	return items, err
+}
+
+// itemsToOverwrite returns the items selected by params, leaving out PVCs, as deleting them may delete their volumes,
+// and the items of component resources, which are overwritten through their PEs by the restore item actions
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) itemsToOverwrite(ctx context.Context, items []snapshotItem,
+	params restoreParams) ([]snapshotItem, error) {
+	componentMappings, err := recv.GetComponentMappings(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resources := collections.GetResourceIncludesExcludes(recv.clients.discoveryHelper, params.includedResources,
+		params.allExcludedResources())
+	selector := labels.Everything()
+	if params.labelSelector != nil {
+		selector, err = metav1.LabelSelectorAsSelector(params.labelSelector)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s param", LabelSelectorParam)
+		}
+	}
+	kept := map[schema.GroupResource]bool{{Resource: "persistentvolumeclaims"}: true}
+	for _, mapping := range componentMappings {
+		kept[mapping.GroupResource()] = true
+	}
+	returnItems := []snapshotItem{}
+	for _, item := range items {
+		if kept[item.groupResource] || !resources.ShouldInclude(item.groupResource.String()) ||
+			!selector.Matches(labels.Set(item.labels)) {
+			continue
+		}
+		returnItems = append(returnItems, item)
+	}
+	return returnItems, nil
+}
+
+// deleteItemsToOverwrite deletes the items of sourceNamespace in the snapshot that exist in targetNamespace and are
+// selected by params, see itemsToOverwrite.  Velero leaves items that already exist as they are, deleting them first
+// makes the restore recreate them from the snapshot.  It returns once the deleted items are gone
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) deleteItemsToOverwrite(ctx context.Context, snapshotPEID astrolabe.ProtectedEntityID,
+	sourceNamespace string, targetNamespace string, params restoreParams) error {
+	dataReader, err := recv.internalRepo.GetDataReaderForSnapshot(snapshotPEID)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve reader for snapshot %s", snapshotPEID.String())
+	}
+	defer dataReader.Close()
+	items, err := readSnapshotItems(dataReader, sourceNamespace)
+	if err != nil {
+		return err
+	}
+	recv.clients.refreshDiscovery()
+	items, err = recv.itemsToOverwrite(ctx, items, params)
+	if err != nil {
+		return err
+	}
+	return recv.deleteExistingItems(ctx, items, targetNamespace)
+}
+
+// deleteExistingItems deletes the items that exist in namespace and waits until they are gone
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) deleteExistingItems(ctx context.Context, items []snapshotItem,
+	namespace string) error {
+	deleted := map[schema.GroupVersionResource]map[string]types.UID{}
+	for _, item := range items {
+		gvr, _, err := recv.clients.discoveryHelper.ResourceFor(item.groupResource.WithVersion(""))
+		if err != nil {
+			// Velero cannot restore the resource either, it reports it
+			recv.logger.WithError(err).Warnf("Not deleting %s %s/%s before the restore, its resource is not served",
+				item.groupResource.String(), namespace, item.name)
+			continue
+		}
+		resourceClient := recv.clients.dynamicClient.Resource(gvr).Namespace(namespace)
+		existing, err := resourceClient.Get(ctx, item.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Could not retrieve %s %s/%s", item.groupResource.String(), namespace, item.name)
+		}
+		recv.logger.Infof("Deleting %s %s/%s to overwrite it from the snapshot", item.groupResource.String(), namespace, item.name)
+		propagation := metav1.DeletePropagationBackground
+		err = resourceClient.Delete(ctx, item.name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrapf(err, "Could not delete %s %s/%s", item.groupResource.String(), namespace, item.name)
+		}
+		if deleted[gvr] == nil {
+			deleted[gvr] = map[string]types.UID{}
+		}
+		deleted[gvr][item.name] = existing.GetUID()
+	}
+	return recv.waitForItemsDeleted(ctx, namespace, deleted)
+}
+
+// waitForItemsDeleted waits until the items, given by resource and name along with their UID, are gone.  An item
+// that was recreated under the same name counts as gone
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) waitForItemsDeleted(ctx context.Context, namespace string,
+	items map[schema.GroupVersionResource]map[string]types.UID) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultResourceTerminatingTimeout)
+	defer cancel()
+	for gvr, names := range items {
+		resourceClient := recv.clients.dynamicClient.Resource(gvr).Namespace(namespace)
+		for name, uid := range names {
+			err := wait.PollImmediateUntil(overwriteDeletePollInterval, func() (bool, error) {
+				item, err := resourceClient.Get(ctx, name, metav1.GetOptions{})
+				if apierrors.IsNotFound(err) {
+					return true, nil
+				}
+				if err != nil {
+					return false, err
+				}
+				return item.GetUID() != uid, nil
+			}, ctx.Done())
+			if err != nil {
+				return errors.Wrapf(err, "%s %s/%s was not deleted", gvr.GroupResource().String(), namespace, name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package k8sns
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"testing"
+)
+
+// newTestItemJSON returns the JSON of a namespaced item as stored in a snapshot tarball
+func newTestItemJSON(t *testing.T, apiVersion string, kind string, namespace string, name string, labels map[string]string) string {
+	data, err := json.Marshal(newTestNamespacedItem(apiVersion, kind, namespace, name, labels).Object)
+	if err != nil {
+		t.Fatalf("Marshal failed with err %v", err)
+	}
+	return string(data)
+}
+
+func newTestNamespacedItem(apiVersion string, kind string, namespace string, name string, labels map[string]string) *unstructured.Unstructured {
+	item := newTestItem(apiVersion, kind)
+	item.SetNamespace(namespace)
+	item.SetName(name)
+	item.SetUID("")
+	item.SetLabels(labels)
+	return item
+}
+
+func TestParseItemPath(t *testing.T) {
+	tests := []struct {
+		path          string
+		ok            bool
+		groupResource string
+		namespace     string
+		name          string
+	}{
+		{"resources/configmaps/namespaces/app/settings.json", true, "configmaps", "app", "settings"},
+		{"resources/statefulsets.apps/namespaces/app/db.json", true, "statefulsets.apps", "app", "db"},
+		{"resources/namespaces/cluster/app.json", true, "namespaces", "", "app"},
+		{"resources/configmaps/v1-preferredversion/namespaces/app/settings.json", false, "", "", ""},
+		{"resources/configmaps/namespaces/app", false, "", "", ""},
+		{"metadata/version", false, "", "", ""},
+	}
+	for _, test := range tests {
+		groupResource, namespace, name, ok := parseItemPath(test.path)
+		if ok != test.ok || (ok && (groupResource.String() != test.groupResource || namespace != test.namespace || name != test.name)) {
+			t.Fatalf("%s: expected %v %s %s/%s, got %v %s %s/%s", test.path, test.ok, test.groupResource, test.namespace,
+				test.name, ok, groupResource.String(), namespace, name)
+		}
+	}
+}
+
+func TestDeleteItemsToOverwrite(t *testing.T) {
+	web := map[string]string{"app": "web"}
+	tarball := newTestTarball(t, map[string]string{
+		"resources/configmaps/namespaces/app/settings.json":                     newTestItemJSON(t, "v1", "ConfigMap", "app", "settings", web),
+		"resources/configmaps/v1-preferredversion/namespaces/app/settings.json": newTestItemJSON(t, "v1", "ConfigMap", "app", "settings", web),
+		"resources/configmaps/namespaces/app/other.json":                        newTestItemJSON(t, "v1", "ConfigMap", "app", "other", nil),
+		"resources/secrets/namespaces/app/creds.json":                           newTestItemJSON(t, "v1", "Secret", "app", "creds", web),
+		"resources/persistentvolumeclaims/namespaces/app/data.json":             newTestItemJSON(t, "v1", "PersistentVolumeClaim", "app", "data", web),
+		"resources/postgresqls.acid.zalan.do/namespaces/app/db.json":            newTestItemJSON(t, "acid.zalan.do/v1", "postgresql", "app", "db", web),
+		"resources/configmaps/namespaces/elsewhere/settings.json":               newTestItemJSON(t, "v1", "ConfigMap", "elsewhere", "settings", web),
+	})
+	items, err := readSnapshotItems(tarball, "app")
+	if err != nil {
+		t.Fatalf("readSnapshotItems failed with err %v", err)
+	}
+	if len(items) != 5 {
+		t.Fatalf("expected the 5 items of namespace app, got %v", items)
+	}
+
+	live := []runtime.Object{
+		newTestNamespacedItem("v1", "ConfigMap", "restored", "settings", nil),
+		newTestNamespacedItem("v1", "ConfigMap", "restored", "other", nil),
+		newTestNamespacedItem("v1", "PersistentVolumeClaim", "restored", "data", nil),
+		newTestNamespacedItem("acid.zalan.do/v1", "postgresql", "restored", "db", nil),
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), live...)
+	petm := &KubernetesNamespaceProtectedEntityTypeManager{
+		clients:           &veleroClients{dynamicClient: dynamicClient, discoveryHelper: newTestDiscoveryHelper()},
+		componentMappings: &lazyComponentMappings{mappings: DefaultComponentMappings()},
+		logger:            logrus.New(),
+	}
+	params, err := parseRestoreParams(map[string]map[string]interface{}{Typename: {LabelSelectorParam: "app=web"}})
+	if err != nil {
+		t.Fatalf("parseRestoreParams failed with err %v", err)
+	}
+	items, err = petm.itemsToOverwrite(context.Background(), items, params)
+	if err != nil {
+		t.Fatalf("itemsToOverwrite failed with err %v", err)
+	}
+	if err := petm.deleteExistingItems(context.Background(), items, "restored"); err != nil {
+		t.Fatalf("deleteExistingItems failed with err %v", err)
+	}
+	remaining := map[string]bool{}
+	for _, gvr := range []schema.GroupVersionResource{
+		{Version: "v1", Resource: "configmaps"},
+		{Version: "v1", Resource: "persistentvolumeclaims"},
+		{Group: "acid.zalan.do", Version: "v1", Resource: "postgresqls"},
+	} {
+		list, err := dynamicClient.Resource(gvr).Namespace("restored").List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("List failed with err %v", err)
+		}
+		for _, item := range list.Items {
+			remaining[gvr.Resource+"/"+item.GetName()] = true
+		}
+	}
+	expected := map[string]bool{"configmaps/other": true, "persistentvolumeclaims/data": true, "postgresqls/db": true}
+	if len(remaining) != len(expected) {
+		t.Fatalf("expected %v to be kept, got %v", expected, remaining)
+	}
+	for name := range expected {
+		if !remaining[name] {
+			t.Fatalf("expected %v to be kept, got %v", expected, remaining)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+// getBoolParam returns the value of key in the k8sns params.  Missing keys are false, string values are parsed so
+// that params which have been through a query string or a config file are accepted as well
+func getBoolParam(params map[string]map[string]interface{}, key string) (bool, error) {
+	valueObj, ok := params[Typename][key]
+	if !ok || valueObj == nil {
+		return false, nil
+	}
+	switch value := valueObj.(type) {
+	case bool:
+		return value, nil
+	case string:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid value for %s param", key)
+		}
+		return parsed, nil
+	default:
+		return false, errors.New(fmt.Sprintf("%s param must be a bool, got %T", key, valueObj))
+	}
+}
+
+// getStringSliceParam returns the value of key in the k8sns params as a list of strings.  Both lists and comma
+// separated strings are accepted
+func getStringSliceParam(params map[string]map[string]interface{}, key string) ([]string, error) {
+	valueObj, ok := params[Typename][key]
+	if !ok || valueObj == nil {
+		return nil, nil
+	}
+	switch value := valueObj.(type) {
+	case []string:
+		return value, nil
+	case string:
+		if value == "" {
+			return nil, nil
+		}
+		returnValues := []string{}
+		for _, curValue := range strings.Split(value, ",") {
+			returnValues = append(returnValues, strings.TrimSpace(curValue))
+		}
+		return returnValues, nil
+	case []interface{}:
+		returnValues := make([]string, 0, len(value))
+		for _, curValue := range value {
+			curString, ok := curValue.(string)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("%s param must be a list of strings, found %T", key, curValue))
+			}
+			returnValues = append(returnValues, curString)
+		}
+		return returnValues, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("%s param must be a list of strings, got %T", key, valueObj))
+	}
+}
+
+// decodeParam converts the value of key in the k8sns params into obj by way of JSON, so that params decoded from
+// JSON into generic maps and lists can be turned into typed structs.  It returns false if the param is not set
+func decodeParam(params map[string]map[string]interface{}, key string, obj interface{}) (bool, error) {
+	valueObj, ok := params[Typename][key]
+	if !ok || valueObj == nil {
+		return false, nil
+	}
+	buf, err := json.Marshal(valueObj)
+	if err != nil {
+		return false, errors.Wrapf(err, "invalid value for %s param", key)
+	}
+	if err := json.Unmarshal(buf, obj); err != nil {
+		return false, errors.Wrapf(err, "invalid value for %s param", key)
+	}
+	return true, nil
+}
@@ -0,0 +1,418 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"io"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+	utilexec "k8s.io/client-go/util/exec"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultVolumesToFsBackupParam is the k8sns Snapshot param that backs up the contents of all pod volumes in the
+	// namespace.  Volumes can be left out with the VolumesToExcludeAnnotation on the pod
+	DefaultVolumesToFsBackupParam = "defaultVolumesToFsBackup"
+	// DefaultVolumesToFsBackupAnnotation on a namespace has the same effect as the DefaultVolumesToFsBackupParam
+	DefaultVolumesToFsBackupAnnotation = "astrolabe.io/default-volumes-to-fs-backup"
+	// VolumesToBackupAnnotation on a pod lists the volumes whose contents are backed up, as for Velero's restic
+	// integration
+	VolumesToBackupAnnotation = "backup.velero.io/backup-volumes"
+	// VolumesToExcludeAnnotation on a pod lists the volumes that are not backed up when all volumes are
+	VolumesToExcludeAnnotation = "backup.velero.io/backup-volumes-excludes"
+
+	// podVolumesDir is the directory of the snapshot tarball that holds the pod volume archives, with a directory per
+	// pod.  Velero only reads the resources directory of the tarball, so restores are not affected by it
+	podVolumesDir = "podvolumes"
+	// podVolumesIndexPath lists the archives under podVolumesDir.  It is written ahead of them
+	podVolumesIndexPath = podVolumesDir + "/index.json"
+)
+
+// PodVolumeBackup records the contents of one pod volume stored with a namespace snapshot
+type PodVolumeBackup struct {
+	Pod       string `json:"pod"`
+	Volume    string `json:"volume"`
+	Container string `json:"container"`
+	MountPath string `json:"mountPath"`
+	// Path is the path of the tar archive of the volume in the snapshot tarball
+	Path string `json:"path"`
+}
+
+// volumesToBackup returns the volumes of the pod that should have their contents backed up.  Volumes listed in the
+// VolumesToBackupAnnotation are always selected, otherwise all volumes other than those excluded are selected when
+// defaultAll is set.  Volumes whose contents come from the API server are never selected
+func volumesToBackup(pod *v1.Pod, defaultAll bool) []string {
+	volumes := []string{}
+	if annotated := pod.Annotations[VolumesToBackupAnnotation]; annotated != "" {
+		for _, volume := range strings.Split(annotated, ",") {
+			volumes = append(volumes, strings.TrimSpace(volume))
+		}
+		return volumes
+	}
+	if !defaultAll {
+		return volumes
+	}
+	excluded := map[string]bool{}
+	for _, volume := range strings.Split(pod.Annotations[VolumesToExcludeAnnotation], ",") {
+		excluded[strings.TrimSpace(volume)] = true
+	}
+	for _, volume := range pod.Spec.Volumes {
+		if excluded[volume.Name] {
+			continue
+		}
+		source := volume.VolumeSource
+		if source.HostPath != nil || source.Secret != nil || source.ConfigMap != nil || source.Projected != nil ||
+			source.DownwardAPI != nil {
+			continue
+		}
+		volumes = append(volumes, volume.Name)
+	}
+	return volumes
+}
+
+// findVolumeMount returns the first container in the pod that mounts volume and the path it is mounted at
+func findVolumeMount(pod *v1.Pod, volume string) (string, string, bool) {
+	for _, container := range pod.Spec.Containers {
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == volume {
+				return container.Name, mount.MountPath, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// podVolumeArchivePath returns the path of the archive of a volume in the snapshot tarball.  Pod names cannot contain
+// a slash, so each pod gets a directory of its own
+func podVolumeArchivePath(pod string, volume string) string {
+	return path.Join(podVolumesDir, pod, volume+".tar")
+}
+
+// podVolumeArchives keeps the pod volume archives taken during a backup in a temp dir until they are added to the end
+// of the snapshot tarball
+type podVolumeArchives struct {
+	dir     string
+	mutex   sync.Mutex
+	backups []PodVolumeBackup
+	files   []string
+	errs    []string
+}
+
+func newPodVolumeArchives() (*podVolumeArchives, error) {
+	dir, err := ioutil.TempDir("", "astrolabe-podvolumes")
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create pod volume archive dir")
+	}
+	return &podVolumeArchives{dir: dir}, nil
+}
+
+func (recv *podVolumeArchives) add(podVolumeBackup PodVolumeBackup, file string) {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	recv.backups = append(recv.backups, podVolumeBackup)
+	recv.files = append(recv.files, file)
+}
+
+// fail records a volume that could not be backed up.  Velero only logs the errors of item actions, the failures are
+// returned by appendTo so that the snapshot fails
+func (recv *podVolumeArchives) fail(err error) {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	recv.errs = append(recv.errs, err.Error())
+}
+
+// holdItem passes all items through, the archives are only added after them
+func (recv *podVolumeArchives) holdItem(header *tar.Header, data []byte) (bool, error) {
+	return false, nil
+}
+
+// appendTo writes the index and the archives into tarWriter
+func (recv *podVolumeArchives) appendTo(tarWriter *tar.Writer) error {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	if len(recv.errs) > 0 {
+		return errors.New("pod volume backup failed: " + strings.Join(recv.errs, "; "))
+	}
+	if len(recv.backups) == 0 {
+		return nil
+	}
+	index, err := json.Marshal(recv.backups)
+	if err != nil {
+		return errors.Wrap(err, "Could not marshal pod volume index")
+	}
+	err = writeTarEntry(tarWriter, podVolumesIndexPath, int64(len(index)), bytes.NewReader(index))
+	if err != nil {
+		return err
+	}
+	for i, podVolumeBackup := range recv.backups {
+		err := appendFileToTar(tarWriter, podVolumeBackup.Path, recv.files[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (recv *podVolumeArchives) remove() error {
+	return os.RemoveAll(recv.dir)
+}
+
+func appendFileToTar(tarWriter *tar.Writer, name string, file string) error {
+	reader, err := os.Open(file)
+	if err != nil {
+		return errors.Wrapf(err, "Could not open %s", file)
+	}
+	defer reader.Close()
+	info, err := reader.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "Could not stat %s", file)
+	}
+	return writeTarEntry(tarWriter, name, info.Size(), reader)
+}
+
+func writeTarEntry(tarWriter *tar.Writer, name string, size int64, reader io.Reader) error {
+	err := tarWriter.WriteHeader(&tar.Header{
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		Typeflag: tar.TypeReg,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Could not write tar header for %s", name)
+	}
+	if _, err := io.Copy(tarWriter, reader); err != nil {
+		return errors.Wrapf(err, "Could not write %s to tarball", name)
+	}
+	return nil
+}
+
+// podVolumeBackupAction copies the contents of the selected volumes of each pod in the backup.  Velero runs it between
+// the pre and post hooks of the pod, so the hooks can quiesce the application while its volumes are read, and only for
+// the pods the backup includes.  The files are read with tar in the container that mounts the volume, so the
+// container image must provide tar; the backup of the volume fails with an error saying so when it does not.  Only
+// running pods are backed up
+type podVolumeBackupAction struct {
+	ctx        context.Context
+	petm       *KubernetesNamespaceProtectedEntityTypeManager
+	defaultAll bool
+	archives   *podVolumeArchives
+	logger     logrus.FieldLogger
+}
+
+func (recv podVolumeBackupAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"pods"},
+	}, nil
+}
+
+func (recv podVolumeBackupAction) Execute(item runtime.Unstructured, backup *velerov1.Backup) (runtime.Unstructured, []velero.ResourceIdentifier, error) {
+	pod := &v1.Pod{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.UnstructuredContent(), pod); err != nil {
+		return nil, nil, errors.Wrap(err, "Could not convert item to pod")
+	}
+	volumes := volumesToBackup(pod, recv.defaultAll)
+	if len(volumes) == 0 {
+		return item, nil, nil
+	}
+	if pod.Status.Phase != v1.PodRunning {
+		recv.logger.Warnf("Pod %s is not running, skipping backup of its volumes", pod.Name)
+		return item, nil, nil
+	}
+	for _, volume := range volumes {
+		container, mountPath, found := findVolumeMount(pod, volume)
+		if !found {
+			recv.logger.Warnf("Volume %s of pod %s is not mounted by any container, skipping", volume, pod.Name)
+			continue
+		}
+		podVolumeBackup := PodVolumeBackup{
+			Pod:       pod.Name,
+			Volume:    volume,
+			Container: container,
+			MountPath: mountPath,
+			Path:      podVolumeArchivePath(pod.Name, volume),
+		}
+		recv.logger.Infof("Backing up volume %s of pod %s from %s", volume, pod.Name, mountPath)
+		err := recv.backupVolume(pod.Namespace, podVolumeBackup)
+		if err != nil {
+			err = errors.Wrapf(err, "Failed to back up volume %s of pod %s", volume, pod.Name)
+			recv.archives.fail(err)
+			return nil, nil, err
+		}
+	}
+	return item, nil, nil
+}
+
+func (recv podVolumeBackupAction) backupVolume(namespace string, podVolumeBackup PodVolumeBackup) error {
+	file, err := ioutil.TempFile(recv.archives.dir, "volume-*.tar")
+	if err != nil {
+		return errors.Wrap(err, "Could not create volume archive")
+	}
+	defer file.Close()
+	err = recv.petm.execInPod(recv.ctx, namespace, podVolumeBackup.Pod, podVolumeBackup.Container,
+		[]string{"tar", "-cf", "-", "-C", podVolumeBackup.MountPath, "."}, nil, file)
+	if commandNotFound(err) {
+		return errors.Wrapf(err, "container %s has no tar, pod volume backups need tar in the image of the container that mounts the volume",
+			podVolumeBackup.Container)
+	}
+	if err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrap(err, "Could not write volume archive")
+	}
+	recv.archives.add(podVolumeBackup, file.Name())
+	return nil
+}
+
+// newPodVolumeBackupAction returns the action that backs up the pod volumes of the namespace during a snapshot, or nil
+// if no pod volume is selected.  defaultVolumesToFsBackup overrides the annotation on the namespace when set
+func (recv *KubernetesNamespaceProtectedEntity) newPodVolumeBackupAction(ctx context.Context, defaultVolumesToFsBackup *bool) (*podVolumeBackupAction, error) {
+	defaultAll := false
+	if defaultVolumesToFsBackup != nil {
+		defaultAll = *defaultVolumesToFsBackup
+	} else {
+		namespace, err := recv.petm.clientset.CoreV1().Namespaces().Get(ctx, recv.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not retrieve namespace %s", recv.name)
+		}
+		defaultAll, _ = strconv.ParseBool(namespace.Annotations[DefaultVolumesToFsBackupAnnotation])
+	}
+	if !defaultAll {
+		pods, err := recv.petm.clientset.CoreV1().Pods(recv.name).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not list pods in namespace %s", recv.name)
+		}
+		annotated := false
+		for _, pod := range pods.Items {
+			if pod.Annotations[VolumesToBackupAnnotation] != "" {
+				annotated = true
+				break
+			}
+		}
+		if !annotated {
+			return nil, nil
+		}
+	}
+	archives, err := newPodVolumeArchives()
+	if err != nil {
+		return nil, err
+	}
+	return &podVolumeBackupAction{
+		ctx:        ctx,
+		petm:       recv.petm,
+		defaultAll: defaultAll,
+		archives:   archives,
+		logger:     recv.logger,
+	}, nil
+}
+
+// cancellableUpgrader closes the connection of a pod exec once ctx is done, remotecommand has no other way to stop a
+// running stream
+type cancellableUpgrader struct {
+	ctx      context.Context
+	upgrader spdy.Upgrader
+}
+
+func (recv cancellableUpgrader) NewConnection(resp *http.Response) (httpstream.Connection, error) {
+	conn, err := recv.upgrader.NewConnection(resp)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-recv.ctx.Done():
+			conn.Close()
+		case <-conn.CloseChan():
+		}
+	}()
+	return conn, nil
+}
+
+// commandNotFound returns true if err is the failure of a pod exec whose command is not in the container image
+func commandNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	if exitErr, ok := errors.Cause(err).(utilexec.ExitError); ok && (exitErr.ExitStatus() == 126 || exitErr.ExitStatus() == 127) {
+		return true
+	}
+	return strings.Contains(err.Error(), "executable file not found")
+}
+
+// execInPod runs command in a container and streams stdin and stdout.  The command's stderr is returned in the error
+// if it fails.  Cancelling ctx closes the stream
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) execInPod(ctx context.Context, namespace string, pod string, container string,
+	command []string, stdin io.Reader, stdout io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	request := recv.clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(pod).
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	transport, upgrader, err := spdy.RoundTripperFor(recv.clients.restConfig)
+	if err != nil {
+		return errors.Wrap(err, "could not create pod exec transport")
+	}
+	executor, err := remotecommand.NewSPDYExecutorForTransports(transport, cancellableUpgrader{ctx: ctx, upgrader: upgrader}, "POST", request.URL())
+	if err != nil {
+		return errors.Wrap(err, "could not create pod executor")
+	}
+	stderr := &bytes.Buffer{}
+	err = executor.Stream(remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+	if ctx.Err() != nil {
+		return errors.Wrapf(ctx.Err(), "command %v in %s/%s cancelled", command, namespace, pod)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "command %v failed in %s/%s: %s", command, namespace, pod, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package k8sns
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestVolumesToBackup(t *testing.T) {
+	volumes := []v1.Volume{
+		{Name: "data", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+		{Name: "scratch", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+		{Name: "token", VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "token"}}},
+		{Name: "config", VolumeSource: v1.VolumeSource{ConfigMap: &v1.ConfigMapVolumeSource{}}},
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		defaultAll  bool
+		expected    []string
+	}{
+		{"not opted in", nil, false, []string{}},
+		{"pod annotation", map[string]string{VolumesToBackupAnnotation: "data, scratch"}, false, []string{"data", "scratch"}},
+		{"default all", nil, true, []string{"data", "scratch"}},
+		{"default all with excludes", map[string]string{VolumesToExcludeAnnotation: "scratch"}, true, []string{"data"}},
+	}
+	for _, test := range tests {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Annotations: test.annotations},
+			Spec:       v1.PodSpec{Volumes: volumes},
+		}
+		selected := volumesToBackup(pod, test.defaultAll)
+		if !reflect.DeepEqual(selected, test.expected) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.expected, selected)
+		}
+	}
+}
+
+func TestFindVolumeMount(t *testing.T) {
+	pod := &v1.Pod{
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{Name: "sidecar"},
+				{Name: "app", VolumeMounts: []v1.VolumeMount{{Name: "data", MountPath: "/var/lib/data"}}},
+			},
+		},
+	}
+	container, mountPath, found := findVolumeMount(pod, "data")
+	if !found || container != "app" || mountPath != "/var/lib/data" {
+		t.Fatalf("unexpected mount %s %s %v", container, mountPath, found)
+	}
+	if _, _, found := findVolumeMount(pod, "missing"); found {
+		t.Fatalf("found mount for unmounted volume")
+	}
+}
+
+func TestPodVolumeArchivePath(t *testing.T) {
+	if podVolumeArchivePath("a-b", "c") == podVolumeArchivePath("a", "b-c") {
+		t.Fatalf("archive paths of different pod volumes collide: %s", podVolumeArchivePath("a", "b-c"))
+	}
+}
+
+func newTestTarball(t *testing.T, entries map[string]string) *bytes.Buffer {
+	tarball := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(tarball)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, contents := range entries {
+		if err := writeTarEntry(tarWriter, name, int64(len(contents)), bytes.NewReader([]byte(contents))); err != nil {
+			t.Fatalf("writeTarEntry failed with err %v", err)
+		}
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+	return tarball
+}
+
+func TestAppendPodVolumesToTarball(t *testing.T) {
+	archives, err := newPodVolumeArchives()
+	if err != nil {
+		t.Fatalf("newPodVolumeArchives failed with err %v", err)
+	}
+	defer archives.remove()
+	archiveFile := filepath.Join(archives.dir, "volume.tar")
+	if err := ioutil.WriteFile(archiveFile, []byte("volume data"), 0600); err != nil {
+		t.Fatalf("WriteFile failed with err %v", err)
+	}
+	podVolumeBackup := PodVolumeBackup{Pod: "web", Volume: "data", Container: "app", MountPath: "/data",
+		Path: podVolumeArchivePath("web", "data")}
+	archives.add(podVolumeBackup, archiveFile)
+
+	source := newTestTarball(t, map[string]string{"resources/pods/namespaces/test/web.json": "{}"})
+	dest := &bytes.Buffer{}
+	if err := appendToTarball(source, dest, []tarballAppender{archives}); err != nil {
+		t.Fatalf("appendToTarball failed with err %v", err)
+	}
+	gzipReader, err := gzip.NewReader(dest)
+	if err != nil {
+		t.Fatalf("gzip.NewReader failed with err %v", err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	entries := map[string]string{}
+	names := []string{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Reading tarball failed with err %v", err)
+		}
+		contents, _ := ioutil.ReadAll(tarReader)
+		entries[header.Name] = string(contents)
+		names = append(names, header.Name)
+	}
+	expectedNames := []string{"resources/pods/namespaces/test/web.json", podVolumesIndexPath, "podvolumes/web/data.tar"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Fatalf("Expected entries %v, got %v", expectedNames, names)
+	}
+	index := []PodVolumeBackup{}
+	if err := json.Unmarshal([]byte(entries[podVolumesIndexPath]), &index); err != nil {
+		t.Fatalf("Could not parse index, err %v", err)
+	}
+	if !reflect.DeepEqual(index, []PodVolumeBackup{podVolumeBackup}) || entries["podvolumes/web/data.tar"] != "volume data" {
+		t.Fatalf("Unexpected pod volume entries %v", entries)
+	}
+
+	archives.fail(errors.New("tar not found"))
+	source = newTestTarball(t, map[string]string{"resources/pods/namespaces/test/web.json": "{}"})
+	if err := appendToTarball(source, ioutil.Discard, []tarballAppender{archives}); err == nil {
+		t.Fatalf("Expected appendToTarball to fail after a pod volume failed")
+	}
+}
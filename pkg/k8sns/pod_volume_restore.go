@@ -0,0 +1,303 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"io"
+	"io/ioutil"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"path"
+	"time"
+)
+
+const (
+	// DefaultPodVolumeRestoreHelperImage is the image of the init container pod volumes are restored through.  The
+	// image must provide sh, sleep and tar
+	DefaultPodVolumeRestoreHelperImage = "busybox:1.33"
+
+	// podVolumeRestoreHelperName is the name of the init container added to the restored pods
+	podVolumeRestoreHelperName = "astrolabe-restore-helper"
+	// podVolumeRestoreDir is where the restore helper mounts the volumes being restored, a directory per volume
+	podVolumeRestoreDir = "/astrolabe-restores"
+	// The restore helper exits once one of the marker files is created in its own filesystem, successfully only for
+	// podVolumeRestoreDoneFile.  The app containers do not start until it exits successfully
+	podVolumeRestoreDoneFile   = "/tmp/astrolabe-restore-done"
+	podVolumeRestoreFailedFile = "/tmp/astrolabe-restore-failed"
+
+	podReadyTimeout      = 5 * time.Minute
+	podReadyPollInterval = 2 * time.Second
+)
+
+var podVolumeRestoreHelperScript = fmt.Sprintf("until [ -f %s ] || [ -f %s ]; do sleep 1; done; [ -f %s ]",
+	podVolumeRestoreDoneFile, podVolumeRestoreFailedFile, podVolumeRestoreDoneFile)
+
+// podVolumeRestoreAction adds the restore helper init container to the restored pods that have pod volume backups, as
+// Velero does for restic restores.  The helper mounts the volumes to restore and holds back the app containers until
+// restorePodVolumes has extracted the archives into the volumes through it
+type podVolumeRestoreAction struct {
+	// backups holds the pod volume backups by pod name
+	backups map[string][]PodVolumeBackup
+	image   string
+}
+
+func newPodVolumeRestoreAction(podVolumeBackups []PodVolumeBackup, image string) podVolumeRestoreAction {
+	backups := map[string][]PodVolumeBackup{}
+	for _, podVolumeBackup := range podVolumeBackups {
+		backups[podVolumeBackup.Pod] = append(backups[podVolumeBackup.Pod], podVolumeBackup)
+	}
+	return podVolumeRestoreAction{
+		backups: backups,
+		image:   image,
+	}
+}
+
+func (recv podVolumeRestoreAction) AppliesTo() (velero.ResourceSelector, error) {
+	return velero.ResourceSelector{
+		IncludedResources: []string{"pods"},
+	}, nil
+}
+
+func (recv podVolumeRestoreAction) Execute(input *velero.RestoreItemActionExecuteInput) (*velero.RestoreItemActionExecuteOutput, error) {
+	pod := &v1.Pod{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(input.Item.UnstructuredContent(), pod); err != nil {
+		return nil, errors.Wrap(err, "Could not convert item to pod")
+	}
+	podVolumeBackups := recv.backups[pod.Name]
+	if len(podVolumeBackups) == 0 {
+		return velero.NewRestoreItemActionExecuteOutput(input.Item), nil
+	}
+	helper := v1.Container{
+		Name:    podVolumeRestoreHelperName,
+		Image:   recv.image,
+		Command: []string{"sh", "-c", podVolumeRestoreHelperScript},
+	}
+	for _, podVolumeBackup := range podVolumeBackups {
+		helper.VolumeMounts = append(helper.VolumeMounts, v1.VolumeMount{
+			Name:      podVolumeBackup.Volume,
+			MountPath: podVolumeRestorePath(podVolumeBackup.Volume),
+		})
+	}
+	initContainers := []v1.Container{helper}
+	for _, container := range pod.Spec.InitContainers {
+		if container.Name != podVolumeRestoreHelperName {
+			initContainers = append(initContainers, container)
+		}
+	}
+	pod.Spec.InitContainers = initContainers
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pod)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not convert pod to item")
+	}
+	return velero.NewRestoreItemActionExecuteOutput(&unstructured.Unstructured{Object: content}), nil
+}
+
+// podVolumeRestorePath returns where the restore helper mounts volume
+func podVolumeRestorePath(volume string) string {
+	return path.Join(podVolumeRestoreDir, volume)
+}
+
+// readPodVolumeIndex returns the pod volume backups stored with the snapshot, if any
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) readPodVolumeIndex(snapshotPEID astrolabe.ProtectedEntityID) ([]PodVolumeBackup, error) {
+	index := []PodVolumeBackup{}
+	err := recv.walkSnapshotTarball(snapshotPEID, func(header *tar.Header, reader io.Reader) (bool, error) {
+		if header.Name != podVolumesIndexPath {
+			return true, nil
+		}
+		if err := json.NewDecoder(reader).Decode(&index); err != nil {
+			return false, errors.Wrapf(err, "Could not parse pod volume index of snapshot %s", snapshotPEID.String())
+		}
+		return false, nil
+	})
+	return index, err
+}
+
+// walkSnapshotTarball calls visit with each entry of the snapshot tarball until it returns false or an error
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) walkSnapshotTarball(snapshotPEID astrolabe.ProtectedEntityID,
+	visit func(header *tar.Header, reader io.Reader) (bool, error)) error {
+	dataReader, err := recv.internalRepo.GetDataReaderForSnapshot(snapshotPEID)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve reader for snapshot %s", snapshotPEID.String())
+	}
+	defer dataReader.Close()
+	return walkTarball(dataReader, visit)
+}
+
+// walkTarball calls visit with each entry of the gzipped tarball until it returns false or an error
+func walkTarball(tarball io.Reader, visit func(header *tar.Header, reader io.Reader) (bool, error)) error {
+	gzipReader, err := gzip.NewReader(tarball)
+	if err != nil {
+		return errors.Wrap(err, "Could not open snapshot tarball")
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "Could not read snapshot tarball")
+		}
+		more, err := visit(header, tarReader)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+// restorePodVolumes extracts the pod volume archives in the snapshot tarball into the volumes of the pods of the same
+// name in targetNamespace, through the restore helper podVolumeRestoreAction added to them.  Once the archives of a pod
+// are extracted its helper is released, so that its app containers start on the restored volumes.  A pod whose volumes
+// could not be restored has its helper fail, so that the app does not start on incomplete data.  Failures are added
+// to the errors of result
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) restorePodVolumes(ctx context.Context, snapshotPEID astrolabe.ProtectedEntityID,
+	targetNamespace string, podVolumeBackups []PodVolumeBackup, result *RestoreResult) (err error) {
+	if len(podVolumeBackups) == 0 {
+		return nil
+	}
+	backupsByPath := map[string]PodVolumeBackup{}
+	for _, podVolumeBackup := range podVolumeBackups {
+		backupsByPath[podVolumeBackup.Path] = podVolumeBackup
+	}
+	// helpers holds whether the helper of each pod is waiting, and failed the pods with a volume that was not restored
+	helpers := map[string]bool{}
+	failed := map[string]bool{}
+	fail := func(podVolumeBackup PodVolumeBackup, err error) {
+		recv.logger.WithError(err).Errorf("Failed to restore volume %s of pod %s", podVolumeBackup.Volume, podVolumeBackup.Pod)
+		result.Errors.Add(targetNamespace, errors.Wrapf(err, "failed to restore volume %s of pod %s",
+			podVolumeBackup.Volume, podVolumeBackup.Pod))
+		failed[podVolumeBackup.Pod] = true
+	}
+	defer func() {
+		// The volumes of a restore that was cancelled or could not read the snapshot are incomplete
+		for pod, waiting := range helpers {
+			if waiting {
+				recv.releasePodVolumeRestoreHelper(targetNamespace, pod, err == nil && !failed[pod], result)
+			}
+		}
+	}()
+	return recv.walkSnapshotTarball(snapshotPEID, func(header *tar.Header, reader io.Reader) (bool, error) {
+		podVolumeBackup, found := backupsByPath[header.Name]
+		if !found || failed[podVolumeBackup.Pod] {
+			return true, nil
+		}
+		if _, checked := helpers[podVolumeBackup.Pod]; !checked {
+			err := recv.waitForPodVolumeRestoreHelper(ctx, targetNamespace, podVolumeBackup.Pod)
+			helpers[podVolumeBackup.Pod] = err == nil
+			if err != nil {
+				if ctx.Err() != nil {
+					return false, err
+				}
+				fail(podVolumeBackup, err)
+				return true, nil
+			}
+		}
+		recv.logger.Infof("Restoring volume %s of pod %s/%s", podVolumeBackup.Volume, targetNamespace, podVolumeBackup.Pod)
+		err := recv.execInPod(ctx, targetNamespace, podVolumeBackup.Pod, podVolumeRestoreHelperName,
+			[]string{"tar", "-xf", "-", "-C", podVolumeRestorePath(podVolumeBackup.Volume)}, reader, ioutil.Discard)
+		if commandNotFound(err) {
+			err = errors.Wrapf(err, "restore helper image %s has no tar", recv.podVolumeRestoreHelperImage)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, err
+			}
+			fail(podVolumeBackup, err)
+		}
+		return true, nil
+	})
+}
+
+// releasePodVolumeRestoreHelper lets the restore helper of the pod exit, successfully if its volumes were restored.
+// It runs after the restore was cancelled as well, so the helper is not left waiting
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) releasePodVolumeRestoreHelper(namespace string, pod string,
+	restored bool, result *RestoreResult) {
+	marker := podVolumeRestoreDoneFile
+	if !restored {
+		marker = podVolumeRestoreFailedFile
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), podReadyTimeout)
+	defer cancel()
+	err := recv.execInPod(ctx, namespace, pod, podVolumeRestoreHelperName, []string{"touch", marker}, nil, ioutil.Discard)
+	if err != nil {
+		recv.logger.WithError(err).Errorf("Could not release the restore helper of pod %s/%s", namespace, pod)
+		result.Errors.Add(namespace, errors.Wrapf(err, "could not release the restore helper of pod %s", pod))
+	}
+}
+
+// waitForPodVolumeRestoreHelper waits up to podReadyTimeout for the restore helper of the pod to be running.  A pod
+// without the helper already existed and was not restored, so its volumes are not overwritten
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) waitForPodVolumeRestoreHelper(ctx context.Context, namespace string,
+	name string) error {
+	waitCtx, cancel := context.WithTimeout(ctx, podReadyTimeout)
+	defer cancel()
+	err := wait.PollImmediateUntil(podReadyPollInterval, func() (bool, error) {
+		pod, err := recv.clientset.CoreV1().Pods(namespace).Get(waitCtx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "could not retrieve pod %s/%s", namespace, name)
+		}
+		return podVolumeRestoreHelperRunning(pod)
+	}, waitCtx.Done())
+	if err == wait.ErrWaitTimeout {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.New("the restore helper of pod " + namespace + "/" + name + " did not start within " + podReadyTimeout.String())
+	}
+	return err
+}
+
+// podVolumeRestoreHelperRunning returns true once the restore helper of pod is running, and an error if the pod has no
+// helper or it is no longer running
+func podVolumeRestoreHelperRunning(pod *v1.Pod) (bool, error) {
+	hasHelper := false
+	for _, container := range pod.Spec.InitContainers {
+		if container.Name == podVolumeRestoreHelperName {
+			hasHelper = true
+		}
+	}
+	if !hasHelper {
+		return false, errors.New("pod " + pod.Namespace + "/" + pod.Name + " has no restore helper, it already existed and was not restored")
+	}
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Name != podVolumeRestoreHelperName {
+			continue
+		}
+		if status.State.Terminated != nil {
+			return false, errors.New(fmt.Sprintf("the restore helper of pod %s/%s exited: %s", pod.Namespace, pod.Name,
+				status.State.Terminated.Reason))
+		}
+		return status.State.Running != nil, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,102 @@
+package k8sns
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilexec "k8s.io/client-go/util/exec"
+	"testing"
+)
+
+func newTestPodItem(t *testing.T, pod *v1.Pod) *unstructured.Unstructured {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pod)
+	if err != nil {
+		t.Fatalf("ToUnstructured failed with err %v", err)
+	}
+	return &unstructured.Unstructured{Object: content}
+}
+
+func TestPodVolumeRestoreAction(t *testing.T) {
+	action := newPodVolumeRestoreAction([]PodVolumeBackup{
+		{Pod: "web", Volume: "data", Path: podVolumeArchivePath("web", "data")},
+		{Pod: "web", Volume: "cache", Path: podVolumeArchivePath("web", "cache")},
+	}, "restore-helper:1")
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "app"},
+		Spec: v1.PodSpec{
+			InitContainers: []v1.Container{{Name: "migrate"}},
+			Containers:     []v1.Container{{Name: "app"}},
+		},
+	}
+	output, err := action.Execute(&velero.RestoreItemActionExecuteInput{Item: newTestPodItem(t, pod)})
+	if err != nil {
+		t.Fatalf("Execute failed with err %v", err)
+	}
+	restored := &v1.Pod{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(output.UpdatedItem.UnstructuredContent(), restored); err != nil {
+		t.Fatalf("FromUnstructured failed with err %v", err)
+	}
+	initContainers := restored.Spec.InitContainers
+	if len(initContainers) != 2 || initContainers[0].Name != podVolumeRestoreHelperName || initContainers[1].Name != "migrate" {
+		t.Fatalf("expected the restore helper to run first, got %v", initContainers)
+	}
+	helper := initContainers[0]
+	if helper.Image != "restore-helper:1" || len(helper.VolumeMounts) != 2 ||
+		helper.VolumeMounts[0].Name != "data" || helper.VolumeMounts[0].MountPath != podVolumeRestorePath("data") {
+		t.Fatalf("unexpected restore helper %v", helper)
+	}
+
+	other := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "worker", Namespace: "app"}}
+	output, err = action.Execute(&velero.RestoreItemActionExecuteInput{Item: newTestPodItem(t, other)})
+	if err != nil {
+		t.Fatalf("Execute failed with err %v", err)
+	}
+	if _, found, _ := unstructured.NestedSlice(output.UpdatedItem.UnstructuredContent(), "spec", "initContainers"); found {
+		t.Fatalf("restore helper added to a pod without volume backups")
+	}
+}
+
+func TestPodVolumeRestoreHelperRunning(t *testing.T) {
+	helperStatus := func(state v1.ContainerState) []v1.ContainerStatus {
+		return []v1.ContainerStatus{{Name: podVolumeRestoreHelperName, State: state}}
+	}
+	tests := []struct {
+		name      string
+		helper    bool
+		statuses  []v1.ContainerStatus
+		running   bool
+		expectErr bool
+	}{
+		{"existing pod", false, nil, false, true},
+		{"pending", true, nil, false, false},
+		{"waiting", true, helperStatus(v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}}), false, false},
+		{"running", true, helperStatus(v1.ContainerState{Running: &v1.ContainerStateRunning{}}), true, false},
+		{"exited", true, helperStatus(v1.ContainerState{Terminated: &v1.ContainerStateTerminated{Reason: "Error"}}), false, true},
+	}
+	for _, test := range tests {
+		pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "app"}}
+		if test.helper {
+			pod.Spec.InitContainers = []v1.Container{{Name: podVolumeRestoreHelperName}}
+		}
+		pod.Status.InitContainerStatuses = test.statuses
+		running, err := podVolumeRestoreHelperRunning(pod)
+		if running != test.running || (err != nil) != test.expectErr {
+			t.Fatalf("%s: expected %v, error %v, got %v, %v", test.name, test.running, test.expectErr, running, err)
+		}
+	}
+}
+
+func TestCommandNotFound(t *testing.T) {
+	if !commandNotFound(errors.Wrap(utilexec.CodeExitError{Err: errors.New("exit"), Code: 127}, "command failed")) {
+		t.Fatalf("exit code 127 not reported as a missing command")
+	}
+	if !commandNotFound(errors.New(`exec: "tar": executable file not found in $PATH`)) {
+		t.Fatalf("runtime error not reported as a missing command")
+	}
+	if commandNotFound(utilexec.CodeExitError{Err: errors.New("exit"), Code: 2}) || commandNotFound(nil) {
+		t.Fatalf("other failures reported as a missing command")
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/discovery"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"text/template"
+)
+
+// RelatedResource selects items in the namespace of a component item that the component depends on, such as the
+// credentials secrets of a database.  They are backed up along with the item even when a filtered backup leaves them
+// out.  LabelSelector is a template expanded with the Name, Namespace, UID and Labels of the component item, e.g.
+// "cluster-name={{.Name}}".  With Owned set, the items whose owner references include the component item are selected
+// as well
+type RelatedResource struct {
+	Group         string `json:"group"`
+	Resource      string `json:"resource"`
+	LabelSelector string `json:"labelSelector,omitempty"`
+	Owned         bool   `json:"owned,omitempty"`
+}
+
+// zalandoRelatedResources are the resources the Zalando postgres operator creates for a postgresql cluster.  It labels
+// all of them with cluster-name and sets the postgresql as the owner of some
+func zalandoRelatedResources() []RelatedResource {
+	return []RelatedResource{
+		{Resource: "secrets", LabelSelector: "cluster-name={{.Name}}", Owned: true},
+		{Resource: "services", LabelSelector: "cluster-name={{.Name}}", Owned: true},
+		{Group: "apps", Resource: "statefulsets", LabelSelector: "cluster-name={{.Name}}", Owned: true},
+		{Resource: "persistentvolumeclaims", LabelSelector: "cluster-name={{.Name}}"},
+	}
+}
+
+func (recv RelatedResource) GroupResource() schema.GroupResource {
+	return schema.GroupResource{Group: recv.Group, Resource: recv.Resource}
+}
+
+func (recv RelatedResource) validate() error {
+	if recv.Resource == "" {
+		return errors.New("resource must be set for related resources")
+	}
+	if recv.LabelSelector == "" && !recv.Owned {
+		return errors.New(fmt.Sprintf("related resource %s must set labelSelector or owned", recv.GroupResource().String()))
+	}
+	if _, err := template.New("labelSelector").Parse(recv.LabelSelector); err != nil {
+		return errors.Wrapf(err, "invalid labelSelector template for related resource %s", recv.GroupResource().String())
+	}
+	return nil
+}
+
+// relatedItemFields are the fields of the component item available to the label selector template
+type relatedItemFields struct {
+	Name      string
+	Namespace string
+	UID       types.UID
+	Labels    map[string]string
+}
+
+// expandLabelSelector returns the label selector for the related items of the component item
+func (recv RelatedResource) expandLabelSelector(fields relatedItemFields) (labels.Selector, error) {
+	selectorTemplate, err := template.New("labelSelector").Option("missingkey=error").Parse(recv.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	var expanded bytes.Buffer
+	if err := selectorTemplate.Execute(&expanded, fields); err != nil {
+		return nil, errors.Wrapf(err, "could not expand labelSelector %q", recv.LabelSelector)
+	}
+	selector, err := labels.Parse(expanded.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid labelSelector %q expanded from %q", expanded.String(), recv.LabelSelector)
+	}
+	return selector, nil
+}
+
+// RelatedResourceFinder lists the items related to a component item, for the backup item action to return as
+// additional items
+type RelatedResourceFinder struct {
+	dynamicClient   dynamic.Interface
+	discoveryHelper discovery.Helper
+	logger          logrus.FieldLogger
+}
+
+func NewRelatedResourceFinder(dynamicClient dynamic.Interface, discoveryHelper discovery.Helper, logger logrus.FieldLogger) *RelatedResourceFinder {
+	return &RelatedResourceFinder{
+		dynamicClient:   dynamicClient,
+		discoveryHelper: discoveryHelper,
+		logger:          logger,
+	}
+}
+
+// find returns the items of the related resources of mapping for item.  A resource that is not served by the cluster
+// is skipped, an error listing the items of a related resource fails the item so that it is not backed up without them
+func (recv *RelatedResourceFinder) find(ctx context.Context, mapping ComponentMapping, item runtime.Unstructured) ([]velero.ResourceIdentifier, error) {
+	if len(mapping.RelatedResources) == 0 {
+		return nil, nil
+	}
+	accessor := meta.NewAccessor()
+	fields := relatedItemFields{}
+	var err error
+	if fields.Name, err = accessor.Name(item); err != nil {
+		return nil, errors.Wrap(err, "Failed to retrieve name")
+	}
+	if fields.Namespace, err = accessor.Namespace(item); err != nil {
+		return nil, errors.Wrap(err, "Failed to retrieve namespace")
+	}
+	if fields.UID, err = accessor.UID(item); err != nil {
+		return nil, errors.Wrap(err, "Failed to retrieve UID")
+	}
+	if fields.Labels, err = accessor.Labels(item); err != nil {
+		return nil, errors.Wrap(err, "Failed to retrieve labels")
+	}
+	logger := recv.logger.WithField("item", fields.Namespace+"/"+fields.Name)
+
+	returnItems := []velero.ResourceIdentifier{}
+	seen := map[velero.ResourceIdentifier]bool{}
+	for _, related := range mapping.RelatedResources {
+		gvr, _, err := recv.discoveryHelper.ResourceFor(related.GroupResource().WithVersion(""))
+		if err != nil {
+			logger.WithError(err).Debugf("Related resource %s is not served by the cluster, skipping", related.GroupResource().String())
+			continue
+		}
+		names, err := recv.findNames(ctx, gvr, related, fields)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not find related %s of %s/%s", related.GroupResource().String(),
+				fields.Namespace, fields.Name)
+		}
+		for _, name := range names {
+			identifier := velero.ResourceIdentifier{
+				GroupResource: related.GroupResource(),
+				Namespace:     fields.Namespace,
+				Name:          name,
+			}
+			if !seen[identifier] {
+				seen[identifier] = true
+				returnItems = append(returnItems, identifier)
+			}
+		}
+	}
+	return returnItems, nil
+}
+
+// findNames returns the names of the items of related that match its label selector or are owned by the item.  Owner
+// references cannot be selected by the API server, so owned items are found by listing all items of the resource.
+// Otherwise the label selector is applied by the API server
+func (recv *RelatedResourceFinder) findNames(ctx context.Context, gvr schema.GroupVersionResource, related RelatedResource,
+	fields relatedItemFields) ([]string, error) {
+	selector := labels.Nothing()
+	if related.LabelSelector != "" {
+		var err error
+		selector, err = related.expandLabelSelector(fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	listOptions := metav1.ListOptions{LabelSelector: selector.String()}
+	if related.Owned {
+		listOptions = metav1.ListOptions{}
+	}
+	list, err := recv.dynamicClient.Resource(gvr).Namespace(fields.Namespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list %s", gvr.String())
+	}
+	names := []string{}
+	for _, relatedItem := range list.Items {
+		if selector.Matches(labels.Set(relatedItem.GetLabels())) || (related.Owned && isOwnedBy(&relatedItem, fields.UID)) {
+			names = append(names, relatedItem.GetName())
+		}
+	}
+	return names, nil
+}
+
+func isOwnedBy(item metav1.Object, uid types.UID) bool {
+	for _, ownerReference := range item.GetOwnerReferences() {
+		if ownerReference.UID == uid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package k8sns
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+)
+
+func newRelatedItem(apiVersion string, kind string, namespace string, name string, itemLabels map[string]string,
+	ownerUID types.UID) *unstructured.Unstructured {
+	item := &unstructured.Unstructured{}
+	item.SetAPIVersion(apiVersion)
+	item.SetKind(kind)
+	item.SetNamespace(namespace)
+	item.SetName(name)
+	item.SetLabels(itemLabels)
+	if ownerUID != "" {
+		item.SetOwnerReferences([]metav1.OwnerReference{{APIVersion: "acid.zalan.do/v1", Kind: "postgresql", Name: "owner", UID: ownerUID}})
+	}
+	return item
+}
+
+func TestFindRelatedResources(t *testing.T) {
+	clusterLabels := map[string]string{"cluster-name": "test"}
+	dynamicClient := fake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newRelatedItem("v1", "Secret", "db", "postgres.test.credentials.postgresql.acid.zalan.do", clusterLabels, ""),
+		newRelatedItem("v1", "Secret", "db", "postgres.other.credentials.postgresql.acid.zalan.do", map[string]string{"cluster-name": "other"}, ""),
+		newRelatedItem("v1", "Secret", "other-ns", "postgres.test.credentials.postgresql.acid.zalan.do", clusterLabels, ""),
+		newRelatedItem("v1", "Service", "db", "test", clusterLabels, "test-uid"),
+		newRelatedItem("v1", "Service", "db", "test-config", nil, "test-uid"),
+		newRelatedItem("apps/v1", "StatefulSet", "db", "test", clusterLabels, "test-uid"),
+		newRelatedItem("v1", "PersistentVolumeClaim", "db", "pgdata-test-0", clusterLabels, ""),
+	)
+	finder := NewRelatedResourceFinder(dynamicClient, newTestDiscoveryHelper(), logrus.New())
+	item := newTestItem("acid.zalan.do/v1", "postgresql")
+	item.SetNamespace("db")
+	mappings := DefaultComponentMappings()
+	if err := validateComponentMappings(mappings); err != nil {
+		t.Fatalf("validateComponentMappings failed with err %v", err)
+	}
+	var psqlMapping ComponentMapping
+	for _, mapping := range mappings {
+		if mapping.Resource == "postgresqls" {
+			psqlMapping = mapping
+		}
+	}
+
+	related, err := finder.find(context.Background(), psqlMapping, item)
+	if err != nil {
+		t.Fatalf("find failed with err %v", err)
+	}
+	expected := map[velero.ResourceIdentifier]bool{
+		{GroupResource: schema.GroupResource{Resource: "secrets"}, Namespace: "db", Name: "postgres.test.credentials.postgresql.acid.zalan.do"}: true,
+		{GroupResource: schema.GroupResource{Resource: "services"}, Namespace: "db", Name: "test"}:                                              true,
+		{GroupResource: schema.GroupResource{Resource: "services"}, Namespace: "db", Name: "test-config"}:                                       true,
+		{GroupResource: schema.GroupResource{Group: "apps", Resource: "statefulsets"}, Namespace: "db", Name: "test"}:                           true,
+		{GroupResource: schema.GroupResource{Resource: "persistentvolumeclaims"}, Namespace: "db", Name: "pgdata-test-0"}:                       true,
+	}
+	if len(related) != len(expected) {
+		t.Fatalf("expected %d related items, got %v", len(expected), related)
+	}
+	for _, identifier := range related {
+		if !expected[identifier] {
+			t.Fatalf("unexpected related item %v", identifier)
+		}
+	}
+	if lists := len(dynamicClient.Actions()); lists != len(psqlMapping.RelatedResources) {
+		t.Fatalf("expected one list per related resource, got %d", lists)
+	}
+
+	dynamicClient.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("forbidden")
+	})
+	if _, err := finder.find(context.Background(), psqlMapping, item); err == nil {
+		t.Fatalf("expected find to fail when the secrets cannot be listed")
+	}
+}
+
+func TestRelatedResourceValidation(t *testing.T) {
+	invalid := []RelatedResource{
+		{LabelSelector: "cluster-name={{.Name}}"},
+		{Resource: "secrets"},
+		{Resource: "secrets", LabelSelector: "cluster-name={{.Name"},
+	}
+	for _, related := range invalid {
+		if err := related.validate(); err == nil {
+			t.Fatalf("expected related resource %v to be rejected", related)
+		}
+	}
+	related := RelatedResource{Resource: "secrets", LabelSelector: "cluster-name={{.Missing}}"}
+	if _, err := related.expandLabelSelector(relatedItemFields{Name: "test"}); err == nil {
+		t.Fatalf("expected a template referencing an unknown field to fail")
+	}
+}
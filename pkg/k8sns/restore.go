@@ -0,0 +1,222 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/builder"
+	"github.com/vmware-tanzu/velero/pkg/plugin/velero"
+	"github.com/vmware-tanzu/velero/pkg/restore"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"time"
+)
+
+// defaultRestorePriorities mirrors the resource ordering used by the Velero server so that dependencies such as
+// CRDs, PVs and secrets exist before the resources that reference them are restored
+var defaultRestorePriorities = []string{
+	"customresourcedefinitions",
+	"namespaces",
+	"storageclasses",
+	"volumesnapshotclass.snapshot.storage.k8s.io",
+	"volumesnapshotcontents.snapshot.storage.k8s.io",
+	"volumesnapshots.snapshot.storage.k8s.io",
+	"persistentvolumes",
+	"persistentvolumeclaims",
+	"secrets",
+	"configmaps",
+	"serviceaccounts",
+	"limitranges",
+	"pods",
+	"replicasets.apps",
+}
+
+// nonRestorableResources are never restored, the same list the Velero restore controller excludes
+var nonRestorableResources = []string{
+	"nodes",
+	"events",
+	"events.events.k8s.io",
+	"backups.velero.io",
+	"restores.velero.io",
+	"resticrepositories.velero.io",
+}
+
+const defaultResourceTerminatingTimeout = 10 * time.Minute
+
+// restoreParams holds the k8sns Copy and Overwrite params that map onto the Velero Restore spec.  They use the keys of
+// the Snapshot params: IncludedResourcesParam, ExcludedResourcesParam and LabelSelectorParam
+type restoreParams struct {
+	includedResources []string
+	excludedResources []string
+	labelSelector     *metav1.LabelSelector
+}
+
+func parseRestoreParams(params map[string]map[string]interface{}) (restoreParams, error) {
+	returnParams := restoreParams{}
+	var err error
+	returnParams.includedResources, err = getStringSliceParam(params, IncludedResourcesParam)
+	if err != nil {
+		return restoreParams{}, err
+	}
+	returnParams.excludedResources, err = getStringSliceParam(params, ExcludedResourcesParam)
+	if err != nil {
+		return restoreParams{}, err
+	}
+	returnParams.labelSelector, err = getLabelSelectorParam(params, LabelSelectorParam)
+	if err != nil {
+		return restoreParams{}, err
+	}
+	return returnParams, nil
+}
+
+// allExcludedResources returns the excluded resources along with the nonRestorableResources
+func (recv restoreParams) allExcludedResources() []string {
+	return append(append([]string{}, recv.excludedResources...), nonRestorableResources...)
+}
+
+// RestoreResult holds the warnings and errors Velero reported while restoring a namespace snapshot.  Messages are
+// grouped the same way Velero groups them: Velero itself, cluster scoped resources and per namespace
+type RestoreResult struct {
+	Warnings restore.Result
+	Errors   restore.Result
+}
+
+func (recv RestoreResult) HasErrors() bool {
+	return resultCount(recv.Errors) > 0
+}
+
+func resultCount(result restore.Result) int {
+	count := len(result.Velero) + len(result.Cluster)
+	for _, messages := range result.Namespaces {
+		count += len(messages)
+	}
+	return count
+}
+
+// RestoreError is returned when Velero completed the restore but reported errors for one or more resources
+type RestoreError struct {
+	Result RestoreResult
+}
+
+func (recv RestoreError) Error() string {
+	messages := resultMessages(recv.Result.Errors)
+	return fmt.Sprintf("restore failed with %d errors: %s", len(messages), strings.Join(messages, "; "))
+}
+
+// resultMessages flattens result, prefixing the messages of namespaces with the namespace
+func resultMessages(result restore.Result) []string {
+	messages := append([]string{}, result.Velero...)
+	messages = append(messages, result.Cluster...)
+	for namespace, namespaceMessages := range result.Namespaces {
+		for _, message := range namespaceMessages {
+			messages = append(messages, fmt.Sprintf("%s: %s", namespace, message))
+		}
+	}
+	return messages
+}
+
+// restoreFromSnapshot runs the Velero restorer over the tarball stored for snapshotID.  Resources from
+// sourceNamespace are restored into targetNamespace, which is created by Velero if it does not exist.  params select
+// the resources and items that are restored.  Pod volume
+// contents stored with the snapshot are copied back through an init container added to their pods, before the app
+// containers start
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) restoreFromSnapshot(ctx context.Context, snapshotID astrolabe.ProtectedEntityID,
+	sourceNamespace string, targetNamespace string, params restoreParams, actions []velero.RestoreItemAction) (RestoreResult, error) {
+	if !snapshotID.HasSnapshot() {
+		return RestoreResult{}, errors.New(fmt.Sprintf("pe %s is not a snapshot, cannot restore from it", snapshotID.String()))
+	}
+	podVolumeBackups, err := recv.readPodVolumeIndex(snapshotID)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	if len(podVolumeBackups) > 0 {
+		actions = append(append([]velero.RestoreItemAction{}, actions...),
+			newPodVolumeRestoreAction(podVolumeBackups, recv.podVolumeRestoreHelperImage))
+	}
+	backupReader, err := recv.internalRepo.GetDataReaderForSnapshot(snapshotID)
+	if err != nil {
+		return RestoreResult{}, errors.Wrapf(err, "Could not retrieve reader for snapshot %s", snapshotID.String())
+	}
+	defer backupReader.Close()
+
+	clients := recv.clients
+	clients.refreshDiscovery()
+
+	restoreUUID, err := uuid.NewRandom()
+	if err != nil {
+		return RestoreResult{}, errors.Wrap(err, "Failed to create new UUID")
+	}
+	backupName := "astrolabe-" + snapshotID.GetSnapshotID().GetID()
+	backupParams := builder.ForBackup(velerov1.DefaultNamespace, backupName).
+		IncludedNamespaces(sourceNamespace).DefaultVolumesToRestic(false).Result()
+	restoreBuilder := builder.ForRestore(velerov1.DefaultNamespace, "astrolabe-"+restoreUUID.String()).
+		Backup(backupName).IncludedNamespaces(sourceNamespace).
+		IncludedResources(params.includedResources...).ExcludedResources(params.allExcludedResources()...)
+	if params.labelSelector != nil {
+		restoreBuilder = restoreBuilder.LabelSelector(params.labelSelector)
+	}
+	if targetNamespace != sourceNamespace {
+		restoreBuilder = restoreBuilder.NamespaceMappings(sourceNamespace, targetNamespace)
+	}
+	logger := recv.logger.WithField("snapshot", snapshotID.String()).WithField("namespace", targetNamespace)
+	request := restore.Request{
+		Restore:      restoreBuilder.Result(),
+		Log:          logger,
+		Backup:       backupParams,
+		BackupReader: backupReader,
+	}
+
+	logger.Infof("Restoring namespace %s from snapshot into namespace %s", sourceNamespace, targetNamespace)
+	warnings, restoreErrors := clients.restorer.Restore(request, actions, nil, nil)
+	result := RestoreResult{
+		Warnings: warnings,
+		Errors:   restoreErrors,
+	}
+	err = recv.restorePodVolumes(ctx, snapshotID, targetNamespace, podVolumeBackups, &result)
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	logRestoreResult(logger, result)
+	return result, nil
+}
+
+func logRestoreResult(logger logrus.FieldLogger, result RestoreResult) {
+	logMessages := func(messages []string, level string, scope string) {
+		for _, message := range messages {
+			entry := logger.WithField("scope", scope)
+			if level == "error" {
+				entry.Error(message)
+			} else {
+				entry.Warn(message)
+			}
+		}
+	}
+	for level, levelResult := range map[string]restore.Result{"warning": result.Warnings, "error": result.Errors} {
+		logMessages(levelResult.Velero, level, "velero")
+		logMessages(levelResult.Cluster, level, "cluster")
+		for namespace, messages := range levelResult.Namespaces {
+			logMessages(messages, level, namespace)
+		}
+	}
+	logger.Infof("Restore completed with %d warnings and %d errors", resultCount(result.Warnings), resultCount(result.Errors))
+}
@@ -0,0 +1,169 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/astrolabe-velero/pkg/buildinfo"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"time"
+)
+
+// Annotations set on component items by the backup and restore item actions
+const (
+	// SnapshotIDAnnotation holds the ID of the component snapshot taken when the item was backed up.  It is still
+	// written alongside SnapshotAnnotation for readers that predate it
+	SnapshotIDAnnotation = "vmware-tanzu.astrolabe.snapshotID"
+	// SnapshotAnnotation holds the SnapshotRecord of the component snapshot as JSON
+	SnapshotAnnotation = "astrolabe.io/snapshot"
+	// RestoredFromAnnotation holds the ID of the component snapshot the item was restored from
+	RestoredFromAnnotation = "astrolabe.io/restored-from"
+	// RestoredIDAnnotation holds the ID of the component PE the snapshot was restored into
+	RestoredIDAnnotation = "astrolabe.io/restored-id"
+)
+
+// SnapshotRecordFormatVersion is the version of the SnapshotRecord format written by this version of astrolabe-velero
+const SnapshotRecordFormatVersion = 1
+
+// SnapshotRecord records where a component snapshot came from
+type SnapshotRecord struct {
+	FormatVersion int                               `json:"formatVersion"`
+	SnapshotID    string                            `json:"snapshotID"`
+	PEType        string                            `json:"peType"`
+	TakenAt       time.Time                         `json:"takenAt"`
+	Version       string                            `json:"astrolabeVeleroVersion"`
+	Params        map[string]map[string]interface{} `json:"params,omitempty"`
+	ClusterID     string                            `json:"clusterID,omitempty"`
+}
+
+// NewSnapshotRecord returns the record for the snapshot snapshotPEID taken now with params in cluster clusterID
+func NewSnapshotRecord(snapshotPEID astrolabe.ProtectedEntityID, params map[string]map[string]interface{},
+	clusterID string) SnapshotRecord {
+	return SnapshotRecord{
+		FormatVersion: SnapshotRecordFormatVersion,
+		SnapshotID:    snapshotPEID.String(),
+		PEType:        snapshotPEID.GetPeType(),
+		TakenAt:       time.Now().UTC(),
+		Version:       buildinfo.Version,
+		Params:        params,
+		ClusterID:     clusterID,
+	}
+}
+
+// GetSnapshotPEID parses the snapshot ID of the record
+func (recv SnapshotRecord) GetSnapshotPEID() (astrolabe.ProtectedEntityID, error) {
+	snapshotPEID, err := astrolabe.NewProtectedEntityIDFromString(recv.SnapshotID)
+	if err != nil {
+		return astrolabe.ProtectedEntityID{}, errors.Wrapf(err, "Invalid snapshot ID %q", recv.SnapshotID)
+	}
+	if !snapshotPEID.HasSnapshot() {
+		return astrolabe.ProtectedEntityID{}, errors.New("ID " + recv.SnapshotID + " does not reference a snapshot")
+	}
+	return snapshotPEID, nil
+}
+
+// setSnapshotAnnotations records the snapshot on item, both as SnapshotAnnotation and as the bare SnapshotIDAnnotation
+func setSnapshotAnnotations(item runtime.Object, record SnapshotRecord) error {
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "Could not marshal snapshot record")
+	}
+	return setAnnotations(item, map[string]string{
+		SnapshotAnnotation:   string(recordJSON),
+		SnapshotIDAnnotation: record.SnapshotID,
+	})
+}
+
+// getSnapshotRecord returns the record of the component snapshot stored on item by the backup item action.  Items
+// backed up before SnapshotAnnotation was introduced only carry SnapshotIDAnnotation, and get a record holding just
+// the snapshot ID and PE type.  found is false if the item has no snapshot annotation
+func getSnapshotRecord(item runtime.Object) (record SnapshotRecord, found bool, err error) {
+	annotations, err := meta.NewAccessor().Annotations(item)
+	if err != nil {
+		return SnapshotRecord{}, false, errors.Wrap(err, "Could not retrieve annotations")
+	}
+	if recordJSON := annotations[SnapshotAnnotation]; recordJSON != "" {
+		if err := json.Unmarshal([]byte(recordJSON), &record); err != nil {
+			return SnapshotRecord{}, true, errors.Wrapf(err, "Invalid %s annotation", SnapshotAnnotation)
+		}
+		if record.FormatVersion < 1 || record.FormatVersion > SnapshotRecordFormatVersion {
+			return SnapshotRecord{}, true, errors.New(fmt.Sprintf("unsupported %s annotation format version %d",
+				SnapshotAnnotation, record.FormatVersion))
+		}
+	} else {
+		snapshotIDStr := annotations[SnapshotIDAnnotation]
+		if snapshotIDStr == "" {
+			return SnapshotRecord{}, false, nil
+		}
+		record = SnapshotRecord{
+			SnapshotID: snapshotIDStr,
+		}
+	}
+	snapshotPEID, err := record.GetSnapshotPEID()
+	if err != nil {
+		return SnapshotRecord{}, true, errors.Wrap(err, "Invalid snapshot annotation")
+	}
+	record.PEType = snapshotPEID.GetPeType()
+	return record, true, nil
+}
+
+// getSnapshotAnnotation returns the component snapshot ID stored on item by the backup item action.  found is false if
+// the item has no snapshot annotation
+func getSnapshotAnnotation(item runtime.Object) (snapshotPEID astrolabe.ProtectedEntityID, found bool, err error) {
+	record, found, err := getSnapshotRecord(item)
+	if err != nil || !found {
+		return astrolabe.ProtectedEntityID{}, found, err
+	}
+	snapshotPEID, err = record.GetSnapshotPEID()
+	return snapshotPEID, true, err
+}
+
+// setAnnotations adds annotations to the annotations of item
+func setAnnotations(item runtime.Object, annotations map[string]string) error {
+	accessor := meta.NewAccessor()
+	itemAnnotations, err := accessor.Annotations(item)
+	if err != nil {
+		return errors.Wrap(err, "Could not retrieve annotations")
+	}
+	if itemAnnotations == nil {
+		itemAnnotations = map[string]string{}
+	}
+	for key, value := range annotations {
+		itemAnnotations[key] = value
+	}
+	if err := accessor.SetAnnotations(item, itemAnnotations); err != nil {
+		return errors.Wrap(err, "Could not set annotations")
+	}
+	return nil
+}
+
+// GetClusterID returns the ID recorded as the source cluster of snapshots, the UID of the kube-system namespace.  The
+// UID is assigned when the cluster is created and does not change for the life of the cluster
+func GetClusterID(ctx context.Context, kubeClient kubernetes.Interface) (string, error) {
+	kubeSystem, err := kubeClient.CoreV1().Namespaces().Get(ctx, "kube-system", metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrap(err, "Could not retrieve kube-system namespace for the cluster ID")
+	}
+	return string(kubeSystem.UID), nil
+}
@@ -0,0 +1,84 @@
+package k8sns
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/vmware-tanzu/astrolabe-velero/pkg/buildinfo"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestSnapshotAnnotationRoundTrip(t *testing.T) {
+	snapshotPEID := astrolabe.NewProtectedEntityIDWithSnapshotID("psql", "db-uid", astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+	params := map[string]map[string]interface{}{"psql": {"compress": true}}
+	item := newTestItem("acid.zalan.do/v1", "postgresql")
+	if err := setSnapshotAnnotations(item, NewSnapshotRecord(snapshotPEID, params, "cluster-uid")); err != nil {
+		t.Fatalf("setSnapshotAnnotations failed with err %v", err)
+	}
+	if legacyID := item.GetAnnotations()[SnapshotIDAnnotation]; legacyID != snapshotPEID.String() {
+		t.Fatalf("expected %s annotation %s, got %s", SnapshotIDAnnotation, snapshotPEID.String(), legacyID)
+	}
+	record, found, err := getSnapshotRecord(item)
+	if err != nil || !found {
+		t.Fatalf("getSnapshotRecord returned found = %t, err = %v", found, err)
+	}
+	if record.SnapshotID != snapshotPEID.String() || record.PEType != "psql" || record.ClusterID != "cluster-uid" ||
+		record.Version != buildinfo.Version || record.FormatVersion != SnapshotRecordFormatVersion || record.TakenAt.IsZero() {
+		t.Fatalf("unexpected record %+v", record)
+	}
+	if compress, ok := record.Params["psql"]["compress"].(bool); !ok || !compress {
+		t.Fatalf("expected params to be recorded, got %v", record.Params)
+	}
+}
+
+func TestLegacySnapshotAnnotation(t *testing.T) {
+	snapshotPEID := astrolabe.NewProtectedEntityIDWithSnapshotID("psql", "db-uid", astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+	item := newTestItem("acid.zalan.do/v1", "postgresql")
+	item.SetAnnotations(map[string]string{SnapshotIDAnnotation: snapshotPEID.String()})
+	record, found, err := getSnapshotRecord(item)
+	if err != nil || !found {
+		t.Fatalf("getSnapshotRecord returned found = %t, err = %v", found, err)
+	}
+	if record.SnapshotID != snapshotPEID.String() || record.PEType != "psql" {
+		t.Fatalf("unexpected record %+v", record)
+	}
+	parsedPEID, found, err := getSnapshotAnnotation(item)
+	if err != nil || !found || parsedPEID.String() != snapshotPEID.String() {
+		t.Fatalf("getSnapshotAnnotation returned %s, found = %t, err = %v", parsedPEID.String(), found, err)
+	}
+
+	if _, found, err := getSnapshotRecord(newTestItem("v1", "ConfigMap")); err != nil || found {
+		t.Fatalf("expected no record on an item without annotations, got found = %t, err = %v", found, err)
+	}
+}
+
+func TestUnsupportedSnapshotAnnotationVersion(t *testing.T) {
+	snapshotPEID := astrolabe.NewProtectedEntityIDWithSnapshotID("psql", "db-uid", astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+	record := NewSnapshotRecord(snapshotPEID, nil, "")
+	record.FormatVersion = SnapshotRecordFormatVersion + 1
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("json.Marshal failed with err %v", err)
+	}
+	item := newTestItem("acid.zalan.do/v1", "postgresql")
+	item.SetAnnotations(map[string]string{SnapshotAnnotation: string(recordJSON)})
+	if _, _, err := getSnapshotRecord(item); err == nil {
+		t.Fatalf("expected a newer format version to be rejected")
+	}
+}
+
+func TestGetClusterID(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-system", UID: "cluster-uid"},
+	})
+	clusterID, err := GetClusterID(context.Background(), kubeClient)
+	if err != nil {
+		t.Fatalf("GetClusterID failed with err %v", err)
+	}
+	if clusterID != "cluster-uid" {
+		t.Fatalf("expected cluster ID cluster-uid, got %s", clusterID)
+	}
+}
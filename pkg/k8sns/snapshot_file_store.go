@@ -0,0 +1,108 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const snapshotFilesDirName = ".k8sns-files"
+
+// snapshotFileStore keeps the files that belong to a namespace snapshot but are not part of its data, such as the
+// metadata document, in a directory per snapshot under the snapshots directory
+type snapshotFileStore struct {
+	dir string
+}
+
+func newSnapshotFileStore(snapshotsDir string) (snapshotFileStore, error) {
+	dir := filepath.Join(snapshotsDir, snapshotFilesDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return snapshotFileStore{}, errors.Wrapf(err, "could not create snapshot files dir %s", dir)
+	}
+	return snapshotFileStore{
+		dir: dir,
+	}, nil
+}
+
+func (recv snapshotFileStore) snapshotDir(snapshotPEID astrolabe.ProtectedEntityID) string {
+	return filepath.Join(recv.dir, snapshotPEID.GetID(), snapshotPEID.GetSnapshotID().GetID())
+}
+
+// write stores the contents of reader as the file name of the snapshot
+func (recv snapshotFileStore) write(snapshotPEID astrolabe.ProtectedEntityID, name string, reader io.Reader) error {
+	if !snapshotPEID.HasSnapshot() {
+		return errors.New("pe " + snapshotPEID.String() + " is not a snapshot")
+	}
+	return writeFileAtomically(filepath.Join(recv.snapshotDir(snapshotPEID), name), reader)
+}
+
+// writeFileAtomically stores the contents of reader in the file at path, creating its dir if needed.  The file is
+// written to a temporary name first and renamed, so that a partially written file is never visible
+func writeFileAtomically(path string, reader io.Reader) error {
+	dir, name := filepath.Split(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "could not create dir %s", dir)
+	}
+	tmpFile, err := ioutil.TempFile(dir, "."+name+"-")
+	if err != nil {
+		return errors.Wrapf(err, "could not create temp file for %s", name)
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = io.Copy(tmpFile, reader)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not write %s", name)
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+func (recv snapshotFileStore) writeJSON(snapshotPEID astrolabe.ProtectedEntityID, name string, obj interface{}) error {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(json.NewEncoder(pipeWriter).Encode(obj))
+	}()
+	defer pipeReader.Close()
+	return recv.write(snapshotPEID, name, pipeReader)
+}
+
+// reader opens the file name of the snapshot.  If the file does not exist the returned error satisfies
+// os.IsNotExist
+func (recv snapshotFileStore) reader(snapshotPEID astrolabe.ProtectedEntityID, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(recv.snapshotDir(snapshotPEID), name))
+}
+
+func (recv snapshotFileStore) readJSON(snapshotPEID astrolabe.ProtectedEntityID, name string, obj interface{}) error {
+	reader, err := recv.reader(snapshotPEID, name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return json.NewDecoder(reader).Decode(obj)
+}
+
+// delete removes all of the files of the snapshot
+func (recv snapshotFileStore) delete(snapshotPEID astrolabe.ProtectedEntityID) error {
+	return os.RemoveAll(recv.snapshotDir(snapshotPEID))
+}
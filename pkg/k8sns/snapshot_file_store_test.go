@@ -0,0 +1,44 @@
+package k8sns
+
+import (
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSnapshotFileStore(t *testing.T) {
+	snapshotsDir, err := ioutil.TempDir("", "k8sns-snapshots")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(snapshotsDir)
+	store, err := newSnapshotFileStore(snapshotsDir)
+	if err != nil {
+		t.Fatalf("newSnapshotFileStore failed with %v", err)
+	}
+	snapshotPEID := astrolabe.NewProtectedEntityIDWithSnapshotID(Typename, "ns-uid", astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+
+	written := NamespaceMetadata{Version: NamespaceMetadataVersion, Name: "kibishii", Labels: map[string]string{"app": "kibishii"}}
+	if err := store.writeJSON(snapshotPEID, metadataFileName, written); err != nil {
+		t.Fatalf("writeJSON failed with %v", err)
+	}
+	read := NamespaceMetadata{}
+	if err := store.readJSON(snapshotPEID, metadataFileName, &read); err != nil {
+		t.Fatalf("readJSON failed with %v", err)
+	}
+	if read.Name != written.Name || read.Labels["app"] != "kibishii" {
+		t.Fatalf("Read metadata %v does not match written metadata %v", read, written)
+	}
+
+	if err := store.delete(snapshotPEID); err != nil {
+		t.Fatalf("delete failed with %v", err)
+	}
+	if _, err := store.reader(snapshotPEID, metadataFileName); !os.IsNotExist(err) {
+		t.Fatalf("Expected not exist error after delete, got %v", err)
+	}
+
+	if err := store.writeJSON(astrolabe.NewProtectedEntityID(Typename, "ns-uid"), metadataFileName, written); err == nil {
+		t.Fatalf("Expected error writing files for a pe that is not a snapshot")
+	}
+}
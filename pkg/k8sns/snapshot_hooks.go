@@ -0,0 +1,128 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"time"
+)
+
+// HooksParam is the k8sns Snapshot param that declares exec hooks, as a list of SnapshotHookSpec.
+//
+// Hooks can also be declared on the pods themselves with Velero's standard annotations,
+// pre.hook.backup.velero.io/command, pre.hook.backup.velero.io/container, pre.hook.backup.velero.io/on-error,
+// pre.hook.backup.velero.io/timeout and their post.hook.backup.velero.io equivalents.  As with Velero, when a pod
+// has hook annotations they are run instead of the hooks from the params
+const HooksParam = "hooks"
+
+const (
+	defaultHookTimeout = 30 * time.Second
+	defaultHookOnError = velerov1.HookErrorModeFail
+)
+
+// SnapshotHookSpec selects pods in the namespace and the commands that are run in them before and after they are
+// backed up
+type SnapshotHookSpec struct {
+	Name              string                `json:"name"`
+	IncludedResources []string              `json:"includedResources,omitempty"`
+	ExcludedResources []string              `json:"excludedResources,omitempty"`
+	LabelSelector     *metav1.LabelSelector `json:"labelSelector,omitempty"`
+	Pre               []SnapshotExecHook    `json:"pre,omitempty"`
+	Post              []SnapshotExecHook    `json:"post,omitempty"`
+}
+
+// SnapshotExecHook is a command run in a container of a selected pod.  Timeout defaults to 30s and OnError, which
+// is either Continue or Fail, defaults to Fail
+type SnapshotExecHook struct {
+	Container string                 `json:"container,omitempty"`
+	Command   []string               `json:"command"`
+	OnError   velerov1.HookErrorMode `json:"onError,omitempty"`
+	Timeout   metav1.Duration        `json:"timeout,omitempty"`
+}
+
+// parseSnapshotHooks decodes the hooks param and converts it into the hooks of a Velero Backup spec
+func parseSnapshotHooks(params map[string]map[string]interface{}) ([]velerov1.BackupResourceHookSpec, error) {
+	hookSpecs := []SnapshotHookSpec{}
+	found, err := decodeParam(params, HooksParam, &hookSpecs)
+	if err != nil || !found {
+		return nil, err
+	}
+	resourceHooks := make([]velerov1.BackupResourceHookSpec, 0, len(hookSpecs))
+	for i, hookSpec := range hookSpecs {
+		name := hookSpec.Name
+		if name == "" {
+			name = fmt.Sprintf("hook-%d", i)
+		}
+		preHooks, err := convertExecHooks(name, "pre", hookSpec.Pre)
+		if err != nil {
+			return nil, err
+		}
+		postHooks, err := convertExecHooks(name, "post", hookSpec.Post)
+		if err != nil {
+			return nil, err
+		}
+		if len(preHooks) == 0 && len(postHooks) == 0 {
+			return nil, errors.New(fmt.Sprintf("hook %s has no pre or post hooks", name))
+		}
+		resourceHooks = append(resourceHooks, velerov1.BackupResourceHookSpec{
+			Name:              name,
+			IncludedResources: hookSpec.IncludedResources,
+			ExcludedResources: hookSpec.ExcludedResources,
+			LabelSelector:     hookSpec.LabelSelector,
+			PreHooks:          preHooks,
+			PostHooks:         postHooks,
+		})
+	}
+	return resourceHooks, nil
+}
+
+func convertExecHooks(name string, phase string, execHooks []SnapshotExecHook) ([]velerov1.BackupResourceHook, error) {
+	resourceHooks := make([]velerov1.BackupResourceHook, 0, len(execHooks))
+	for i, execHook := range execHooks {
+		if len(execHook.Command) == 0 {
+			return nil, errors.New(fmt.Sprintf("%s hook %d of %s has no command", phase, i, name))
+		}
+		onError := execHook.OnError
+		switch onError {
+		case "":
+			onError = defaultHookOnError
+		case velerov1.HookErrorModeContinue, velerov1.HookErrorModeFail:
+		default:
+			return nil, errors.New(fmt.Sprintf("%s hook %d of %s has invalid onError %q, must be %s or %s", phase, i,
+				name, onError, velerov1.HookErrorModeContinue, velerov1.HookErrorModeFail))
+		}
+		timeout := execHook.Timeout
+		if timeout.Duration < 0 {
+			return nil, errors.New(fmt.Sprintf("%s hook %d of %s has negative timeout", phase, i, name))
+		}
+		if timeout.Duration == 0 {
+			timeout.Duration = defaultHookTimeout
+		}
+		resourceHooks = append(resourceHooks, velerov1.BackupResourceHook{
+			Exec: &velerov1.ExecHook{
+				Container: execHook.Container,
+				Command:   execHook.Command,
+				OnError:   onError,
+				Timeout:   timeout,
+			},
+		})
+	}
+	return resourceHooks, nil
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"io/ioutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const snapshotIndexFileName = "snapshot-index.json"
+
+// SnapshotIndexEntry records the component snapshot taken for an item of a backup
+type SnapshotIndexEntry struct {
+	BackupUID  string    `json:"backupUID"`
+	ItemUID    string    `json:"itemUID"`
+	SnapshotID string    `json:"snapshotID"`
+	TakenAt    time.Time `json:"takenAt"`
+}
+
+// SnapshotIndex maps backup UID plus item UID to the component snapshot taken for the item, so that a retried backup
+// reuses the snapshot instead of taking a duplicate.  The index is kept in a JSON file so that it survives a restart.
+// The file is read on every call, as the plugin processes Velero starts share it, and it is kept small by dropping
+// the entries of a backup once its snapshots are stored, deleted or discarded
+type SnapshotIndex struct {
+	path   string
+	mutex  sync.Mutex
+	logger logrus.FieldLogger
+}
+
+func NewSnapshotIndex(path string, logger logrus.FieldLogger) *SnapshotIndex {
+	return &SnapshotIndex{
+		path:   path,
+		logger: logger,
+	}
+}
+
+// GetOrSnapshot returns the snapshot recorded for backupUID and itemUID if it still exists.  Otherwise snapshot is
+// called and the snapshot it returns is recorded.  reused is true when an existing snapshot was returned.  The index
+// is not locked while snapshot runs, so that snapshots of different items can be taken concurrently.  A snapshot that
+// cannot be recorded is deleted again, as nothing else would refer to it
+func (recv *SnapshotIndex) GetOrSnapshot(ctx context.Context, pem astrolabe.ProtectedEntityManager, backupUID string, itemUID string,
+	snapshot func() (astrolabe.ProtectedEntityID, error)) (snapshotPEID astrolabe.ProtectedEntityID, reused bool, err error) {
+	snapshotPEID, found, err := recv.lookup(ctx, pem, backupUID, itemUID)
+	if err != nil || found {
+		return snapshotPEID, found, err
+	}
+	snapshotPEID, err = snapshot()
+	if err != nil {
+		return astrolabe.ProtectedEntityID{}, false, err
+	}
+	err = recv.record(SnapshotIndexEntry{
+		BackupUID:  backupUID,
+		ItemUID:    itemUID,
+		SnapshotID: snapshotPEID.String(),
+		TakenAt:    time.Now().UTC(),
+	})
+	if err != nil {
+		if deleteErr := deleteComponentSnapshot(ctx, pem, snapshotPEID.String()); deleteErr != nil {
+			recv.logger.WithError(deleteErr).Errorf("Could not delete unrecorded component snapshot %s", snapshotPEID.String())
+		}
+		return astrolabe.ProtectedEntityID{}, false, errors.Wrapf(err, "Took component snapshot %s but could not record it",
+			snapshotPEID.String())
+	}
+	return snapshotPEID, false, nil
+}
+
+// lookup returns the snapshot recorded for backupUID and itemUID if it still exists.  found is only false for a
+// recorded snapshot that is not found, any other error retrieving it is returned so that a transient failure does not
+// lead to a duplicate snapshot
+func (recv *SnapshotIndex) lookup(ctx context.Context, pem astrolabe.ProtectedEntityManager, backupUID string,
+	itemUID string) (astrolabe.ProtectedEntityID, bool, error) {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	entries, err := recv.load()
+	if err != nil {
+		return astrolabe.ProtectedEntityID{}, false, err
+	}
+	for _, entry := range entries {
+		if entry.BackupUID != backupUID || entry.ItemUID != itemUID {
+			continue
+		}
+		existingPEID, err := astrolabe.NewProtectedEntityIDFromString(entry.SnapshotID)
+		if err != nil {
+			recv.logger.WithError(err).Warnf("Invalid component snapshot %s recorded for backup %s, item %s, taking a new snapshot",
+				entry.SnapshotID, backupUID, itemUID)
+			continue
+		}
+		_, err = pem.GetProtectedEntity(ctx, existingPEID)
+		if err == nil {
+			return existingPEID, true, nil
+		}
+		if !apierrors.IsNotFound(errors.Cause(err)) {
+			return astrolabe.ProtectedEntityID{}, false, errors.Wrapf(err, "Could not check component snapshot %s recorded for backup %s, item %s",
+				entry.SnapshotID, backupUID, itemUID)
+		}
+		recv.logger.WithError(err).Warnf("Component snapshot %s recorded for backup %s, item %s is gone, taking a new snapshot",
+			entry.SnapshotID, backupUID, itemUID)
+	}
+	return astrolabe.ProtectedEntityID{}, false, nil
+}
+
+// record adds entry to the index, replacing any entry for the same backup and item
+func (recv *SnapshotIndex) record(entry SnapshotIndexEntry) error {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	entries, err := recv.load()
+	if err != nil {
+		return err
+	}
+	remaining := []SnapshotIndexEntry{}
+	for _, existing := range entries {
+		if existing.BackupUID != entry.BackupUID || existing.ItemUID != entry.ItemUID {
+			remaining = append(remaining, existing)
+		}
+	}
+	return recv.save(append(remaining, entry))
+}
+
+// Remove drops the entry for backupUID and itemUID, once the snapshot has been deleted with its backup
+func (recv *SnapshotIndex) Remove(backupUID string, itemUID string) error {
+	return recv.removeWhere(func(entry SnapshotIndexEntry) bool {
+		return entry.BackupUID == backupUID && entry.ItemUID == itemUID
+	})
+}
+
+// RemoveSnapshot drops the entries recording the component snapshot snapshotID, once it has been deleted
+func (recv *SnapshotIndex) RemoveSnapshot(snapshotID string) error {
+	return recv.removeWhere(func(entry SnapshotIndexEntry) bool {
+		return entry.SnapshotID == snapshotID
+	})
+}
+
+// RemoveForBackup drops the entries of backupUID, once the backup has been stored or deleted and will not be retried
+func (recv *SnapshotIndex) RemoveForBackup(backupUID string) error {
+	return recv.removeWhere(func(entry SnapshotIndexEntry) bool {
+		return entry.BackupUID == backupUID
+	})
+}
+
+// Discard deletes the component snapshots recorded for backupUID, which failed, and drops their entries.  All of the
+// snapshots are attempted, those that could not be deleted are returned in a ComponentDeleteError
+func (recv *SnapshotIndex) Discard(ctx context.Context, backupUID string, pem astrolabe.ProtectedEntityManager) error {
+	entries, err := recv.Entries()
+	if err != nil {
+		return err
+	}
+	failed := map[string]error{}
+	for _, entry := range entries {
+		if entry.BackupUID != backupUID {
+			continue
+		}
+		recv.logger.Infof("Deleting component snapshot %s of discarded backup %s", entry.SnapshotID, backupUID)
+		if err := deleteComponentSnapshot(ctx, pem, entry.SnapshotID); err != nil {
+			failed[entry.SnapshotID] = err
+		}
+	}
+	if err := recv.RemoveForBackup(backupUID); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return ComponentDeleteError{Failed: failed}
+	}
+	return nil
+}
+
+// removeWhere drops the entries that remove returns true for
+func (recv *SnapshotIndex) removeWhere(remove func(entry SnapshotIndexEntry) bool) error {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	entries, err := recv.load()
+	if err != nil {
+		return err
+	}
+	remaining := []SnapshotIndexEntry{}
+	for _, entry := range entries {
+		if !remove(entry) {
+			remaining = append(remaining, entry)
+		}
+	}
+	if len(remaining) == len(entries) {
+		return nil
+	}
+	return recv.save(remaining)
+}
+
+// Entries returns the recorded snapshots
+func (recv *SnapshotIndex) Entries() ([]SnapshotIndexEntry, error) {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	return recv.load()
+}
+
+func (recv *SnapshotIndex) load() ([]SnapshotIndexEntry, error) {
+	entries := []SnapshotIndexEntry{}
+	data, err := ioutil.ReadFile(recv.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, errors.Wrapf(err, "could not read snapshot index from %s", recv.path)
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Wrapf(err, "could not parse snapshot index in %s", recv.path)
+	}
+	return entries, nil
+}
+
+func (recv *SnapshotIndex) save(entries []SnapshotIndexEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not marshal snapshot index")
+	}
+	return writeFileAtomically(recv.path, bytes.NewReader(data))
+}
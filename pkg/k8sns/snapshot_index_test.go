@@ -0,0 +1,125 @@
+package k8sns
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-index")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	pe := &deletablePE{}
+	pem := deletablePEM{pe: pe}
+	index := NewSnapshotIndex(filepath.Join(dir, snapshotIndexFileName), logrus.New())
+	snapshots := 0
+	snapshot := func() (astrolabe.ProtectedEntityID, error) {
+		snapshots++
+		return astrolabe.NewProtectedEntityIDWithSnapshotID("psql", "db-uid",
+			astrolabe.NewProtectedEntitySnapshotID("snap-"+string(rune('0'+snapshots)))), nil
+	}
+
+	first, reused, err := index.GetOrSnapshot(ctx, pem, "backup-1", "item-1", snapshot)
+	if err != nil || reused {
+		t.Fatalf("GetOrSnapshot returned %v, %v", reused, err)
+	}
+	second, reused, err := index.GetOrSnapshot(ctx, pem, "backup-1", "item-1", snapshot)
+	if err != nil || !reused || second != first || snapshots != 1 {
+		t.Fatalf("expected %s to be reused, got %s, %v after %d snapshots, err %v", first.String(), second.String(), reused,
+			snapshots, err)
+	}
+	// The recorded snapshot is gone, so a new one is taken
+	third, reused, err := index.GetOrSnapshot(ctx, deletablePEM{}, "backup-1", "item-1", snapshot)
+	if err != nil || reused || third == first {
+		t.Fatalf("expected a new snapshot, got %s, %v, err %v", third.String(), reused, err)
+	}
+	if _, _, err := index.GetOrSnapshot(ctx, pem, "backup-2", "item-1", snapshot); err != nil {
+		t.Fatalf("GetOrSnapshot failed with err %v", err)
+	}
+
+	if err := index.RemoveSnapshot(third.String()); err != nil {
+		t.Fatalf("RemoveSnapshot failed with err %v", err)
+	}
+	entries, err := index.Entries()
+	if err != nil || len(entries) != 1 || entries[0].BackupUID != "backup-2" {
+		t.Fatalf("expected only the entry of backup-2, got %v, %v", entries, err)
+	}
+	if err := index.RemoveForBackup("backup-2"); err != nil {
+		t.Fatalf("RemoveForBackup failed with err %v", err)
+	}
+	entries, err = index.Entries()
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected no entries, got %v, %v", entries, err)
+	}
+}
+
+func TestSnapshotIndexDeletesUnrecordedSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-index")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	pe := &deletablePE{}
+	index := NewSnapshotIndex(filepath.Join(dir, "index", snapshotIndexFileName), logrus.New())
+	snapshotPEID := astrolabe.NewProtectedEntityIDWithSnapshotID("psql", "db-uid", astrolabe.NewProtectedEntitySnapshotID("snap-1"))
+	_, _, err = index.GetOrSnapshot(context.Background(), deletablePEM{pe: pe}, "backup-1", "item-1",
+		func() (astrolabe.ProtectedEntityID, error) {
+			// A file in place of its directory stops the index from being written
+			return snapshotPEID, ioutil.WriteFile(filepath.Join(dir, "index"), []byte{}, 0600)
+		})
+	if err == nil {
+		t.Fatalf("expected GetOrSnapshot to fail when the snapshot cannot be recorded")
+	}
+	if len(pe.deleted) != 1 || pe.deleted[0] != snapshotPEID.GetSnapshotID() {
+		t.Fatalf("expected the unrecorded snapshot to be deleted, got %v", pe.deleted)
+	}
+}
+
+func TestSnapshotIndexDiscard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-index")
+	if err != nil {
+		t.Fatalf("TempDir failed with err %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	pe := &deletablePE{failures: 1}
+	pem := deletablePEM{pe: pe}
+	index := NewSnapshotIndex(filepath.Join(dir, snapshotIndexFileName), logrus.New())
+	for _, id := range []string{"snap-1", "snap-2"} {
+		snapshotPEID := astrolabe.NewProtectedEntityIDWithSnapshotID("psql", id, astrolabe.NewProtectedEntitySnapshotID(id))
+		_, _, err := index.GetOrSnapshot(ctx, pem, "failed-backup", id, func() (astrolabe.ProtectedEntityID, error) {
+			return snapshotPEID, nil
+		})
+		if err != nil {
+			t.Fatalf("GetOrSnapshot failed with err %v", err)
+		}
+	}
+	_, _, err = index.GetOrSnapshot(ctx, pem, "other-backup", "item-1", func() (astrolabe.ProtectedEntityID, error) {
+		return astrolabe.NewProtectedEntityIDWithSnapshotID("psql", "db-uid", astrolabe.NewProtectedEntitySnapshotID("snap-3")), nil
+	})
+	if err != nil {
+		t.Fatalf("GetOrSnapshot failed with err %v", err)
+	}
+
+	err = index.Discard(ctx, "failed-backup", pem)
+	deleteErr, ok := errors.Cause(err).(ComponentDeleteError)
+	if !ok || len(deleteErr.Failed) != 1 {
+		t.Fatalf("expected one failed delete, got %v", err)
+	}
+	if pe.attempts != 2 || len(pe.deleted) != 1 {
+		t.Fatalf("expected both snapshots of the backup to be attempted, got %d attempts, %v deleted", pe.attempts, pe.deleted)
+	}
+	entries, err := index.Entries()
+	if err != nil || len(entries) != 1 || entries[0].BackupUID != "other-backup" {
+		t.Fatalf("expected only the entry of other-backup to be kept, got %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	velerov1 "github.com/vmware-tanzu/velero/pkg/apis/velero/v1"
+	"github.com/vmware-tanzu/velero/pkg/builder"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// k8sns params accepted by Snapshot.  IncludedResourcesParam, ExcludedResourcesParam and LabelSelectorParam are
+// accepted by Copy and Overwrite as well, to select what is restored
+const (
+	// IncludedResourcesParam lists the resources to back up, e.g. ["deployments.apps", "configmaps"]
+	IncludedResourcesParam = "includedResources"
+	// ExcludedResourcesParam lists the resources that are not backed up, e.g. ["events", "endpoints"]
+	ExcludedResourcesParam = "excludedResources"
+	// LabelSelectorParam selects the items to back up, either as a selector string such as "app=web,tier in (frontend,api)"
+	// or as a metav1.LabelSelector
+	LabelSelectorParam = "labelSelector"
+	// IncludeClusterResourcesParam controls whether cluster scoped resources used by the namespace are backed up
+	IncludeClusterResourcesParam = "includeClusterResources"
+	// OrderedResourcesParam maps a resource to the order its items are backed up in, as "ns/name,ns/name"
+	OrderedResourcesParam = "orderedResources"
+)
+
+// snapshotParams holds the k8sns Snapshot params that map onto the Velero Backup spec
+type snapshotParams struct {
+	includedResources       []string
+	excludedResources       []string
+	labelSelector           *metav1.LabelSelector
+	includeClusterResources *bool
+	orderedResources        map[string]string
+	hooks                   []velerov1.BackupResourceHookSpec
+	// defaultVolumesToFsBackup overrides the DefaultVolumesToFsBackupAnnotation on the namespace when set
+	defaultVolumesToFsBackup *bool
+}
+
+func parseSnapshotParams(params map[string]map[string]interface{}) (snapshotParams, error) {
+	returnParams := snapshotParams{}
+	var err error
+	returnParams.includedResources, err = getStringSliceParam(params, IncludedResourcesParam)
+	if err != nil {
+		return snapshotParams{}, err
+	}
+	returnParams.excludedResources, err = getStringSliceParam(params, ExcludedResourcesParam)
+	if err != nil {
+		return snapshotParams{}, err
+	}
+	returnParams.labelSelector, err = getLabelSelectorParam(params, LabelSelectorParam)
+	if err != nil {
+		return snapshotParams{}, err
+	}
+	if _, ok := params[Typename][IncludeClusterResourcesParam]; ok {
+		includeClusterResources, err := getBoolParam(params, IncludeClusterResourcesParam)
+		if err != nil {
+			return snapshotParams{}, err
+		}
+		returnParams.includeClusterResources = &includeClusterResources
+	}
+	if _, ok := params[Typename][DefaultVolumesToFsBackupParam]; ok {
+		defaultVolumesToFsBackup, err := getBoolParam(params, DefaultVolumesToFsBackupParam)
+		if err != nil {
+			return snapshotParams{}, err
+		}
+		returnParams.defaultVolumesToFsBackup = &defaultVolumesToFsBackup
+	}
+	orderedResources := map[string]string{}
+	_, err = decodeParam(params, OrderedResourcesParam, &orderedResources)
+	if err != nil {
+		return snapshotParams{}, err
+	}
+	if len(orderedResources) > 0 {
+		returnParams.orderedResources = orderedResources
+	}
+	returnParams.hooks, err = parseSnapshotHooks(params)
+	if err != nil {
+		return snapshotParams{}, err
+	}
+	return returnParams, nil
+}
+
+func getLabelSelectorParam(params map[string]map[string]interface{}, key string) (*metav1.LabelSelector, error) {
+	valueObj, ok := params[Typename][key]
+	if !ok || valueObj == nil {
+		return nil, nil
+	}
+	if selectorString, ok := valueObj.(string); ok {
+		if selectorString == "" {
+			return nil, nil
+		}
+		selector, err := metav1.ParseToLabelSelector(selectorString)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s param %q", key, selectorString)
+		}
+		return selector, nil
+	}
+	selector := &metav1.LabelSelector{}
+	if _, err := decodeParam(params, key, selector); err != nil {
+		return nil, err
+	}
+	if _, err := metav1.LabelSelectorAsSelector(selector); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s param", key)
+	}
+	return selector, nil
+}
+
+// applyTo sets the params on the Velero Backup being built
+func (recv snapshotParams) applyTo(backupBuilder *builder.BackupBuilder) *builder.BackupBuilder {
+	if len(recv.includedResources) > 0 {
+		backupBuilder = backupBuilder.IncludedResources(recv.includedResources...)
+	}
+	if len(recv.excludedResources) > 0 {
+		backupBuilder = backupBuilder.ExcludedResources(recv.excludedResources...)
+	}
+	if recv.labelSelector != nil {
+		backupBuilder = backupBuilder.LabelSelector(recv.labelSelector)
+	}
+	if recv.includeClusterResources != nil {
+		backupBuilder = backupBuilder.IncludeClusterResources(*recv.includeClusterResources)
+	}
+	if recv.orderedResources != nil {
+		backupBuilder = backupBuilder.OrderedResources(recv.orderedResources)
+	}
+	if len(recv.hooks) > 0 {
+		backupBuilder = backupBuilder.Hooks(velerov1.BackupHooks{Resources: recv.hooks})
+	}
+	return backupBuilder
+}
+
+func (recv snapshotParams) String() string {
+	return fmt.Sprintf("included=%v excluded=%v labelSelector=%v includeClusterResources=%v orderedResources=%v hooks=%d defaultVolumesToFsBackup=%v",
+		recv.includedResources, recv.excludedResources, metav1.FormatLabelSelector(recv.labelSelector),
+		recv.includeClusterResources, recv.orderedResources, len(recv.hooks), recv.defaultVolumesToFsBackup)
+}
@@ -0,0 +1,120 @@
+package k8sns
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSnapshotParams(t *testing.T) {
+	params := map[string]map[string]interface{}{
+		Typename: {
+			IncludedResourcesParam:       []interface{}{"deployments.apps", "configmaps"},
+			ExcludedResourcesParam:       "events, endpoints",
+			LabelSelectorParam:           "app=web,tier in (frontend,api)",
+			IncludeClusterResourcesParam: "false",
+			OrderedResourcesParam:        map[string]interface{}{"pods": "ns1/pod1,ns1/pod2"},
+		},
+	}
+	parsed, err := parseSnapshotParams(params)
+	if err != nil {
+		t.Fatalf("parseSnapshotParams failed with %v", err)
+	}
+	if !reflect.DeepEqual(parsed.includedResources, []string{"deployments.apps", "configmaps"}) {
+		t.Errorf("Unexpected included resources %v", parsed.includedResources)
+	}
+	if !reflect.DeepEqual(parsed.excludedResources, []string{"events", "endpoints"}) {
+		t.Errorf("Unexpected excluded resources %v", parsed.excludedResources)
+	}
+	if parsed.labelSelector == nil || parsed.labelSelector.MatchLabels["app"] != "web" || len(parsed.labelSelector.MatchExpressions) != 1 {
+		t.Errorf("Unexpected label selector %v", parsed.labelSelector)
+	}
+	if parsed.includeClusterResources == nil || *parsed.includeClusterResources {
+		t.Errorf("Expected includeClusterResources to be false, got %v", parsed.includeClusterResources)
+	}
+	if parsed.orderedResources["pods"] != "ns1/pod1,ns1/pod2" {
+		t.Errorf("Unexpected ordered resources %v", parsed.orderedResources)
+	}
+
+	empty, err := parseSnapshotParams(map[string]map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("parseSnapshotParams with no params failed with %v", err)
+	}
+	if !reflect.DeepEqual(empty, snapshotParams{}) {
+		t.Errorf("Expected empty params, got %v", empty)
+	}
+
+	structuredSelector := map[string]map[string]interface{}{
+		Typename: {
+			LabelSelectorParam: map[string]interface{}{"matchLabels": map[string]interface{}{"app": "db"}},
+		},
+	}
+	parsed, err = parseSnapshotParams(structuredSelector)
+	if err != nil {
+		t.Fatalf("parseSnapshotParams with structured selector failed with %v", err)
+	}
+	if parsed.labelSelector.MatchLabels["app"] != "db" {
+		t.Errorf("Unexpected label selector %v", parsed.labelSelector)
+	}
+
+	badSelector := map[string]map[string]interface{}{Typename: {LabelSelectorParam: "app in"}}
+	if _, err := parseSnapshotParams(badSelector); err == nil {
+		t.Errorf("Expected error for invalid label selector")
+	}
+}
+
+func TestParseSnapshotHooks(t *testing.T) {
+	params := map[string]map[string]interface{}{
+		Typename: {
+			HooksParam: []interface{}{
+				map[string]interface{}{
+					"name":          "flush-cache",
+					"labelSelector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "web"}},
+					"pre": []interface{}{
+						map[string]interface{}{
+							"container": "web",
+							"command":   []interface{}{"/bin/sh", "-c", "flush"},
+							"timeout":   "2m",
+						},
+					},
+					"post": []interface{}{
+						map[string]interface{}{
+							"command": []interface{}{"resume"},
+							"onError": "Continue",
+						},
+					},
+				},
+			},
+		},
+	}
+	hooks, err := parseSnapshotHooks(params)
+	if err != nil {
+		t.Fatalf("parseSnapshotHooks failed with %v", err)
+	}
+	if len(hooks) != 1 || len(hooks[0].PreHooks) != 1 || len(hooks[0].PostHooks) != 1 {
+		t.Fatalf("Unexpected hooks %v", hooks)
+	}
+	pre := hooks[0].PreHooks[0].Exec
+	if pre.Container != "web" || pre.Timeout.Duration.String() != "2m0s" || pre.OnError != defaultHookOnError {
+		t.Errorf("Unexpected pre hook %v", pre)
+	}
+	post := hooks[0].PostHooks[0].Exec
+	if post.Timeout.Duration != defaultHookTimeout || post.OnError != "Continue" {
+		t.Errorf("Unexpected post hook %v", post)
+	}
+	if hooks[0].LabelSelector.MatchLabels["app"] != "web" {
+		t.Errorf("Unexpected label selector %v", hooks[0].LabelSelector)
+	}
+
+	badOnError := map[string]map[string]interface{}{
+		Typename: {
+			HooksParam: []interface{}{
+				map[string]interface{}{
+					"pre": []interface{}{map[string]interface{}{"command": []interface{}{"true"}, "onError": "Ignore"}},
+				},
+			},
+		},
+	}
+	if _, err := parseSnapshotHooks(badOnError); err == nil {
+		t.Errorf("Expected error for invalid onError")
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/vmware-tanzu/astrolabe/gen/models"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"io"
+	"io/ioutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"os"
+	"sync"
+	"time"
+)
+
+const statsFileName = "stats.json"
+
+// SnapshotStats describes the stored data of a namespace snapshot
+type SnapshotStats struct {
+	// CompressedBytes is the size of the snapshot tarball as stored in the snapshot repository
+	CompressedBytes int64 `json:"compressedBytes"`
+	// UncompressedBytes is the size of the tar stream inside the snapshot tarball
+	UncompressedBytes int64 `json:"uncompressedBytes"`
+	// ItemCount is the number of Kubernetes items in the snapshot
+	ItemCount int `json:"itemCount"`
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (recv *countingReader) Read(p []byte) (int, error) {
+	n, err := recv.reader.Read(p)
+	recv.count += int64(n)
+	return n, err
+}
+
+// computeSnapshotStats reads back the tarball stored for the snapshot and measures it, along with the inventory of the
+// namespaced resources in it
+func (recv *KubernetesNamespaceProtectedEntityTypeManager) computeSnapshotStats(snapshotPEID astrolabe.ProtectedEntityID) (SnapshotStats, []ResourceCount, error) {
+	dataReader, err := recv.internalRepo.GetDataReaderForSnapshot(snapshotPEID)
+	if err != nil {
+		return SnapshotStats{}, nil, errors.Wrapf(err, "Could not retrieve reader for snapshot %s", snapshotPEID.String())
+	}
+	defer dataReader.Close()
+	return measureSnapshotTarball(dataReader)
+}
+
+// measureSnapshotTarball measures the gzipped snapshot tarball read from dataReader and counts the items of each
+// namespaced resource in it
+func measureSnapshotTarball(dataReader io.Reader) (SnapshotStats, []ResourceCount, error) {
+	compressed := &countingReader{reader: dataReader}
+	gzipReader, err := gzip.NewReader(compressed)
+	if err != nil {
+		return SnapshotStats{}, nil, errors.Wrap(err, "Could not open snapshot tarball")
+	}
+	defer gzipReader.Close()
+	uncompressed := &countingReader{reader: gzipReader}
+	tarReader := tar.NewReader(uncompressed)
+	itemCount := 0
+	counts := map[schema.GroupVersionResource]*ResourceCount{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return SnapshotStats{}, nil, errors.Wrap(err, "Could not read snapshot tarball")
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		groupResource, namespace, _, ok := parseItemPath(header.Name)
+		if !ok {
+			continue
+		}
+		itemCount++
+		if namespace == "" {
+			continue
+		}
+		typeMeta := metav1.TypeMeta{}
+		if err := json.NewDecoder(tarReader).Decode(&typeMeta); err != nil {
+			return SnapshotStats{}, nil, errors.Wrapf(err, "Could not decode %s from snapshot tarball", header.Name)
+		}
+		gv, err := schema.ParseGroupVersion(typeMeta.APIVersion)
+		if err != nil {
+			return SnapshotStats{}, nil, errors.Wrapf(err, "Invalid apiVersion of %s in snapshot tarball", header.Name)
+		}
+		gvr := groupResource.WithVersion(gv.Version)
+		if counts[gvr] == nil {
+			counts[gvr] = &ResourceCount{Group: gvr.Group, Version: gvr.Version, Resource: gvr.Resource}
+		}
+		counts[gvr].Count++
+		counts[gvr].Bytes += header.Size
+	}
+	// Drain any trailing data so the byte counts cover the whole stream
+	if _, err := io.Copy(ioutil.Discard, uncompressed); err != nil {
+		return SnapshotStats{}, nil, errors.Wrap(err, "Could not read snapshot tarball")
+	}
+	inventory := []ResourceCount{}
+	for _, count := range counts {
+		inventory = append(inventory, *count)
+	}
+	sortInventory(inventory)
+	return SnapshotStats{
+		CompressedBytes:   compressed.count,
+		UncompressedBytes: uncompressed.count,
+		ItemCount:         itemCount,
+	}, inventory, nil
+}
+
+// isItemPath returns true for the paths Velero stores items under, resources/<resource>/namespaces/<ns>/<name>.json
+// and resources/<resource>/cluster/<name>.json.  Copies of items stored under API version directories are not counted
+func isItemPath(path string) bool {
+	_, _, _, ok := parseItemPath(path)
+	return ok
+}
+
+// GetSnapshotStats returns the stored sizes and item count of a snapshot PE
+func (recv *KubernetesNamespaceProtectedEntity) GetSnapshotStats(ctx context.Context) (SnapshotStats, error) {
+	if !recv.id.HasSnapshot() {
+		return SnapshotStats{}, errors.New("pe " + recv.id.String() + " is not a snapshot")
+	}
+	stats := SnapshotStats{}
+	err := recv.petm.snapshotFiles.readJSON(recv.id, statsFileName, &stats)
+	if err != nil {
+		return SnapshotStats{}, errors.Wrapf(err, "Could not read stats for snapshot %s", recv.id.String())
+	}
+	return stats, nil
+}
+
+// NamespaceProtectedEntityInfo is the ProtectedEntityInfo returned by namespace PEs.  For snapshots it carries the
+// stats stored with the snapshot as well
+type NamespaceProtectedEntityInfo struct {
+	astrolabe.ProtectedEntityInfo
+	stats *SnapshotStats
+}
+
+// GetSnapshotStats returns the stats of the snapshot, or nil for a live namespace or a snapshot without stats
+func (recv NamespaceProtectedEntityInfo) GetSnapshotStats() *SnapshotStats {
+	return recv.stats
+}
+
+func (recv NamespaceProtectedEntityInfo) MarshalJSON() ([]byte, error) {
+	jsonStruct := struct {
+		models.ProtectedEntityInfo
+		SnapshotStats *SnapshotStats `json:"snapshotStats,omitempty"`
+	}{
+		ProtectedEntityInfo: recv.GetModelProtectedEntityInfo(),
+		SnapshotStats:       recv.stats,
+	}
+	jsonStruct.Size = recv.GetSize()
+	return json.Marshal(jsonStruct)
+}
+
+// getStoredStats returns the stats stored with a snapshot, or nil if the snapshot has none
+func (recv *KubernetesNamespaceProtectedEntity) getStoredStats(ctx context.Context) (*SnapshotStats, error) {
+	stats, err := recv.GetSnapshotStats(ctx)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// EstimateLiveSize estimates the size of a live namespace from the size of its items.  Every namespaced resource in
+// the namespace is listed, GetInfo reports the estimate cached by getLiveSize instead
+func (recv *KubernetesNamespaceProtectedEntity) EstimateLiveSize(ctx context.Context) (int64, error) {
+	if recv.id.HasSnapshot() {
+		return -1, errors.New("pe " + recv.id.String() + " is a snapshot, use GetSnapshotStats")
+	}
+	inventory, _, err := recv.getResourceInventory(ctx)
+	if err != nil {
+		return -1, err
+	}
+	var size int64
+	for _, resourceCount := range inventory {
+		size += resourceCount.Bytes
+	}
+	return size, nil
+}
+
+// getLiveSize returns the size estimate of a live namespace, reusing the estimate cached by the type manager while it
+// is fresh
+func (recv *KubernetesNamespaceProtectedEntity) getLiveSize(ctx context.Context) (int64, error) {
+	if recv.petm.liveSizes == nil {
+		return recv.EstimateLiveSize(ctx)
+	}
+	return recv.petm.liveSizes.get(recv.id.String(), func() (int64, error) {
+		return recv.EstimateLiveSize(ctx)
+	})
+}
+
+const defaultLiveSizeTTL = 5 * time.Minute
+
+type liveSizeEstimate struct {
+	size        int64
+	estimatedAt time.Time
+}
+
+// liveSizeCache caches the size estimates of live namespaces for ttl, as each estimate lists the whole namespace
+type liveSizeCache struct {
+	ttl       time.Duration
+	mutex     sync.Mutex
+	estimates map[string]liveSizeEstimate
+}
+
+func newLiveSizeCache(ttl time.Duration) *liveSizeCache {
+	return &liveSizeCache{
+		ttl:       ttl,
+		estimates: map[string]liveSizeEstimate{},
+	}
+}
+
+// get returns the cached estimate for key, calling estimate if there is none or it is older than the ttl.  Failed
+// estimates are not cached
+func (recv *liveSizeCache) get(key string, estimate func() (int64, error)) (int64, error) {
+	recv.mutex.Lock()
+	cached, ok := recv.estimates[key]
+	recv.mutex.Unlock()
+	if ok && time.Since(cached.estimatedAt) < recv.ttl {
+		return cached.size, nil
+	}
+	size, err := estimate()
+	if err != nil {
+		return -1, err
+	}
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	recv.estimates[key] = liveSizeEstimate{size: size, estimatedAt: time.Now()}
+	return size, nil
+}
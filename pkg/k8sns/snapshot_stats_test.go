@@ -0,0 +1,120 @@
+package k8sns
+
+import (
+	"github.com/pkg/errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIsItemPath(t *testing.T) {
+	tests := map[string]bool{
+		"resources/configmaps/namespaces/test/a.json":                             true,
+		"/resources/configmaps/namespaces/test/a.json":                            true,
+		"resources/namespaces/cluster/test.json":                                  true,
+		"resources/statefulsets.apps/namespaces/test/db.json":                     true,
+		"resources/configmaps/v1-preferredversion/namespaces/test/a.json":         false,
+		"resources/statefulsets.apps/v1-preferredversion/namespaces/test/db.json": false,
+		"resources/namespaces/v1-preferredversion/cluster/test.json":              false,
+		"resources/configmaps/namespaces/test":                                    false,
+		"resources/configmaps/namespaces/test/a.yaml":                             false,
+		"metadata/version":  false,
+		podVolumesIndexPath: false,
+	}
+	for path, expected := range tests {
+		if isItemPath(path) != expected {
+			t.Fatalf("expected isItemPath(%s) to be %t", path, expected)
+		}
+	}
+}
+
+func TestMeasureSnapshotTarball(t *testing.T) {
+	configMap := `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"a"}}`
+	statefulSet := `{"apiVersion":"apps/v1","kind":"StatefulSet","metadata":{"name":"db"}}`
+	namespace := `{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"test"}}`
+	tests := []struct {
+		name              string
+		entries           map[string]string
+		expectedItems     int
+		expectedInventory []ResourceCount
+	}{
+		{
+			name:              "empty",
+			entries:           map[string]string{"metadata/version": "1"},
+			expectedInventory: []ResourceCount{},
+		},
+		{
+			name: "preferred version copies",
+			entries: map[string]string{
+				"resources/configmaps/namespaces/test/a.json":                             configMap,
+				"resources/configmaps/v1-preferredversion/namespaces/test/a.json":         configMap,
+				"resources/configmaps/namespaces/test/b.json":                             configMap,
+				"resources/configmaps/v1-preferredversion/namespaces/test/b.json":         configMap,
+				"resources/statefulsets.apps/namespaces/test/db.json":                     statefulSet,
+				"resources/statefulsets.apps/v1-preferredversion/namespaces/test/db.json": statefulSet,
+				"resources/namespaces/cluster/test.json":                                  namespace,
+				"resources/namespaces/v1-preferredversion/cluster/test.json":              namespace,
+				"metadata/version": "1",
+			},
+			expectedItems: 4,
+			expectedInventory: []ResourceCount{
+				{Version: "v1", Resource: "configmaps", Count: 2, Bytes: int64(2 * len(configMap))},
+				{Group: "apps", Version: "v1", Resource: "statefulsets", Count: 1, Bytes: int64(len(statefulSet))},
+			},
+		},
+		{
+			name: "pod volumes",
+			entries: map[string]string{
+				"resources/configmaps/namespaces/test/a.json": configMap,
+				podVolumesIndexPath:                           "[]",
+				"podvolumes/web/data.tar":                     "volume data",
+			},
+			expectedItems:     1,
+			expectedInventory: []ResourceCount{{Version: "v1", Resource: "configmaps", Count: 1, Bytes: int64(len(configMap))}},
+		},
+	}
+	for _, test := range tests {
+		tarball := newTestTarball(t, test.entries)
+		compressedBytes := int64(tarball.Len())
+		stats, inventory, err := measureSnapshotTarball(tarball)
+		if err != nil {
+			t.Fatalf("%s: measureSnapshotTarball failed with err %v", test.name, err)
+		}
+		if stats.ItemCount != test.expectedItems || stats.CompressedBytes != compressedBytes || stats.UncompressedBytes <= 0 {
+			t.Fatalf("%s: unexpected stats %v for %d compressed bytes", test.name, stats, compressedBytes)
+		}
+		if !reflect.DeepEqual(inventory, test.expectedInventory) {
+			t.Fatalf("%s: expected inventory %v, got %v", test.name, test.expectedInventory, inventory)
+		}
+	}
+	if _, _, err := measureSnapshotTarball(newTestTarball(t, map[string]string{
+		"resources/configmaps/namespaces/test/a.json": "not json",
+	})); err == nil {
+		t.Fatalf("measureSnapshotTarball accepted an item that is not JSON")
+	}
+}
+
+func TestLiveSizeCache(t *testing.T) {
+	cache := newLiveSizeCache(time.Hour)
+	estimates := 0
+	estimate := func() (int64, error) {
+		estimates++
+		return 100, nil
+	}
+	for i := 0; i < 2; i++ {
+		if size, err := cache.get("ns", estimate); size != 100 || err != nil {
+			t.Fatalf("get returned %d, %v", size, err)
+		}
+	}
+	if estimates != 1 {
+		t.Fatalf("expected the estimate to be cached, estimated %d times", estimates)
+	}
+	if size, err := cache.get("failing", func() (int64, error) { return 0, errors.New("forbidden") }); size != -1 || err == nil {
+		t.Fatalf("expected a failed estimate, got %d, %v", size, err)
+	}
+	cache.ttl = 0
+	cache.get("ns", estimate)
+	if estimates != 2 {
+		t.Fatalf("expected a stale estimate to be refreshed, estimated %d times", estimates)
+	}
+}
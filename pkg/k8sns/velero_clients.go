@@ -0,0 +1,202 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package k8sns
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/velero/pkg/backup"
+	"github.com/vmware-tanzu/velero/pkg/client"
+	"github.com/vmware-tanzu/velero/pkg/discovery"
+	veleroclientset "github.com/vmware-tanzu/velero/pkg/generated/clientset/versioned"
+	"github.com/vmware-tanzu/velero/pkg/podexec"
+	"github.com/vmware-tanzu/velero/pkg/restore"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+	k8sdiscovery "k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"sync"
+)
+
+// veleroClients bundles the clients needed to drive Velero's backup and restore machinery.  They are built once by
+// the type manager from its rest.Config and shared by all of its PEs, so that every operation talks to the same
+// cluster
+type veleroClients struct {
+	restConfig         *rest.Config
+	veleroClient       veleroclientset.Interface
+	kubeClient         kubernetes.Interface
+	dynamicClient      dynamic.Interface
+	dynamicFactory     client.DynamicFactory
+	discoveryHelper    discovery.Helper
+	podCommandExecutor podexec.PodCommandExecutor
+	restorer           restore.Restorer
+	logger             logrus.FieldLogger
+}
+
+func newVeleroClients(config *rest.Config, kubeClient kubernetes.Interface, logger logrus.FieldLogger) (*veleroClients, error) {
+	veleroClient, err := veleroclientset.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create Velero client")
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create dynamic client")
+	}
+	dynamicFactory := client.NewDynamicFactory(dynamicClient)
+
+	discoveryHelper := &lazyDiscoveryHelper{
+		discoveryClient: veleroClient.Discovery(),
+		logger:          logger,
+	}
+
+	podCommandExecutor := podexec.NewPodCommandExecutor(config, kubeClient.CoreV1().RESTClient())
+
+	restorer, err := restore.NewKubernetesRestorer(veleroClient.VeleroV1(),
+		discoveryHelper,
+		dynamicFactory,
+		defaultRestorePriorities,
+		kubeClient.CoreV1().Namespaces(),
+		nil,
+		0,
+		defaultResourceTerminatingTimeout,
+		logger,
+		podCommandExecutor,
+		kubeClient.CoreV1().RESTClient())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create Velero restorer")
+	}
+
+	return &veleroClients{
+		restConfig:         config,
+		veleroClient:       veleroClient,
+		kubeClient:         kubeClient,
+		dynamicClient:      dynamicClient,
+		dynamicFactory:     dynamicFactory,
+		discoveryHelper:    discoveryHelper,
+		podCommandExecutor: podCommandExecutor,
+		restorer:           restorer,
+		logger:             logger,
+	}, nil
+}
+
+// newBackupper creates the backupper of one backup.  Its hooks stop running once ctx is done
+func (recv *veleroClients) newBackupper(ctx context.Context) (backup.Backupper, error) {
+	// Pod volume contents are copied by podVolumeBackupAction rather than by Velero's restic integration
+	defaultVolumesToRestic := false
+	backupper, err := backup.NewKubernetesBackupper(recv.veleroClient.VeleroV1(),
+		recv.discoveryHelper,
+		recv.dynamicFactory,
+		cancellablePodCommandExecutor{ctx: ctx, executor: recv.podCommandExecutor},
+		nil,
+		0,
+		defaultVolumesToRestic)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create Velero backupper")
+	}
+	return backupper, nil
+}
+
+// refreshDiscovery picks up resource types, such as CRDs, added to the cluster since the clients were built.  A
+// failed refresh is logged and the previously discovered resources are used
+func (recv *veleroClients) refreshDiscovery() {
+	if err := recv.discoveryHelper.Refresh(); err != nil {
+		recv.logger.WithError(err).Warn("Could not refresh discovery, using previously discovered resources")
+	}
+}
+
+// lazyDiscoveryHelper defers discovery to the first use of the helper, so that the type manager can be created while
+// the API server is unreachable.  A failed discovery is retried on the next use
+type lazyDiscoveryHelper struct {
+	discoveryClient k8sdiscovery.DiscoveryInterface
+	logger          logrus.FieldLogger
+	mutex           sync.Mutex
+	helper          discovery.Helper
+}
+
+var _ discovery.Helper = &lazyDiscoveryHelper{}
+
+// get returns the helper, running the first discovery if it has not succeeded yet.  discovered is true if the
+// discovery was run by this call
+func (recv *lazyDiscoveryHelper) get() (helper discovery.Helper, discovered bool, err error) {
+	recv.mutex.Lock()
+	defer recv.mutex.Unlock()
+	if recv.helper != nil {
+		return recv.helper, false, nil
+	}
+	helper, err = discovery.NewHelper(recv.discoveryClient, recv.logger)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "could not discover API resources")
+	}
+	recv.helper = helper
+	return helper, true, nil
+}
+
+func (recv *lazyDiscoveryHelper) Resources() []*metav1.APIResourceList {
+	helper, _, err := recv.get()
+	if err != nil {
+		recv.logger.WithError(err).Error("No API resources available")
+		return nil
+	}
+	return helper.Resources()
+}
+
+func (recv *lazyDiscoveryHelper) ResourceFor(input schema.GroupVersionResource) (schema.GroupVersionResource, metav1.APIResource, error) {
+	helper, _, err := recv.get()
+	if err != nil {
+		return schema.GroupVersionResource{}, metav1.APIResource{}, err
+	}
+	return helper.ResourceFor(input)
+}
+
+func (recv *lazyDiscoveryHelper) KindFor(input schema.GroupVersionKind) (schema.GroupVersionResource, metav1.APIResource, error) {
+	helper, _, err := recv.get()
+	if err != nil {
+		return schema.GroupVersionResource{}, metav1.APIResource{}, err
+	}
+	return helper.KindFor(input)
+}
+
+func (recv *lazyDiscoveryHelper) Refresh() error {
+	helper, discovered, err := recv.get()
+	if err != nil || discovered {
+		return err
+	}
+	return helper.Refresh()
+}
+
+func (recv *lazyDiscoveryHelper) APIGroups() []metav1.APIGroup {
+	helper, _, err := recv.get()
+	if err != nil {
+		recv.logger.WithError(err).Error("No API groups available")
+		return nil
+	}
+	return helper.APIGroups()
+}
+
+func (recv *lazyDiscoveryHelper) ServerVersion() *version.Info {
+	helper, _, err := recv.get()
+	if err != nil {
+		recv.logger.WithError(err).Error("No server version available")
+		return nil
+	}
+	return helper.ServerVersion()
+}
@@ -0,0 +1,29 @@
+package k8sns
+
+import (
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"testing"
+)
+
+func TestNewVeleroClientsDefersDiscovery(t *testing.T) {
+	// Nothing listens on port 1, so any request to the API server fails
+	config := &rest.Config{Host: "http://127.0.0.1:1"}
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		t.Fatalf("kubernetes.NewForConfig failed with err %v", err)
+	}
+	clients, err := newVeleroClients(config, kubeClient, logrus.New())
+	if err != nil {
+		t.Fatalf("newVeleroClients failed with unreachable API server, err %v", err)
+	}
+	_, _, err = clients.discoveryHelper.KindFor(schema.GroupVersionKind{Version: "v1", Kind: "Secret"})
+	if err == nil {
+		t.Fatalf("Expected KindFor to fail with unreachable API server")
+	}
+	if err := clients.discoveryHelper.Refresh(); err == nil {
+		t.Fatalf("Expected Refresh to retry discovery and fail with unreachable API server")
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pvc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Defaults for the Kubernetes client, the same as k8sns
+const (
+	DefaultClientQPS   = 20.0
+	DefaultClientBurst = 30
+)
+
+// Config is the pvc config, decoded from the params of the pvc PE type config file
+type Config struct {
+	// Kubeconfig is the path of the kubeconfig file.  When it is empty the kubeconfig is loaded from $KUBECONFIG or
+	// ~/.kube/config as kubectl does, falling back to the in-cluster config
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// Context is the kubeconfig context to use instead of the current context
+	Context   string `json:"context,omitempty"`
+	MasterURL string `json:"masterURL,omitempty"`
+	// QPS and Burst limit the requests of the Kubernetes clients
+	QPS   float32 `json:"qps,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+	// VolumeSnapshotClassName is the default VolumeSnapshotClass of snapshots, see VolumeSnapshotClassParam
+	VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+}
+
+// ParseConfig decodes the pvc params into a Config and fills in the defaults.  Unknown params are rejected, so that
+// misspelled keys are not silently ignored
+func ParseConfig(params map[string]interface{}) (Config, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return Config{}, errors.Wrap(err, "invalid pvc config")
+	}
+	config := Config{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return Config{}, errors.Wrap(err, "invalid pvc config")
+	}
+	if config.QPS < 0 || config.Burst < 0 {
+		return Config{}, errors.New(fmt.Sprintf("invalid pvc config: qps %v and burst %d must be positive", config.QPS, config.Burst))
+	}
+	if config.QPS == 0 {
+		config.QPS = DefaultClientQPS
+	}
+	if config.Burst == 0 {
+		config.Burst = DefaultClientBurst
+	}
+	return config, nil
+}
+
+// restConfig builds the config of the Kubernetes clients with the default loading rules of kubectl, Kubeconfig,
+// Context and MasterURL override them when set
+func (recv Config) restConfig() (*rest.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if recv.Kubeconfig != "" {
+		loadingRules.ExplicitPath = recv.Kubeconfig
+	}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules,
+		&clientcmd.ConfigOverrides{
+			CurrentContext: recv.Context,
+			ClusterInfo:    clientcmdapi.Cluster{Server: recv.MasterURL},
+		}).ClientConfig()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load Kubernetes config (kubeconfig %q, context %q)", recv.Kubeconfig, recv.Context)
+	}
+	config.QPS = recv.QPS
+	config.Burst = recv.Burst
+	return config, nil
+}
@@ -0,0 +1,28 @@
+package pvc
+
+import (
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig(map[string]interface{}{
+		"kubeconfig":              "/etc/kube/config",
+		"volumeSnapshotClassName": "csi-class",
+	})
+	if err != nil {
+		t.Fatalf("ParseConfig failed with err %v", err)
+	}
+	if config.Kubeconfig != "/etc/kube/config" || config.VolumeSnapshotClassName != "csi-class" ||
+		config.QPS != DefaultClientQPS || config.Burst != DefaultClientBurst {
+		t.Fatalf("unexpected config %v", config)
+	}
+	for _, params := range []map[string]interface{}{
+		{"kubeconfig": 1},
+		{"snapshotClass": "csi-class"},
+		{"qps": -1},
+	} {
+		if _, err := ParseConfig(params); err == nil {
+			t.Fatalf("ParseConfig accepted %v", params)
+		}
+	}
+}
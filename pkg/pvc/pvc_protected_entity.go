@@ -0,0 +1,173 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pvc
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type PVCProtectedEntity struct {
+	petm      *PVCProtectedEntityTypeManager
+	id        astrolabe.ProtectedEntityID
+	namespace string
+	name      string
+	logger    logrus.FieldLogger
+}
+
+func newPVCProtectedEntity(petm *PVCProtectedEntityTypeManager, id astrolabe.ProtectedEntityID, namespace string,
+	name string) *PVCProtectedEntity {
+	return &PVCProtectedEntity{
+		petm:      petm,
+		id:        id,
+		namespace: namespace,
+		name:      name,
+		logger:    petm.logger.WithField("pvc", namespace+"/"+name),
+	}
+}
+
+func (recv *PVCProtectedEntity) GetID() astrolabe.ProtectedEntityID {
+	return recv.id
+}
+
+// GetInfo returns the requested size of a live PVC, or the restore size of a snapshot
+func (recv *PVCProtectedEntity) GetInfo(ctx context.Context) (astrolabe.ProtectedEntityInfo, error) {
+	var size int64
+	if recv.id.HasSnapshot() {
+		volumeSnapshot, err := recv.petm.getVolumeSnapshot(ctx, recv.id)
+		if err != nil {
+			return nil, err
+		}
+		if volumeSnapshot.Status != nil && volumeSnapshot.Status.RestoreSize != nil {
+			size = volumeSnapshot.Status.RestoreSize.Value()
+		}
+	} else {
+		pvc, err := recv.petm.kubeClient.CoreV1().PersistentVolumeClaims(recv.namespace).Get(ctx, recv.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not retrieve PVC %s/%s", recv.namespace, recv.name)
+		}
+		if storage, ok := pvc.Spec.Resources.Requests[v1.ResourceStorage]; ok {
+			size = storage.Value()
+		}
+	}
+	return astrolabe.NewProtectedEntityInfo(recv.id, recv.name, size, []astrolabe.DataTransport{},
+		[]astrolabe.DataTransport{}, []astrolabe.DataTransport{}, []astrolabe.ProtectedEntityID{}), nil
+}
+
+func (recv *PVCProtectedEntity) GetCombinedInfo(ctx context.Context) ([]astrolabe.ProtectedEntityInfo, error) {
+	info, err := recv.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return []astrolabe.ProtectedEntityInfo{info}, nil
+}
+
+// Snapshot takes a CSI VolumeSnapshot of the PVC.  The VolumeSnapshotClass can be set with the volumeSnapshotClassName
+// pvc param, otherwise the class from the config or the cluster default is used
+func (recv *PVCProtectedEntity) Snapshot(ctx context.Context, params map[string]map[string]interface{}) (astrolabe.ProtectedEntitySnapshotID, error) {
+	if recv.id.HasSnapshot() {
+		return astrolabe.ProtectedEntitySnapshotID{}, errors.New(fmt.Sprintf("pe %s is a snapshot, cannot snapshot it", recv.id.String()))
+	}
+	volumeSnapshotClass := recv.petm.volumeSnapshotClass
+	if classObj, ok := params[Typename][VolumeSnapshotClassParam]; ok {
+		class, ok := classObj.(string)
+		if !ok {
+			return astrolabe.ProtectedEntitySnapshotID{}, errors.New(fmt.Sprintf("%s param must be a string, got %T",
+				VolumeSnapshotClassParam, classObj))
+		}
+		volumeSnapshotClass = class
+	}
+	pvc, err := recv.petm.kubeClient.CoreV1().PersistentVolumeClaims(recv.namespace).Get(ctx, recv.name, metav1.GetOptions{})
+	if err != nil {
+		return astrolabe.ProtectedEntitySnapshotID{}, errors.Wrapf(err, "Could not retrieve PVC %s/%s", recv.namespace, recv.name)
+	}
+	return recv.petm.createVolumeSnapshot(ctx, pvc, volumeSnapshotClass)
+}
+
+func (recv *PVCProtectedEntity) ListSnapshots(ctx context.Context) ([]astrolabe.ProtectedEntitySnapshotID, error) {
+	volumeSnapshots, err := recv.petm.listVolumeSnapshots(ctx, recv.id.GetID())
+	if err != nil {
+		return nil, err
+	}
+	snapshotIDs := []astrolabe.ProtectedEntitySnapshotID{}
+	for _, volumeSnapshot := range volumeSnapshots {
+		snapshotIDs = append(snapshotIDs, astrolabe.NewProtectedEntitySnapshotID(volumeSnapshot.Labels[SnapshotIDLabel]))
+	}
+	return snapshotIDs, nil
+}
+
+// DeleteSnapshot deletes the VolumeSnapshot, along with the VolumeSnapshots Copy created for it in other namespaces.
+// Whether the snapshot data is removed as well depends on the deletion policy of its VolumeSnapshotClass
+func (recv *PVCProtectedEntity) DeleteSnapshot(ctx context.Context, snapshotToDelete astrolabe.ProtectedEntitySnapshotID,
+	params map[string]map[string]interface{}) (bool, error) {
+	volumeSnapshot, err := recv.petm.getVolumeSnapshot(ctx, recv.id.IDWithSnapshot(snapshotToDelete))
+	if err != nil {
+		return false, err
+	}
+	err = recv.petm.deleteBoundSnapshots(ctx, snapshotToDelete.GetID())
+	if err != nil {
+		return false, err
+	}
+	recv.logger.Infof("Deleting VolumeSnapshot %s/%s", volumeSnapshot.Namespace, volumeSnapshot.Name)
+	err = recv.petm.snapshotClient.SnapshotV1beta1().VolumeSnapshots(volumeSnapshot.Namespace).Delete(ctx, volumeSnapshot.Name,
+		metav1.DeleteOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "Could not delete VolumeSnapshot %s/%s", volumeSnapshot.Namespace, volumeSnapshot.Name)
+	}
+	return true, nil
+}
+
+func (recv *PVCProtectedEntity) GetInfoForSnapshot(ctx context.Context, snapshotID astrolabe.ProtectedEntitySnapshotID) (*astrolabe.ProtectedEntityInfo, error) {
+	snapshotPE, err := recv.petm.GetProtectedEntity(ctx, recv.id.IDWithSnapshot(snapshotID))
+	if err != nil {
+		return nil, err
+	}
+	info, err := snapshotPE.GetInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (recv *PVCProtectedEntity) GetComponents(ctx context.Context) ([]astrolabe.ProtectedEntity, error) {
+	return []astrolabe.ProtectedEntity{}, nil
+}
+
+// GetDataReader is not supported, the volume data stays in the storage system and is only reachable through a PVC
+// provisioned by Copy
+func (recv *PVCProtectedEntity) GetDataReader(ctx context.Context) (io.ReadCloser, error) {
+	return nil, errors.New("GetDataReader is not supported for " + Typename)
+}
+
+func (recv *PVCProtectedEntity) GetMetadataReader(ctx context.Context) (io.ReadCloser, error) {
+	return nil, errors.New("GetMetadataReader is not supported for " + Typename)
+}
+
+// Overwrite is not supported, a CSI snapshot can only be restored into a new PVC with Copy
+func (recv *PVCProtectedEntity) Overwrite(ctx context.Context, sourcePE astrolabe.ProtectedEntity, params map[string]map[string]interface{},
+	overwriteComponents bool) error {
+	return errors.New("Overwrite is not supported for " + Typename + ", use Copy")
+}
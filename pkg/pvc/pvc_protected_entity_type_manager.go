@@ -0,0 +1,557 @@
+/*
+ * Copyright 2021 the Astrolabe contributors
+ * SPDX-License-Identifier: Apache-2.0
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pvc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	snapshotv1beta1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotclientset "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+	"time"
+)
+
+const Typename = "pvc"
+
+// pvc params accepted in the config and by Snapshot and Copy
+const (
+	// VolumeSnapshotClassParam names the VolumeSnapshotClass used for snapshots.  The cluster default class is used if
+	// it is not set
+	VolumeSnapshotClassParam = "volumeSnapshotClassName"
+	// CopyNamespaceParam is the namespace Copy creates the PVC in.  Defaults to the namespace of the snapshot
+	CopyNamespaceParam = "namespace"
+	// CopyNameParam is the name of the PVC created by Copy.  Defaults to the name of the snapshotted PVC
+	CopyNameParam = "name"
+)
+
+// Labels and annotations on the VolumeSnapshots created for PVC snapshots
+const (
+	PVCUIDLabel     = "astrolabe.io/pvc-uid"
+	SnapshotIDLabel = "astrolabe.io/snapshot-id"
+	// BoundSnapshotIDLabel marks the VolumeSnapshots and VolumeSnapshotContents created by Copy to use a snapshot in
+	// another namespace.  They are deleted along with the snapshot
+	BoundSnapshotIDLabel     = "astrolabe.io/bound-snapshot-id"
+	PVCSpecAnnotation        = "astrolabe.io/pvc-spec"
+	PVCLabelsAnnotation      = "astrolabe.io/pvc-labels"
+	PVCAnnotationsAnnotation = "astrolabe.io/pvc-annotations"
+	RestoredFromAnnotation   = "astrolabe.io/restored-from"
+)
+
+// pvcControllerAnnotationPrefixes are the prefixes of the PVC annotations set by Kubernetes while binding a PVC, they
+// are not carried over to the PVCs created by Copy
+var pvcControllerAnnotationPrefixes = []string{
+	"pv.kubernetes.io/",
+	"volume.kubernetes.io/",
+	"volume.beta.kubernetes.io/",
+}
+
+const (
+	snapshotReadyTimeout      = 10 * time.Minute
+	snapshotReadyPollInterval = 2 * time.Second
+	// failedSnapshotDeleteTimeout bounds the delete of a VolumeSnapshot that did not become ready
+	failedSnapshotDeleteTimeout = 30 * time.Second
+)
+
+// PVCProtectedEntityTypeManager manages PVCs as PEs.  Snapshots are CSI VolumeSnapshots taken in the namespace of the
+// PVC and labelled with its UID, so the PVC UID is used as the PE ID
+type PVCProtectedEntityTypeManager struct {
+	kubeClient          kubernetes.Interface
+	snapshotClient      snapshotclientset.Interface
+	volumeSnapshotClass string
+	logger              logrus.FieldLogger
+}
+
+// NewPVCProtectedEntityTypeManagerFromConfig creates a PVCProtectedEntityTypeManager from the params of the pvc PE type
+// config file, see Config
+func NewPVCProtectedEntityTypeManagerFromConfig(params map[string]interface{}, s3Config astrolabe.S3Config,
+	logger logrus.FieldLogger) (astrolabe.ProtectedEntityTypeManager, error) {
+	pvcConfig, err := ParseConfig(params)
+	if err != nil {
+		return nil, err
+	}
+	config, err := pvcConfig.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	snapshotClient, err := snapshotclientset.NewForConfig(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create VolumeSnapshot client")
+	}
+	return NewPVCProtectedEntityTypeManager(kubeClient, snapshotClient, pvcConfig.VolumeSnapshotClassName, logger), nil
+}
+
+// NewPVCProtectedEntityTypeManager creates a PVCProtectedEntityTypeManager from existing clients
+func NewPVCProtectedEntityTypeManager(kubeClient kubernetes.Interface, snapshotClient snapshotclientset.Interface,
+	volumeSnapshotClass string, logger logrus.FieldLogger) *PVCProtectedEntityTypeManager {
+	return &PVCProtectedEntityTypeManager{
+		kubeClient:          kubeClient,
+		snapshotClient:      snapshotClient,
+		volumeSnapshotClass: volumeSnapshotClass,
+		logger:              logger,
+	}
+}
+
+func (recv *PVCProtectedEntityTypeManager) GetTypeName() string {
+	return Typename
+}
+
+// CreatesKubernetesItem returns true, Copy creates the PVC for the new PE
+func (recv *PVCProtectedEntityTypeManager) CreatesKubernetesItem() bool {
+	return true
+}
+
+func (recv *PVCProtectedEntityTypeManager) GetProtectedEntity(ctx context.Context, id astrolabe.ProtectedEntityID) (
+	astrolabe.ProtectedEntity, error) {
+	if id.GetPeType() != Typename {
+		return nil, errors.New(fmt.Sprintf("pe %s is not a %s pe", id.String(), Typename))
+	}
+	if id.HasSnapshot() {
+		volumeSnapshot, err := recv.getVolumeSnapshot(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return newPVCProtectedEntity(recv, id, volumeSnapshot.Namespace, getSnapshotPVCName(volumeSnapshot)), nil
+	}
+	pvc, err := recv.getPVCForPEID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return newPVCProtectedEntity(recv, id, pvc.Namespace, pvc.Name), nil
+}
+
+func (recv *PVCProtectedEntityTypeManager) GetProtectedEntities(ctx context.Context) ([]astrolabe.ProtectedEntityID, error) {
+	pvcs, err := recv.kubeClient.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not list PVCs")
+	}
+	returnList := []astrolabe.ProtectedEntityID{}
+	for _, pvc := range pvcs.Items {
+		returnList = append(returnList, astrolabe.NewProtectedEntityID(Typename, string(pvc.UID)))
+	}
+	return returnList, nil
+}
+
+// Copy provisions a new PVC from the VolumeSnapshot of pe.  The namespace and name of the PVC are taken from the pvc
+// params.  A VolumeSnapshot can only be used as a data source in its own namespace, so when the PVC is created in
+// another namespace the snapshot is first bound to a new VolumeSnapshot there.  Only AllocateNewObject is supported,
+// the data of an existing PVC cannot be replaced
+func (recv *PVCProtectedEntityTypeManager) Copy(ctx context.Context, pe astrolabe.ProtectedEntity, params map[string]map[string]interface{},
+	options astrolabe.CopyCreateOptions) (astrolabe.ProtectedEntity, error) {
+	sourceID := pe.GetID()
+	if sourceID.GetPeType() != Typename {
+		return nil, errors.New(fmt.Sprintf("source pe %s is not a %s pe", sourceID.String(), Typename))
+	}
+	if !sourceID.HasSnapshot() {
+		return nil, errors.New(fmt.Sprintf("source pe %s is not a snapshot, only snapshots can be copied", sourceID.String()))
+	}
+	if options != astrolabe.AllocateNewObject {
+		return nil, errors.New(fmt.Sprintf("copy option %d is not supported for %s, only AllocateNewObject", options, Typename))
+	}
+	volumeSnapshot, err := recv.getVolumeSnapshot(ctx, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	targetNamespace, _ := params[Typename][CopyNamespaceParam].(string)
+	if targetNamespace == "" {
+		targetNamespace = volumeSnapshot.Namespace
+	}
+	targetName, _ := params[Typename][CopyNameParam].(string)
+	if targetName == "" {
+		targetName = getSnapshotPVCName(volumeSnapshot)
+	}
+	pvcSpec := v1.PersistentVolumeClaimSpec{}
+	if specJSON, ok := volumeSnapshot.Annotations[PVCSpecAnnotation]; ok {
+		if err := json.Unmarshal([]byte(specJSON), &pvcSpec); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse PVC spec of snapshot %s", sourceID.String())
+		}
+	}
+	if pvcSpec.Resources.Requests == nil && volumeSnapshot.Status != nil && volumeSnapshot.Status.RestoreSize != nil {
+		pvcSpec.Resources.Requests = v1.ResourceList{v1.ResourceStorage: *volumeSnapshot.Status.RestoreSize}
+	}
+	if len(pvcSpec.AccessModes) == 0 {
+		pvcSpec.AccessModes = []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce}
+	}
+
+	labels := map[string]string{}
+	if labelsJSON, ok := volumeSnapshot.Annotations[PVCLabelsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(labelsJSON), &labels); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse PVC labels of snapshot %s", sourceID.String())
+		}
+	}
+	annotations := map[string]string{}
+	if annotationsJSON, ok := volumeSnapshot.Annotations[PVCAnnotationsAnnotation]; ok {
+		if err := json.Unmarshal([]byte(annotationsJSON), &annotations); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse PVC annotations of snapshot %s", sourceID.String())
+		}
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[RestoredFromAnnotation] = sourceID.String()
+
+	dataSourceName := volumeSnapshot.Name
+	if targetNamespace != volumeSnapshot.Namespace {
+		dataSourceName, err = recv.bindSnapshotInNamespace(ctx, volumeSnapshot, targetNamespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+	apiGroup := snapshotv1beta1.GroupName
+	pvcSpec.DataSource = &v1.TypedLocalObjectReference{
+		APIGroup: &apiGroup,
+		Kind:     "VolumeSnapshot",
+		Name:     dataSourceName,
+	}
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   targetNamespace,
+			Name:        targetName,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: pvcSpec,
+	}
+	recv.logger.Infof("Creating PVC %s/%s from snapshot %s", targetNamespace, targetName, sourceID.String())
+	pvc, err = recv.kubeClient.CoreV1().PersistentVolumeClaims(targetNamespace).Create(ctx, pvc, metav1.CreateOptions{})
+	if err != nil {
+		if dataSourceName != volumeSnapshot.Name {
+			if cleanupErr := recv.deleteBoundSnapshot(ctx, targetNamespace, dataSourceName); cleanupErr != nil {
+				recv.logger.WithError(cleanupErr).Errorf("Could not delete VolumeSnapshot %s/%s", targetNamespace, dataSourceName)
+			}
+		}
+		return nil, errors.Wrapf(err, "Could not create PVC %s/%s", targetNamespace, targetName)
+	}
+	newID := astrolabe.NewProtectedEntityID(Typename, string(pvc.UID))
+	return newPVCProtectedEntity(recv, newID, pvc.Namespace, pvc.Name), nil
+}
+
+func (recv *PVCProtectedEntityTypeManager) CopyFromInfo(ctx context.Context, info astrolabe.ProtectedEntityInfo, params map[string]map[string]interface{},
+	options astrolabe.CopyCreateOptions) (astrolabe.ProtectedEntity, error) {
+	pe, err := recv.GetProtectedEntity(ctx, info.GetID())
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not get source pe %s", info.GetID().String())
+	}
+	return recv.Copy(ctx, pe, params, options)
+}
+
+func (recv *PVCProtectedEntityTypeManager) Delete(ctx context.Context, id astrolabe.ProtectedEntityID) error {
+	if id.HasSnapshot() {
+		return errors.New(fmt.Sprintf("pe %s is a snapshot, use DeleteSnapshot", id.String()))
+	}
+	pvc, err := recv.getPVCForPEID(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = recv.kubeClient.CoreV1().PersistentVolumeClaims(pvc.Namespace).Delete(ctx, pvc.Name, metav1.DeleteOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "Could not delete PVC %s/%s", pvc.Namespace, pvc.Name)
+	}
+	return nil
+}
+
+func (recv *PVCProtectedEntityTypeManager) getPVCForPEID(ctx context.Context, id astrolabe.ProtectedEntityID) (*v1.PersistentVolumeClaim, error) {
+	pvcs, err := recv.kubeClient.CoreV1().PersistentVolumeClaims(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not list PVCs")
+	}
+	for i := range pvcs.Items {
+		if string(pvcs.Items[i].UID) == id.GetID() {
+			return &pvcs.Items[i], nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("PVC for pe %s not found", id.String()))
+}
+
+// listVolumeSnapshots returns the VolumeSnapshots taken of the PVC with pvcUID, in any namespace
+func (recv *PVCProtectedEntityTypeManager) listVolumeSnapshots(ctx context.Context, pvcUID string) ([]snapshotv1beta1.VolumeSnapshot, error) {
+	volumeSnapshots, err := recv.snapshotClient.SnapshotV1beta1().VolumeSnapshots(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: PVCUIDLabel + "=" + pvcUID,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not list VolumeSnapshots for PVC %s", pvcUID)
+	}
+	return volumeSnapshots.Items, nil
+}
+
+// getVolumeSnapshot returns the VolumeSnapshot of the snapshot PE id.  The error is a NotFound API error if there is none
+func (recv *PVCProtectedEntityTypeManager) getVolumeSnapshot(ctx context.Context, id astrolabe.ProtectedEntityID) (*snapshotv1beta1.VolumeSnapshot, error) {
+	volumeSnapshots, err := recv.listVolumeSnapshots(ctx, id.GetID())
+	if err != nil {
+		return nil, err
+	}
+	for i := range volumeSnapshots {
+		if volumeSnapshots[i].Labels[SnapshotIDLabel] == id.GetSnapshotID().GetID() {
+			return &volumeSnapshots[i], nil
+		}
+	}
+	notFound := apierrors.NewNotFound(snapshotv1beta1.Resource("volumesnapshots"), id.GetSnapshotID().GetID())
+	return nil, errors.Wrapf(notFound, "VolumeSnapshot for pe %s not found", id.String())
+}
+
+// createVolumeSnapshot snapshots pvc and waits for the snapshot to be ready to use
+func (recv *PVCProtectedEntityTypeManager) createVolumeSnapshot(ctx context.Context, pvc *v1.PersistentVolumeClaim,
+	volumeSnapshotClass string) (astrolabe.ProtectedEntitySnapshotID, error) {
+	snapshotUUID, err := uuid.NewRandom()
+	if err != nil {
+		return astrolabe.ProtectedEntitySnapshotID{}, errors.Wrap(err, "Failed to create new UUID")
+	}
+	pvcSpec := pvc.Spec.DeepCopy()
+	pvcSpec.VolumeName = ""
+	pvcSpec.DataSource = nil
+	pvcSpec.Selector = nil
+	specJSON, err := json.Marshal(pvcSpec)
+	if err != nil {
+		return astrolabe.ProtectedEntitySnapshotID{}, errors.Wrap(err, "Could not marshal PVC spec")
+	}
+	labelsJSON, err := json.Marshal(pvc.Labels)
+	if err != nil {
+		return astrolabe.ProtectedEntitySnapshotID{}, errors.Wrap(err, "Could not marshal PVC labels")
+	}
+	annotationsJSON, err := json.Marshal(copiedPVCAnnotations(pvc))
+	if err != nil {
+		return astrolabe.ProtectedEntitySnapshotID{}, errors.Wrap(err, "Could not marshal PVC annotations")
+	}
+	pvcName := pvc.Name
+	volumeSnapshot := &snapshotv1beta1.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: pvc.Namespace,
+			Name:      "astrolabe-" + snapshotUUID.String(),
+			Labels: map[string]string{
+				PVCUIDLabel:     string(pvc.UID),
+				SnapshotIDLabel: snapshotUUID.String(),
+			},
+			Annotations: map[string]string{
+				PVCSpecAnnotation:        string(specJSON),
+				PVCLabelsAnnotation:      string(labelsJSON),
+				PVCAnnotationsAnnotation: string(annotationsJSON),
+			},
+		},
+		Spec: snapshotv1beta1.VolumeSnapshotSpec{
+			Source: snapshotv1beta1.VolumeSnapshotSource{
+				PersistentVolumeClaimName: &pvcName,
+			},
+		},
+	}
+	if volumeSnapshotClass != "" {
+		volumeSnapshot.Spec.VolumeSnapshotClassName = &volumeSnapshotClass
+	}
+	recv.logger.Infof("Creating VolumeSnapshot %s/%s for PVC %s", volumeSnapshot.Namespace, volumeSnapshot.Name, pvcName)
+	volumeSnapshot, err = recv.snapshotClient.SnapshotV1beta1().VolumeSnapshots(pvc.Namespace).Create(ctx, volumeSnapshot, metav1.CreateOptions{})
+	if err != nil {
+		return astrolabe.ProtectedEntitySnapshotID{}, errors.Wrapf(err, "Could not create VolumeSnapshot for PVC %s/%s", pvc.Namespace, pvcName)
+	}
+	err = recv.waitForVolumeSnapshot(ctx, volumeSnapshot.Namespace, volumeSnapshot.Name)
+	if err != nil {
+		recv.deleteFailedVolumeSnapshot(volumeSnapshot.Namespace, volumeSnapshot.Name)
+		return astrolabe.ProtectedEntitySnapshotID{}, err
+	}
+	return astrolabe.NewProtectedEntitySnapshotID(snapshotUUID.String()), nil
+}
+
+// deleteFailedVolumeSnapshot deletes a VolumeSnapshot that did not become ready, so that it is not left behind.  ctx may
+// already be done, so a new context is used
+func (recv *PVCProtectedEntityTypeManager) deleteFailedVolumeSnapshot(namespace string, name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), failedSnapshotDeleteTimeout)
+	defer cancel()
+	recv.logger.Infof("Deleting VolumeSnapshot %s/%s that did not become ready", namespace, name)
+	err := recv.snapshotClient.SnapshotV1beta1().VolumeSnapshots(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !isNotFound(err) {
+		recv.logger.WithError(err).Errorf("Could not delete VolumeSnapshot %s/%s, it must be deleted manually", namespace, name)
+	}
+}
+
+// waitForVolumeSnapshot waits until the VolumeSnapshot is ready to use.  It gives up after snapshotReadyTimeout or when
+// ctx is done
+func (recv *PVCProtectedEntityTypeManager) waitForVolumeSnapshot(ctx context.Context, namespace string, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, snapshotReadyTimeout)
+	defer cancel()
+	err := wait.PollImmediateUntil(snapshotReadyPollInterval, func() (bool, error) {
+		volumeSnapshot, err := recv.snapshotClient.SnapshotV1beta1().VolumeSnapshots(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if volumeSnapshot.Status == nil {
+			return false, nil
+		}
+		if volumeSnapshot.Status.Error != nil && volumeSnapshot.Status.Error.Message != nil {
+			return false, errors.New(*volumeSnapshot.Status.Error.Message)
+		}
+		return volumeSnapshot.Status.ReadyToUse != nil && *volumeSnapshot.Status.ReadyToUse, nil
+	}, ctx.Done())
+	if err != nil {
+		return errors.Wrapf(err, "VolumeSnapshot %s/%s did not become ready", namespace, name)
+	}
+	return nil
+}
+
+// bindSnapshotInNamespace makes the snapshot taken by volumeSnapshot available in targetNamespace by creating a
+// pre-provisioned VolumeSnapshotContent for the same snapshot handle and a VolumeSnapshot bound to it.  The content is
+// retained when the new VolumeSnapshot is deleted, as the snapshot is still owned by volumeSnapshot.  Both are labelled
+// with the snapshot ID and deleted by deleteBoundSnapshots when the snapshot is deleted
+func (recv *PVCProtectedEntityTypeManager) bindSnapshotInNamespace(ctx context.Context, volumeSnapshot *snapshotv1beta1.VolumeSnapshot,
+	targetNamespace string) (string, error) {
+	if volumeSnapshot.Status == nil || volumeSnapshot.Status.BoundVolumeSnapshotContentName == nil {
+		return "", errors.New(fmt.Sprintf("VolumeSnapshot %s/%s is not bound to a VolumeSnapshotContent",
+			volumeSnapshot.Namespace, volumeSnapshot.Name))
+	}
+	contentName := *volumeSnapshot.Status.BoundVolumeSnapshotContentName
+	content, err := recv.snapshotClient.SnapshotV1beta1().VolumeSnapshotContents().Get(ctx, contentName, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not retrieve VolumeSnapshotContent %s", contentName)
+	}
+	if content.Status == nil || content.Status.SnapshotHandle == nil {
+		return "", errors.New(fmt.Sprintf("VolumeSnapshotContent %s has no snapshot handle", contentName))
+	}
+	bindUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to create new UUID")
+	}
+	name := "astrolabe-" + bindUUID.String()
+	labels := map[string]string{
+		BoundSnapshotIDLabel: volumeSnapshot.Labels[SnapshotIDLabel],
+	}
+	snapshotHandle := *content.Status.SnapshotHandle
+	newContent := &snapshotv1beta1.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: snapshotv1beta1.VolumeSnapshotContentSpec{
+			VolumeSnapshotRef: v1.ObjectReference{
+				Kind:       "VolumeSnapshot",
+				APIVersion: snapshotv1beta1.SchemeGroupVersion.String(),
+				Namespace:  targetNamespace,
+				Name:       name,
+			},
+			DeletionPolicy:          snapshotv1beta1.VolumeSnapshotContentRetain,
+			Driver:                  content.Spec.Driver,
+			VolumeSnapshotClassName: content.Spec.VolumeSnapshotClassName,
+			Source: snapshotv1beta1.VolumeSnapshotContentSource{
+				SnapshotHandle: &snapshotHandle,
+			},
+		},
+	}
+	_, err = recv.snapshotClient.SnapshotV1beta1().VolumeSnapshotContents().Create(ctx, newContent, metav1.CreateOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not create VolumeSnapshotContent %s", name)
+	}
+	newSnapshot := &snapshotv1beta1.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: targetNamespace,
+			Name:      name,
+			Labels:    labels,
+		},
+		Spec: snapshotv1beta1.VolumeSnapshotSpec{
+			Source: snapshotv1beta1.VolumeSnapshotSource{
+				VolumeSnapshotContentName: &name,
+			},
+		},
+	}
+	_, err = recv.snapshotClient.SnapshotV1beta1().VolumeSnapshots(targetNamespace).Create(ctx, newSnapshot, metav1.CreateOptions{})
+	if err != nil {
+		if cleanupErr := recv.snapshotClient.SnapshotV1beta1().VolumeSnapshotContents().Delete(ctx, name, metav1.DeleteOptions{}); cleanupErr != nil {
+			recv.logger.WithError(cleanupErr).Errorf("Could not delete VolumeSnapshotContent %s", name)
+		}
+		return "", errors.Wrapf(err, "Could not create VolumeSnapshot %s/%s", targetNamespace, name)
+	}
+	return name, nil
+}
+
+// deleteBoundSnapshot deletes a VolumeSnapshot created by bindSnapshotInNamespace and its VolumeSnapshotContent, which
+// share the same name.  The snapshot data is retained
+func (recv *PVCProtectedEntityTypeManager) deleteBoundSnapshot(ctx context.Context, namespace string, name string) error {
+	recv.logger.Infof("Deleting VolumeSnapshot %s/%s bound to the snapshot of another namespace", namespace, name)
+	err := recv.snapshotClient.SnapshotV1beta1().VolumeSnapshots(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !isNotFound(err) {
+		return errors.Wrapf(err, "Could not delete VolumeSnapshot %s/%s", namespace, name)
+	}
+	err = recv.snapshotClient.SnapshotV1beta1().VolumeSnapshotContents().Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !isNotFound(err) {
+		return errors.Wrapf(err, "Could not delete VolumeSnapshotContent %s", name)
+	}
+	return nil
+}
+
+// deleteBoundSnapshots deletes the VolumeSnapshots and VolumeSnapshotContents created by Copy for the snapshot with
+// snapshotID in other namespaces
+func (recv *PVCProtectedEntityTypeManager) deleteBoundSnapshots(ctx context.Context, snapshotID string) error {
+	selector := metav1.ListOptions{LabelSelector: BoundSnapshotIDLabel + "=" + snapshotID}
+	volumeSnapshots, err := recv.snapshotClient.SnapshotV1beta1().VolumeSnapshots(metav1.NamespaceAll).List(ctx, selector)
+	if err != nil {
+		return errors.Wrapf(err, "Could not list VolumeSnapshots bound to snapshot %s", snapshotID)
+	}
+	for _, volumeSnapshot := range volumeSnapshots.Items {
+		if err := recv.deleteBoundSnapshot(ctx, volumeSnapshot.Namespace, volumeSnapshot.Name); err != nil {
+			return err
+		}
+	}
+	// Contents whose VolumeSnapshot was already removed
+	contents, err := recv.snapshotClient.SnapshotV1beta1().VolumeSnapshotContents().List(ctx, selector)
+	if err != nil {
+		return errors.Wrapf(err, "Could not list VolumeSnapshotContents bound to snapshot %s", snapshotID)
+	}
+	for _, content := range contents.Items {
+		err := recv.snapshotClient.SnapshotV1beta1().VolumeSnapshotContents().Delete(ctx, content.Name, metav1.DeleteOptions{})
+		if err != nil && !isNotFound(err) {
+			return errors.Wrapf(err, "Could not delete VolumeSnapshotContent %s", content.Name)
+		}
+	}
+	return nil
+}
+
+// copiedPVCAnnotations returns the annotations of pvc that are carried over to the PVCs created by Copy
+func copiedPVCAnnotations(pvc *v1.PersistentVolumeClaim) map[string]string {
+	annotations := map[string]string{}
+	for key, value := range pvc.Annotations {
+		controllerAnnotation := false
+		for _, prefix := range pvcControllerAnnotationPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				controllerAnnotation = true
+				break
+			}
+		}
+		if !controllerAnnotation && key != RestoredFromAnnotation {
+			annotations[key] = value
+		}
+	}
+	return annotations
+}
+
+func getSnapshotPVCName(volumeSnapshot *snapshotv1beta1.VolumeSnapshot) string {
+	if volumeSnapshot.Spec.Source.PersistentVolumeClaimName != nil {
+		return *volumeSnapshot.Spec.Source.PersistentVolumeClaimName
+	}
+	return volumeSnapshot.Name
+}
+
+func isNotFound(err error) bool {
+	return apierrors.IsNotFound(errors.Cause(err))
+}
@@ -0,0 +1,235 @@
+package pvc
+
+import (
+	"context"
+	snapshotv1beta1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1beta1"
+	snapshotfake "github.com/kubernetes-csi/external-snapshotter/client/v4/clientset/versioned/fake"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware-tanzu/astrolabe/pkg/astrolabe"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestPETM returns a PETM over fake clients with one PVC.  The fake snapshot controller marks VolumeSnapshots
+// ready and bound to a VolumeSnapshotContent as soon as they are created
+func newTestPETM(t *testing.T) (*PVCProtectedEntityTypeManager, *fake.Clientset, *snapshotfake.Clientset) {
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "app",
+			Name:        "data",
+			UID:         "pvc-uid-1",
+			Labels:      map[string]string{"app": "web"},
+			Annotations: map[string]string{"example.com/owner": "team-a", "pv.kubernetes.io/bind-completed": "yes"},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes: []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+			},
+			VolumeName: "pv-1",
+		},
+	}
+	snapshotHandle := "snap-handle-1"
+	content := &snapshotv1beta1.VolumeSnapshotContent{
+		ObjectMeta: metav1.ObjectMeta{Name: "content-1"},
+		Spec:       snapshotv1beta1.VolumeSnapshotContentSpec{Driver: "csi.example.com"},
+		Status:     &snapshotv1beta1.VolumeSnapshotContentStatus{SnapshotHandle: &snapshotHandle},
+	}
+	kubeClient := fake.NewSimpleClientset(pvc)
+	snapshotClient := snapshotfake.NewSimpleClientset(content)
+	snapshotClient.PrependReactor("create", "volumesnapshots", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		volumeSnapshot := action.(k8stesting.CreateAction).GetObject().(*snapshotv1beta1.VolumeSnapshot)
+		ready := true
+		contentName := content.Name
+		restoreSize := resource.MustParse("1Gi")
+		volumeSnapshot.Status = &snapshotv1beta1.VolumeSnapshotStatus{
+			ReadyToUse:                     &ready,
+			BoundVolumeSnapshotContentName: &contentName,
+			RestoreSize:                    &restoreSize,
+		}
+		return false, nil, nil
+	})
+	return NewPVCProtectedEntityTypeManager(kubeClient, snapshotClient, "csi-class", logrus.New()), kubeClient, snapshotClient
+}
+
+func TestSnapshotAndCopy(t *testing.T) {
+	ctx := context.Background()
+	petm, kubeClient, snapshotClient := newTestPETM(t)
+
+	peIDs, err := petm.GetProtectedEntities(ctx)
+	if err != nil || len(peIDs) != 1 {
+		t.Fatalf("GetProtectedEntities returned %v, %v", peIDs, err)
+	}
+	pe, err := petm.GetProtectedEntity(ctx, peIDs[0])
+	if err != nil {
+		t.Fatalf("GetProtectedEntity failed with err %v", err)
+	}
+	snapshotID, err := pe.Snapshot(ctx, map[string]map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("Snapshot failed with err %v", err)
+	}
+	volumeSnapshots, err := snapshotClient.SnapshotV1beta1().VolumeSnapshots("app").List(ctx, metav1.ListOptions{})
+	if err != nil || len(volumeSnapshots.Items) != 1 {
+		t.Fatalf("expected one VolumeSnapshot, got %v, %v", volumeSnapshots, err)
+	}
+	volumeSnapshot := volumeSnapshots.Items[0]
+	if *volumeSnapshot.Spec.Source.PersistentVolumeClaimName != "data" || *volumeSnapshot.Spec.VolumeSnapshotClassName != "csi-class" {
+		t.Fatalf("unexpected VolumeSnapshot spec %v", volumeSnapshot.Spec)
+	}
+
+	snapshotIDs, err := pe.ListSnapshots(ctx)
+	if err != nil || len(snapshotIDs) != 1 || snapshotIDs[0] != snapshotID {
+		t.Fatalf("ListSnapshots returned %v, %v, expected %v", snapshotIDs, err, snapshotID)
+	}
+
+	snapshotPE, err := petm.GetProtectedEntity(ctx, pe.GetID().IDWithSnapshot(snapshotID))
+	if err != nil {
+		t.Fatalf("GetProtectedEntity for snapshot failed with err %v", err)
+	}
+	info, err := snapshotPE.GetInfo(ctx)
+	if err != nil || info.GetName() != "data" || info.GetSize() != 1<<30 {
+		t.Fatalf("unexpected snapshot info %v, %v", info, err)
+	}
+
+	_, err = petm.Copy(ctx, snapshotPE, map[string]map[string]interface{}{
+		Typename: {CopyNameParam: "data-copy"},
+	}, astrolabe.AllocateNewObject)
+	if err != nil {
+		t.Fatalf("Copy failed with err %v", err)
+	}
+	copied, err := kubeClient.CoreV1().PersistentVolumeClaims("app").Get(ctx, "data-copy", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("copied PVC not found, err %v", err)
+	}
+	if copied.Spec.DataSource == nil || copied.Spec.DataSource.Name != volumeSnapshot.Name || copied.Spec.VolumeName != "" {
+		t.Fatalf("unexpected copied PVC spec %v", copied.Spec)
+	}
+	if copied.Labels["app"] != "web" || copied.Annotations["example.com/owner"] != "team-a" ||
+		copied.Annotations[RestoredFromAnnotation] == "" {
+		t.Fatalf("labels and annotations not carried over to copied PVC: %v, %v", copied.Labels, copied.Annotations)
+	}
+	if _, found := copied.Annotations["pv.kubernetes.io/bind-completed"]; found {
+		t.Fatalf("controller annotation carried over to copied PVC: %v", copied.Annotations)
+	}
+
+	_, err = petm.Copy(ctx, snapshotPE, map[string]map[string]interface{}{
+		Typename: {CopyNamespaceParam: "restored"},
+	}, astrolabe.AllocateNewObject)
+	if err != nil {
+		t.Fatalf("Copy to another namespace failed with err %v", err)
+	}
+	copied, err = kubeClient.CoreV1().PersistentVolumeClaims("restored").Get(ctx, "data", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("copied PVC not found in target namespace, err %v", err)
+	}
+	boundSnapshot, err := snapshotClient.SnapshotV1beta1().VolumeSnapshots("restored").Get(ctx, copied.Spec.DataSource.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("VolumeSnapshot for copy not found in target namespace, err %v", err)
+	}
+	boundContent, err := snapshotClient.SnapshotV1beta1().VolumeSnapshotContents().Get(ctx, *boundSnapshot.Spec.Source.VolumeSnapshotContentName,
+		metav1.GetOptions{})
+	if err != nil || *boundContent.Spec.Source.SnapshotHandle != "snap-handle-1" {
+		t.Fatalf("unexpected VolumeSnapshotContent for copy %v, %v", boundContent, err)
+	}
+
+	deleted, err := pe.DeleteSnapshot(ctx, snapshotID, map[string]map[string]interface{}{})
+	if err != nil || !deleted {
+		t.Fatalf("DeleteSnapshot returned %v, %v", deleted, err)
+	}
+	snapshotIDs, err = pe.ListSnapshots(ctx)
+	if err != nil || len(snapshotIDs) != 0 {
+		t.Fatalf("ListSnapshots after delete returned %v, %v", snapshotIDs, err)
+	}
+	if _, err := snapshotClient.SnapshotV1beta1().VolumeSnapshots("restored").Get(ctx, boundSnapshot.Name, metav1.GetOptions{}); !isNotFound(err) {
+		t.Fatalf("VolumeSnapshot for copy not deleted with the snapshot, err %v", err)
+	}
+	if _, err := snapshotClient.SnapshotV1beta1().VolumeSnapshotContents().Get(ctx, boundContent.Name, metav1.GetOptions{}); !isNotFound(err) {
+		t.Fatalf("VolumeSnapshotContent for copy not deleted with the snapshot, err %v", err)
+	}
+}
+
+func TestSnapshotFailsOnVolumeSnapshotError(t *testing.T) {
+	ctx := context.Background()
+	petm, _, snapshotClient := newTestPETM(t)
+	snapshotClient.PrependReactor("create", "volumesnapshots", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		volumeSnapshot := action.(k8stesting.CreateAction).GetObject().(*snapshotv1beta1.VolumeSnapshot)
+		message := "driver does not support snapshots"
+		volumeSnapshot.Status = &snapshotv1beta1.VolumeSnapshotStatus{
+			Error: &snapshotv1beta1.VolumeSnapshotError{Message: &message},
+		}
+		// Handled here, so the ready status of newTestPETM is not set
+		err := snapshotClient.Tracker().Create(action.GetResource(), volumeSnapshot, action.GetNamespace())
+		return true, volumeSnapshot, err
+	})
+	pe, err := petm.GetProtectedEntity(ctx, astrolabe.NewProtectedEntityID(Typename, "pvc-uid-1"))
+	if err != nil {
+		t.Fatalf("GetProtectedEntity failed with err %v", err)
+	}
+	start := time.Now()
+	_, err = pe.Snapshot(ctx, nil)
+	if err == nil || !strings.Contains(err.Error(), "driver does not support snapshots") {
+		t.Fatalf("Expected the VolumeSnapshot error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Minute {
+		t.Fatalf("Snapshot waited %v after the VolumeSnapshot failed", elapsed)
+	}
+	volumeSnapshots, err := snapshotClient.SnapshotV1beta1().VolumeSnapshots("app").List(ctx, metav1.ListOptions{})
+	if err != nil || len(volumeSnapshots.Items) != 0 {
+		t.Fatalf("Expected the failed VolumeSnapshot to be deleted, got %v, err %v", volumeSnapshots, err)
+	}
+}
+
+func TestSnapshotStopsWaitingWhenContextDone(t *testing.T) {
+	petm, _, snapshotClient := newTestPETM(t)
+	snapshotClient.PrependReactor("create", "volumesnapshots", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		// Never becomes ready
+		volumeSnapshot := action.(k8stesting.CreateAction).GetObject().(*snapshotv1beta1.VolumeSnapshot)
+		err := snapshotClient.Tracker().Create(action.GetResource(), volumeSnapshot, action.GetNamespace())
+		return true, volumeSnapshot, err
+	})
+	pe, err := petm.GetProtectedEntity(context.Background(), astrolabe.NewProtectedEntityID(Typename, "pvc-uid-1"))
+	if err != nil {
+		t.Fatalf("GetProtectedEntity failed with err %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if _, err := pe.Snapshot(ctx, nil); err == nil {
+		t.Fatalf("Snapshot succeeded without a ready VolumeSnapshot")
+	}
+	volumeSnapshots, err := snapshotClient.SnapshotV1beta1().VolumeSnapshots("app").List(context.Background(), metav1.ListOptions{})
+	if err != nil || len(volumeSnapshots.Items) != 0 {
+		t.Fatalf("Expected the VolumeSnapshot to be deleted, got %v, err %v", volumeSnapshots, err)
+	}
+}
+
+func TestCopyOptions(t *testing.T) {
+	ctx := context.Background()
+	petm, _, _ := newTestPETM(t)
+	pe, err := petm.GetProtectedEntity(ctx, astrolabe.NewProtectedEntityID(Typename, "pvc-uid-1"))
+	if err != nil {
+		t.Fatalf("GetProtectedEntity failed with err %v", err)
+	}
+	if _, err := petm.Copy(ctx, pe, nil, astrolabe.AllocateNewObject); err == nil {
+		t.Fatalf("Copy of a live PVC succeeded")
+	}
+	snapshotID, err := pe.Snapshot(ctx, nil)
+	if err != nil {
+		t.Fatalf("Snapshot failed with err %v", err)
+	}
+	snapshotPE, err := petm.GetProtectedEntity(ctx, pe.GetID().IDWithSnapshot(snapshotID))
+	if err != nil {
+		t.Fatalf("GetProtectedEntity for snapshot failed with err %v", err)
+	}
+	for _, options := range []astrolabe.CopyCreateOptions{astrolabe.UpdateExistingObject, astrolabe.AllocateObjectWithID} {
+		if _, err := petm.Copy(ctx, snapshotPE, nil, options); err == nil {
+			t.Fatalf("Copy with option %d succeeded", options)
+		}
+	}
+}